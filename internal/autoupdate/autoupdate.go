@@ -7,16 +7,21 @@
 package autoupdate
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/metric"
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/restrict"
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/restrict/collection"
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/restrict/perm"
@@ -45,7 +50,13 @@ const (
 	datastoreCacheResetTime = 24 * time.Hour
 )
 
-var envConcurentWorker = environment.NewVariable("CONCURENT_WORKER", "0", "Amount of clients that calculate there values at the same time. Default to GOMAXPROCS.")
+var (
+	envConcurentWorker = environment.NewVariable("CONCURENT_WORKER", "0", "Amount of clients that calculate there values at the same time. Default to GOMAXPROCS.")
+	envQueueSize       = environment.NewVariable("AUTOUPDATE_QUEUE_SIZE", "0", "Amount of clients that can wait for a worker. Other clients get an error. Zero means no limit.")
+	envQueueTimeout    = environment.NewVariable("AUTOUPDATE_QUEUE_TIMEOUT", "0s", "Maximum time a client waits for a worker before it gets an error. Zero means no limit.")
+	envLoadInterval    = environment.NewVariable("AUTOUPDATE_LOAD_INTERVAL", "0s", "Minimum time between two messages of a connection, when all workers are busy. Changes in this time are sent in one message. Zero disables it.")
+	envHistoryMode     = environment.NewVariable("HISTORY_MODE", "admin", "Who can see the history. `admin` allows organization managers and meeting admins. `permission` also allows users with meeting.can_see_history and restricts the data with the normal rules at the position.")
+)
 
 // Datastore is the source for the data.
 type Datastore interface {
@@ -58,6 +69,7 @@ type Datastore interface {
 		f func(ctx context.Context, key dskey.Key, changed map[dskey.Key][]byte) ([]byte, error),
 	)
 	HistoryInformation(ctx context.Context, fqid string, w io.Writer) error
+	LastUpdateID() datastore.UpdateID
 }
 
 // KeysBuilder holds the keys that are requested by a user.
@@ -75,6 +87,31 @@ type Autoupdate struct {
 	topic      *topic.Topic[dskey.Key]
 	restricter RestrictMiddleware
 	pool       *workPool
+	updateIDs  updateIDs
+	shared     sharedRegistry
+
+	// historyRestricted is true, if the history is restricted with the normal
+	// restriction rules for users with meeting.can_see_history.
+	historyRestricted bool
+
+	// loadInterval is the minimum time between two messages of a
+	// connection, when all workers are busy.
+	loadInterval time.Duration
+
+	// cacheResets counts the resets of the datastore cache. Connections do
+	// not reuse old results after a reset.
+	cacheResets atomic.Uint64
+
+	// priorities caches the priority of each user for the topic id, it was
+	// calculated with. It is cleared with the datastore cache.
+	prioritiesMu sync.Mutex
+	priorities   map[int]cachedPriority
+}
+
+// cachedPriority is the priority of a user at a topic id.
+type cachedPriority struct {
+	tid  uint64
+	prio priority
 }
 
 // New creates a new autoupdate service.
@@ -91,11 +128,38 @@ func New(lookup environment.Environmenter, ds Datastore, restricter RestrictMidd
 		workers = runtime.GOMAXPROCS(0)
 	}
 
+	var historyRestricted bool
+	switch mode := envHistoryMode.Value(lookup); mode {
+	case "admin":
+	case "permission":
+		historyRestricted = true
+	default:
+		return nil, nil, fmt.Errorf("invalid value for %s: %s, expected admin or permission", envHistoryMode.Key, mode)
+	}
+
+	queueSize, err := strconv.Atoi(envQueueSize.Value(lookup))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid value for %s: %w", envQueueSize.Key, err)
+	}
+
+	queueTimeout, err := environment.ParseDuration(envQueueTimeout.Value(lookup))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid value for %s, expected duration got %s: %w", envQueueTimeout.Key, envQueueTimeout.Value(lookup), err)
+	}
+
+	loadInterval, err := environment.ParseDuration(envLoadInterval.Value(lookup))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid value for %s, expected duration got %s: %w", envLoadInterval.Key, envLoadInterval.Value(lookup), err)
+	}
+
 	a := &Autoupdate{
 		datastore:  ds,
 		topic:      topic.New[dskey.Key](),
 		restricter: restricter,
-		pool:       newWorkPool(workers),
+		pool:       newWorkPool(workers, queueSize, queueTimeout),
+
+		historyRestricted: historyRestricted,
+		loadInterval:      loadInterval,
 	}
 
 	// Update the topic when an data update is received.
@@ -105,7 +169,8 @@ func New(lookup environment.Environmenter, ds Datastore, restricter RestrictMidd
 			keys = append(keys, k)
 		}
 
-		a.topic.Publish(keys...)
+		tid := a.topic.Publish(keys...)
+		a.updateIDs.add(tid, a.datastore.LastUpdateID())
 		return nil
 	})
 
@@ -120,21 +185,142 @@ func New(lookup environment.Environmenter, ds Datastore, restricter RestrictMidd
 // DataProvider is a function that returns the next data for a user.
 type DataProvider func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool)
 
+// ConnectOption changes the behavior of a connection created with Connect().
+type ConnectOption func(*connection)
+
+// WithResume lets the connection resume after the topic id of an older
+// connection.
+//
+// The first message only contains the keys, that have changed since this id. If
+// the topic id is unknown, for example because it was already pruned, the
+// first message contains all data.
+func WithResume(tid uint64) ConnectOption {
+	return func(c *connection) {
+		c.resumeTID = tid
+	}
+}
+
+// WithTopicID registers a function that is called with the topic id of each
+// message before the message is returned.
+//
+// The topic id can be used with WithResume() to resume the connection.
+func WithTopicID(f func(tid uint64)) ConnectOption {
+	return func(c *connection) {
+		c.onTopicID = f
+	}
+}
+
+// WithMinInterval sets the minimum time between two messages of the
+// connection. All changes in this time are sent in one message.
+//
+// If all workers are busy, the server can enforce a higher interval.
+func WithMinInterval(interval time.Duration) ConnectOption {
+	return func(c *connection) {
+		c.minInterval = interval
+	}
+}
+
+// WithOwnComputation lets the connection compute its data without sharing it
+// with other connections of the same user with the same keys.
+//
+// This is needed, if the caller uses the state of the keysbuilder after each
+// message, since the keysbuilder of a shared connection is not always updated.
+func WithOwnComputation() ConnectOption {
+	return func(c *connection) {
+		c.ownComputation = true
+	}
+}
+
+// WithKeysBuilderUpdates lets the connection listen for new keysbuilders.
+//
+// When a keysbuilder is received, it replaces the current keysbuilder. The next
+// message only contains the keys that are new or have changed. Keys, that are
+// not requested anymore, are sent with the value nil.
+func WithKeysBuilderUpdates(updates <-chan KeysBuilder) ConnectOption {
+	return func(c *connection) {
+		c.kbUpdates = updates
+	}
+}
+
+// WithPreviousValues registers a function that is called before each message
+// is returned. It is called with the values of the keys of the message, that
+// where sent to the client before. Keys, that where not sent before, are not in
+// the map.
+//
+// This can be used to send the difference to the old value instead of the new
+// value.
+func WithPreviousValues(f func(previous map[dskey.Key][]byte)) ConnectOption {
+	return func(c *connection) {
+		c.filter.keepValues = true
+		c.onPrevious = f
+	}
+}
+
+// WithKnownHashes tells the connection, which values the client already has.
+// The hashes have to be created with ValueHash.
+//
+// The first message does not contain the keys, where the value has the same
+// hash. It is ignored, if the connection is resumed with WithResume.
+func WithKnownHashes(hashes map[dskey.Key]uint64) ConnectOption {
+	return func(c *connection) {
+		c.knownHashes = hashes
+	}
+}
+
+// WithUpdateID registers a function that is called before each message is
+// returned. It is called with the id of the datastore update, that the message
+// reflects.
+func WithUpdateID(f func(id datastore.UpdateID)) ConnectOption {
+	return func(c *connection) {
+		c.onUpdateID = f
+	}
+}
+
+// Metric adds the values of the work pool to the metric.
+//
+// It has to be registered with metric.Register once.
+func (a *Autoupdate) Metric(values metric.Container) {
+	a.pool.metric(values)
+}
+
+// LastUpdateID returns the id of the last datastore update, that the service
+// has processed.
+func (a *Autoupdate) LastUpdateID() datastore.UpdateID {
+	return a.updateIDs.get(a.topic.LastID())
+}
+
 // Connect has to be called by a client to register to the service. The method
 // returns a Connection object, that can be used to receive the data.
 //
 // There is no need to "close" the returned DataProvider.
-func (a *Autoupdate) Connect(ctx context.Context, userID int, kb KeysBuilder) (DataProvider, error) {
-	skipWorkpool, err := a.skipWorkpool(ctx, userID)
+func (a *Autoupdate) Connect(ctx context.Context, userID int, kb KeysBuilder, options ...ConnectOption) (DataProvider, error) {
+	prio, err := a.priority(ctx, userID)
 	if err != nil {
-		return nil, fmt.Errorf("check if workpool should be used: %w", err)
+		return nil, fmt.Errorf("get priority of connection: %w", err)
 	}
 
 	c := &connection{
-		autoupdate:   a,
-		uid:          userID,
-		kb:           kb,
-		skipWorkpool: skipWorkpool,
+		autoupdate: a,
+		uid:        userID,
+		kb:         kb,
+		priority:   prio,
+	}
+
+	for _, o := range options {
+		o(c)
+	}
+
+	// The keysbuilder of a shared connection is only updated by the shared
+	// computation. Connections, that update or read it otherwise, compute
+	// their own data.
+	shareable := c.kbUpdates == nil && c.playback == nil && c.resumeTID == 0 && !c.ownComputation
+	if fp, ok := kb.(fingerprinter); ok && shareable {
+		shared, detach := a.shared.attach(sharedKey{uid: userID, kb: fp.Fingerprint()}, c)
+		c.shared = shared
+		go func() {
+			<-ctx.Done()
+			detach()
+		}()
 	}
 
 	return c.Next, nil
@@ -149,10 +335,115 @@ func (a *Autoupdate) SingleData(ctx context.Context, userID int, kb KeysBuilder,
 	ctx, restricter = a.restricter(ctx, a.datastore, userID)
 
 	if position != 0 {
-		getter := datastore.NewGetPosition(a.datastore, position)
-		restricter = restrict.NewHistory(a.datastore, getter, userID)
+		restricter = a.history(userID, position)
+	}
+
+	return singleData(ctx, restricter, kb)
+}
+
+// history returns a getter for the data at a position, that is restricted for
+// the user.
+func (a *Autoupdate) history(userID int, position int) datastore.Getter {
+	getter := datastore.NewGetPosition(a.datastore, position)
+	if a.historyRestricted {
+		return restrict.NewHistoryRestricted(a.datastore, getter, userID)
+	}
+	return restrict.NewHistory(a.datastore, getter, userID)
+}
+
+// SingleRequest is one request for BatchData.
+type SingleRequest struct {
+	KeysBuilder KeysBuilder
+
+	// Position is the position in the history. Zero means the current data.
+	Position int
+}
+
+// SingleResult is the result of one request from BatchData.
+type SingleResult struct {
+	Data map[dskey.Key][]byte
+	Err  error
+}
+
+// BatchData is like SingleData for many requests. All requests share the
+// caches of the restricter.
+//
+// The result for each request is at the same index as the request. An error
+// for one request does not stop the others. The batch uses one worker of the
+// work pool. The returned error is only set, if the batch did not get a worker.
+func (a *Autoupdate) BatchData(ctx context.Context, userID int, requests []SingleRequest) ([]SingleResult, error) {
+	prio, err := a.priority(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("get priority of batch: %w", err)
 	}
 
+	done, err := a.pool.Wait(ctx, userID, prio)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	ctx, restricter := a.restricter(ctx, a.datastore, userID)
+	history := make(map[int]datastore.Getter)
+
+	results := make([]SingleResult, len(requests))
+	for i, request := range requests {
+		getter := restricter
+		if request.Position != 0 {
+			historyGetter, ok := history[request.Position]
+			if !ok {
+				historyGetter = a.history(userID, request.Position)
+				history[request.Position] = historyGetter
+			}
+			getter = historyGetter
+		}
+
+		data, err := singleData(ctx, getter, request.KeysBuilder)
+		results[i] = SingleResult{Data: data, Err: err}
+	}
+
+	return results, nil
+}
+
+// ValueDiff is the value of a key at two positions. A nil value means, that
+// the key does not exist or the user can not see it.
+type ValueDiff struct {
+	Old []byte
+	New []byte
+}
+
+// HistoryDiff returns the keys of the keysbuilder, that differ between the
+// positions from and to. The values are restricted like the data of a
+// request with a position.
+func (a *Autoupdate) HistoryDiff(ctx context.Context, userID int, kb KeysBuilder, from, to int) (map[dskey.Key]ValueDiff, error) {
+	oldData, err := singleData(ctx, a.history(userID, from), kb)
+	if err != nil {
+		return nil, fmt.Errorf("getting data at position %d: %w", from, err)
+	}
+
+	newData, err := singleData(ctx, a.history(userID, to), kb)
+	if err != nil {
+		return nil, fmt.Errorf("getting data at position %d: %w", to, err)
+	}
+
+	diff := make(map[dskey.Key]ValueDiff)
+	for key, oldValue := range oldData {
+		if newValue := newData[key]; !bytes.Equal(oldValue, newValue) {
+			diff[key] = ValueDiff{Old: oldValue, New: newValue}
+		}
+	}
+
+	for key, newValue := range newData {
+		if _, ok := oldData[key]; !ok {
+			diff[key] = ValueDiff{New: newValue}
+		}
+	}
+
+	return diff, nil
+}
+
+// singleData returns the data for a keysbuilder from the restricter.
+func singleData(ctx context.Context, restricter datastore.Getter, kb KeysBuilder) (map[dskey.Key][]byte, error) {
 	keys, err := kb.Update(ctx, restricter)
 	if err != nil {
 		return nil, fmt.Errorf("create keys for keysbuilder: %w", err)
@@ -184,6 +475,7 @@ func (a *Autoupdate) pruneOldData(ctx context.Context) {
 			return
 		case <-tick.C:
 			a.topic.Prune(time.Now().Add(-pruneTime))
+			a.updateIDs.prune(time.Now().Add(-pruneTime))
 		}
 	}
 }
@@ -200,6 +492,11 @@ func (a *Autoupdate) resetCache(ctx context.Context) {
 			return
 		case <-tick.C:
 			a.datastore.ResetCache()
+			a.cacheResets.Add(1)
+
+			a.prioritiesMu.Lock()
+			a.priorities = nil
+			a.prioritiesMu.Unlock()
 		}
 	}
 }
@@ -311,32 +608,143 @@ func (a *Autoupdate) RestrictFQIDs(ctx context.Context, userID int, fqids []stri
 	return result, nil
 }
 
-// skipWorkpool desides, if a connection is allowed to skip the workpool.
+// priority decides the class of a connection in the workpool.
 //
-// The current implementation returns true, if the user is a meeting admin in
-// one meeting.
-func (a *Autoupdate) skipWorkpool(ctx context.Context, userID int) (bool, error) {
+// The class is cached for each user until the next data update.
+func (a *Autoupdate) priority(ctx context.Context, userID int) (priority, error) {
 	if userID == 0 {
-		return false, nil
+		return priorityAnonymous, nil
+	}
+
+	// Take the topic id before the calculation. If the data changes in the
+	// meantime, the next call calculates the priority again.
+	tid := a.topic.LastID()
+
+	a.prioritiesMu.Lock()
+	cached, ok := a.priorities[userID]
+	a.prioritiesMu.Unlock()
+
+	if ok && cached.tid == tid {
+		return cached.prio, nil
+	}
+
+	prio, err := a.calculatePriority(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	a.prioritiesMu.Lock()
+	defer a.prioritiesMu.Unlock()
+
+	if a.priorities == nil {
+		a.priorities = make(map[int]cachedPriority)
 	}
+	a.priorities[userID] = cachedPriority{tid: tid, prio: prio}
+	return prio, nil
+}
 
+// calculatePriority calculates the class of a user for the workpool.
+//
+// The class only depends on the user and not on the requested data. A user,
+// that is not a physical person and can see the projector in a meeting, is a
+// projector screen. A user, that can manage the projector in a meeting without
+// being an admin there, is a presenter. Meeting admins and organization
+// managers are admins. All other users are delegates.
+func (a *Autoupdate) calculatePriority(ctx context.Context, userID int) (priority, error) {
 	ds := dsfetch.New(a.datastore)
 
-	meetingIDs := ds.User_GroupIDsTmpl(userID).ErrorLater(ctx)
+	// is_physical_person defaults to true, so a missing value is not the same
+	// as false.
+	physicalKey := dskey.Key{Collection: "user", ID: userID, Field: "is_physical_person"}
+	values, err := a.datastore.Get(ctx, physicalKey)
+	if err != nil {
+		return 0, fmt.Errorf("check if user %d is a physical person: %w", userID, err)
+	}
+	isScreen := bytes.Equal(values[physicalKey], []byte("false"))
+
+	isManager, err := perm.HasOrganizationManagementLevel(ctx, ds, userID, perm.OMLCanManageOrganization)
+	if err != nil {
+		return 0, fmt.Errorf("check organization management level of user %d: %w", userID, err)
+	}
+
+	meetingIDs, err := ds.User_GroupIDsTmpl(userID).Value(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("get meetings of user %d: %w", userID, err)
+	}
 
+	var isProjector, isPresenter, isAdmin bool
 	for _, mid := range meetingIDs {
-		gids := ds.User_GroupIDs(userID, mid).ErrorLater(ctx)
-		for _, gid := range gids {
-			if _, ok := ds.Group_AdminGroupForMeetingID(gid).ErrorLater(ctx); ok {
-				return true, nil
-			}
+		p, err := perm.New(ctx, ds, userID, mid)
+		if err != nil {
+			return 0, fmt.Errorf("get permissions of user %d in meeting %d: %w", userID, mid, err)
 		}
+
+		isProjector = isProjector || isScreen && p.Has(perm.ProjectorCanSee)
+		isPresenter = isPresenter || !p.IsAdmin() && p.Has(perm.ProjectorCanManage)
+		isAdmin = isAdmin || p.IsAdmin()
+	}
+
+	switch {
+	case isProjector:
+		return priorityProjector, nil
+	case isPresenter:
+		return priorityPresenter, nil
+	case isAdmin || isManager:
+		return priorityAdmin, nil
+	default:
+		return priorityDelegate, nil
 	}
-	if err := ds.Err(); err != nil {
-		return false, fmt.Errorf("check if user %d is a meeting admin: %w", userID, err)
+}
+
+// BroadcastScope returns a value, that is the same for users, that get the
+// same data from the restricter for data, that is not about a single user.
+// Returns an empty string, if the user should not share its data.
+//
+// Only users, that are not a physical person, like projector screens, share
+// data. The scope are the groups of the user in each meeting and its
+// organization management level. Fields, that are restricted for each user,
+// for example the own user object, can still differ.
+func (a *Autoupdate) BroadcastScope(ctx context.Context, userID int) (string, error) {
+	if userID == 0 {
+		return "", nil
 	}
 
-	return false, nil
+	// is_physical_person defaults to true, so a missing value is not the same
+	// as false.
+	physicalKey := dskey.Key{Collection: "user", ID: userID, Field: "is_physical_person"}
+	values, err := a.datastore.Get(ctx, physicalKey)
+	if err != nil {
+		return "", fmt.Errorf("check if user %d is a physical person: %w", userID, err)
+	}
+
+	if !bytes.Equal(values[physicalKey], []byte("false")) {
+		return "", nil
+	}
+
+	ds := dsfetch.New(a.datastore)
+
+	oml, err := ds.User_OrganizationManagementLevel(userID).Value(ctx)
+	if err != nil {
+		return "", fmt.Errorf("get organization management level of user %d: %w", userID, err)
+	}
+
+	meetingIDs, err := ds.User_GroupIDsTmpl(userID).Value(ctx)
+	if err != nil {
+		return "", fmt.Errorf("get meetings of user %d: %w", userID, err)
+	}
+	sort.Ints(meetingIDs)
+
+	scope := []string{"oml:" + oml}
+	for _, mid := range meetingIDs {
+		groupIDs, err := ds.User_GroupIDs(userID, mid).Value(ctx)
+		if err != nil {
+			return "", fmt.Errorf("get groups of user %d in meeting %d: %w", userID, mid, err)
+		}
+		sort.Ints(groupIDs)
+
+		scope = append(scope, fmt.Sprintf("meeting/%d:%v", mid, groupIDs))
+	}
+	return strings.Join(scope, ";"), nil
 }
 
 type permissionDeniedError struct {
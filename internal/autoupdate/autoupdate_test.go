@@ -6,10 +6,13 @@ import (
 	"encoding/json"
 	"errors"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/keysbuilder"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dsmock"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/environment"
 )
@@ -38,6 +41,163 @@ func TestSingleDataEmptyValues(t *testing.T) {
 	}
 }
 
+func TestBatchData(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, _ := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		user/1/username: hugo
+		user/2/username: emil
+	`))
+
+	var restricterCalls int
+	restricter := func(ctx context.Context, getter datastore.Getter, uid int) (context.Context, datastore.Getter) {
+		restricterCalls++
+		return RestrictAllowed(ctx, getter, uid)
+	}
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, restricter)
+
+	kb1, _ := keysbuilder.FromKeys("user/1/username")
+	kb2, _ := keysbuilder.FromKeys("user/2/username")
+	kbInvalid, err := keysbuilder.ManyFromJSON(strings.NewReader(`[{"ids":[1],"collection":"user","fields":{"username":{"type":"relation","collection":"user","fields":{"username":null}}}}]`))
+	if err != nil {
+		t.Fatalf("creating keysbuilder: %v", err)
+	}
+
+	results, err := s.BatchData(ctx, 1, []autoupdate.SingleRequest{
+		{KeysBuilder: kb1},
+		{KeysBuilder: kbInvalid},
+		{KeysBuilder: kb2},
+	})
+	if err != nil {
+		t.Fatalf("BatchData: %v", err)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("got %d results, expected 3", len(results))
+	}
+
+	if got := string(results[0].Data[dskey.MustKey("user/1/username")]); got != `"hugo"` || results[0].Err != nil {
+		t.Errorf("first result is %s, %v, expected \"hugo\"", got, results[0].Err)
+	}
+
+	if results[1].Err == nil {
+		t.Errorf("second result has no error")
+	}
+
+	if got := string(results[2].Data[dskey.MustKey("user/2/username")]); got != `"emil"` || results[2].Err != nil {
+		t.Errorf("third result is %s, %v, expected \"emil\"", got, results[2].Err)
+	}
+
+	if restricterCalls != 1 {
+		t.Errorf("restricter was created %d times, expected once", restricterCalls)
+	}
+}
+
+func TestHistoryDiff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, _ := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		user/1/organization_management_level: superadmin
+	`))
+
+	ds := &historyDatastore{
+		MockDatastore: mock,
+		history: map[int]map[dskey.Key][]byte{
+			1: dsmock.YAMLData(`---
+				user/1/username: first
+				user/1/first_name: hugo
+				user/1/last_name: same
+			`),
+			2: dsmock.YAMLData(`---
+				user/1/username: second
+				user/1/last_name: same
+				user/1/title: dr
+			`),
+		},
+	}
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, RestrictAllowed)
+	kb, _ := keysbuilder.FromKeys("user/1/username", "user/1/first_name", "user/1/last_name", "user/1/title")
+
+	diff, err := s.HistoryDiff(ctx, 1, kb, 1, 2)
+	if err != nil {
+		t.Fatalf("HistoryDiff: %v", err)
+	}
+
+	expect := map[dskey.Key]autoupdate.ValueDiff{
+		dskey.MustKey("user/1/username"):   {Old: []byte(`"first"`), New: []byte(`"second"`)},
+		dskey.MustKey("user/1/first_name"): {Old: []byte(`"hugo"`)},
+		dskey.MustKey("user/1/title"):      {New: []byte(`"dr"`)},
+	}
+	if !reflect.DeepEqual(diff, expect) {
+		t.Errorf("got %v, expected %v", diff, expect)
+	}
+}
+
+func TestHistoryMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, _ := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		user/1:
+			group_$2_ids: [3]
+			meeting_ids: [2]
+		group/3/permissions: [meeting.can_see_history]
+		meeting/2/admin_group_id: 4
+	`))
+
+	ds := &historyDatastore{
+		MockDatastore: mock,
+		history: map[int]map[dskey.Key][]byte{
+			1: dsmock.YAMLData(`---
+				user/1:
+					group_$2_ids: [3]
+					meeting_ids: [2]
+				group/3/permissions: [agenda_item.can_see]
+				meeting/2/admin_group_id: 4
+				topic/5:
+					meeting_id: 2
+					title: foo
+			`),
+		},
+	}
+
+	kb, _ := keysbuilder.FromKeys("topic/5/title")
+
+	for _, tt := range []struct {
+		mode   string
+		expect map[dskey.Key][]byte
+	}{
+		{"admin", nil},
+		{"permission", map[dskey.Key][]byte{dskey.MustKey("topic/5/title"): []byte(`"foo"`)}},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			s, _, err := autoupdate.New(environment.ForTests{"HISTORY_MODE": tt.mode}, ds, RestrictAllowed)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+
+			data, err := s.SingleData(ctx, 1, kb, 1)
+			if err != nil {
+				t.Fatalf("SingleData: %v", err)
+			}
+
+			if !reflect.DeepEqual(data, tt.expect) {
+				t.Errorf("got %v, expected %v", data, tt.expect)
+			}
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		if _, _, err := autoupdate.New(environment.ForTests{"HISTORY_MODE": "everyone"}, ds, RestrictAllowed); err == nil {
+			t.Errorf("New did not return an error")
+		}
+	})
+}
+
 func TestHistoryInformation(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -63,6 +223,181 @@ func TestHistoryInformation(t *testing.T) {
 	}
 }
 
+func TestHistoryEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, _ := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		user/1/organization_management_level: superadmin
+		user/5:
+			first_name: Hugo
+			last_name: Boss
+		user/6/username: emil
+		motion/5/meeting_id: 1
+	`))
+
+	ds := &historyDatastore{
+		MockDatastore: mock,
+		history: map[int]map[dskey.Key][]byte{
+			1: dsmock.YAMLData(`---
+				motion/5:
+					meeting_id: 1
+					title: first
+			`),
+			2: dsmock.YAMLData(`---
+				motion/5:
+					meeting_id: 1
+					title: second
+			`),
+			3: dsmock.YAMLData(`---
+				motion/5:
+					meeting_id: 1
+					title: second
+					text: some text
+			`),
+		},
+		information: `{"motion/5":[
+			{"position":1,"user_id":5,"information":["Motion created"],"timestamp":100},
+			{"position":2,"user_id":6,"information":["Motion updated"],"timestamp":200},
+			{"position":3,"user_id":5,"information":["Motion updated"],"timestamp":300}
+		]}`,
+	}
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, RestrictAllowed)
+
+	for _, tt := range []struct {
+		name          string
+		filter        autoupdate.HistoryFilter
+		expectTotal   int
+		expectPos     []int
+		expectNames   []string
+		expectChanged [][]string
+	}{
+		{
+			"all",
+			autoupdate.HistoryFilter{},
+			3,
+			[]int{1, 2, 3},
+			[]string{"Hugo Boss", "emil", "Hugo Boss"},
+			[][]string{{"id", "meeting_id", "title"}, {"title"}, {"text"}},
+		},
+		{
+			"user",
+			autoupdate.HistoryFilter{UserID: 5},
+			2,
+			[]int{1, 3},
+			[]string{"Hugo Boss", "Hugo Boss"},
+			[][]string{{"id", "meeting_id", "title"}, {"text"}},
+		},
+		{
+			"time range",
+			autoupdate.HistoryFilter{From: 150, To: 300},
+			2,
+			[]int{2, 3},
+			[]string{"emil", "Hugo Boss"},
+			[][]string{{"title"}, {"text"}},
+		},
+		{
+			"page",
+			autoupdate.HistoryFilter{Offset: 1, Limit: 1},
+			3,
+			[]int{2},
+			[]string{"emil"},
+			[][]string{{"title"}},
+		},
+		{
+			"offset after end",
+			autoupdate.HistoryFilter{Offset: 5},
+			3,
+			nil,
+			nil,
+			nil,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, total, err := s.HistoryEntries(ctx, 1, "motion/5", tt.filter)
+			if err != nil {
+				t.Fatalf("HistoryEntries: %v", err)
+			}
+
+			if total != tt.expectTotal {
+				t.Errorf("got total %d, expected %d", total, tt.expectTotal)
+			}
+
+			var positions []int
+			var names []string
+			var changed [][]string
+			for _, entry := range entries {
+				positions = append(positions, entry.Position)
+				names = append(names, entry.UserName)
+				changed = append(changed, entry.ChangedFields)
+			}
+
+			if !reflect.DeepEqual(positions, tt.expectPos) {
+				t.Errorf("got positions %v, expected %v", positions, tt.expectPos)
+			}
+
+			if !reflect.DeepEqual(names, tt.expectNames) {
+				t.Errorf("got names %v, expected %v", names, tt.expectNames)
+			}
+
+			if !reflect.DeepEqual(changed, tt.expectChanged) {
+				t.Errorf("got changed fields %v, expected %v", changed, tt.expectChanged)
+			}
+		})
+	}
+}
+
+func TestHistoryEntriesHiddenFields(t *testing.T) {
+	mock, _ := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		user/1/organization_management_level: superadmin
+		user/5/username: hugo
+	`))
+
+	ds := &historyDatastore{
+		MockDatastore: mock,
+		history: map[int]map[dskey.Key][]byte{
+			1: dsmock.YAMLData(`---
+				user/5:
+					username: hugo
+					password: secret
+			`),
+			2: dsmock.YAMLData(`---
+				user/5:
+					username: hugo
+					password: other secret
+			`),
+		},
+		information: `{"user/5":[
+			{"position":1,"user_id":1,"information":["User created"],"timestamp":100},
+			{"position":2,"user_id":1,"information":["Password changed"],"timestamp":200}
+		]}`,
+	}
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, RestrictAllowed)
+
+	entries, _, err := s.HistoryEntries(context.Background(), 1, "user/5", autoupdate.HistoryFilter{})
+	if err != nil {
+		t.Fatalf("HistoryEntries: %v", err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, expected 2", len(entries))
+	}
+
+	for _, entry := range entries {
+		for _, field := range entry.ChangedFields {
+			if field == "password" {
+				t.Errorf("position %d: changed fields contain the password", entry.Position)
+			}
+		}
+	}
+
+	if entries[1].ChangedFields != nil {
+		t.Errorf("got changed fields %v at position 2, expected nil", entries[1].ChangedFields)
+	}
+}
+
 func TestHistoryInformationWrongFQID(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -141,3 +476,55 @@ func TestRestrictFQIDs(t *testing.T) {
 		t.Errorf("\nGot\t\t\t%v\nexpected\t%v", got, expect)
 	}
 }
+
+func TestBroadcastScope(t *testing.T) {
+	ds, _ := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+	user:
+		1:
+			group_$_ids: ["30"]
+			group_$30_ids: [3]
+			is_physical_person: false
+		2:
+			group_$_ids: ["30"]
+			group_$30_ids: [3]
+			is_physical_person: false
+		3:
+			group_$_ids: ["30"]
+			group_$30_ids: [2, 3]
+			is_physical_person: false
+		4:
+			group_$_ids: ["30"]
+			group_$30_ids: [3]
+	`))
+
+	s, _, err := autoupdate.New(environment.ForTests{}, ds, RestrictAllowed)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	scope := func(uid int) string {
+		t.Helper()
+
+		scope, err := s.BroadcastScope(context.Background(), uid)
+		if err != nil {
+			t.Fatalf("BroadcastScope(%d): %v", uid, err)
+		}
+		return scope
+	}
+
+	if scope(1) == "" || scope(1) != scope(2) {
+		t.Errorf("screens in the same groups got scopes %q and %q, expected the same", scope(1), scope(2))
+	}
+
+	if scope(1) == scope(3) {
+		t.Errorf("screens in other groups got the same scope %q", scope(1))
+	}
+
+	if got := scope(4); got != "" {
+		t.Errorf("physical person got scope %q, expected none", got)
+	}
+
+	if got := scope(0); got != "" {
+		t.Errorf("anonymous got scope %q, expected none", got)
+	}
+}
@@ -2,22 +2,54 @@ package autoupdate
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dsrecorder"
+	"github.com/ostcar/topic"
 )
 
 // connection holds the state of a client. It has to be created by colling
 // Connect() on a autoupdate.Service instance.
 type connection struct {
-	autoupdate   *Autoupdate
-	uid          int
-	kb           KeysBuilder
-	tid          uint64
-	filter       filter
-	skipWorkpool bool
-	hotkeys      map[dskey.Key]struct{}
+	autoupdate *Autoupdate
+	uid        int
+	kb         KeysBuilder
+	tid        uint64
+	filter     filter
+	priority   priority
+	hotkeys    map[dskey.Key]struct{}
+
+	resumeTID  uint64
+	onTopicID  func(uint64)
+	kbUpdates  <-chan KeysBuilder
+	onPrevious func(map[dskey.Key][]byte)
+
+	knownHashes map[dskey.Key]uint64
+	onUpdateID  func(datastore.UpdateID)
+
+	playback *playback
+
+	minInterval time.Duration
+	lastMessage time.Time
+
+	// shared is the computation, that the connection shares with other
+	// connections of the same user with the same keysbuilder. It is nil, if
+	// the keysbuilder can change or is used outside of the computation.
+	shared         *sharedComputation
+	ownComputation bool
+
+	// keys is the state of the last update of an incremental keysbuilder. It
+	// is nil, if all keys have to be built on the next update.
+	keys *keysState
+
+	// restriction is the state of the last restriction. It is nil, if all
+	// data has to be restricted on the next update.
+	restriction *restrictionState
 }
 
 // Next returns a function to fetch the next data.
@@ -53,23 +85,71 @@ type connection struct {
 // is never empty.
 func (c *connection) Next() (func(context.Context) (map[dskey.Key][]byte, error), bool) {
 	return func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		if c.playback != nil {
+			data, live, err := c.playbackData(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("playback: %w", err)
+			}
+
+			if !live {
+				return data, nil
+			}
+
+			if len(data) > 0 {
+				c.reportTopicID()
+				return data, nil
+			}
+		}
+
 		if c.filter.empty() {
+			if c.resumeTID != 0 {
+				data, err := c.resumedData(ctx)
+				if err != nil {
+					return nil, fmt.Errorf("creating resumed data: %w", err)
+				}
+
+				c.reportTopicID()
+				return data, nil
+			}
+
 			c.tid = c.autoupdate.topic.LastID()
+			if c.knownHashes != nil {
+				c.filter.seed(c.knownHashes)
+				c.knownHashes = nil
+			}
+
 			data, err := c.updatedData(ctx)
 			if err != nil {
 				return nil, fmt.Errorf("creating first time data: %w", err)
 			}
 
+			c.reportTopicID()
 			return data, nil
 		}
 
 		for {
-			// Blocks until new data or the context is done.
-			tid, changedKeys, err := c.autoupdate.topic.Receive(ctx, c.tid)
+			// Blocks until new data, a new keysbuilder or the context is done.
+			tid, changedKeys, kb, err := c.receive(ctx)
 			if err != nil {
 				// TODO EXTERMAL ERROR
 				return nil, fmt.Errorf("get updated keys: %w", err)
 			}
+
+			if kb != nil {
+				c.kb = kb
+				c.keys = nil
+				data, err := c.updatedDataWithRemoved(ctx)
+				if err != nil {
+					return nil, fmt.Errorf("creating data for new keysbuilder: %w", err)
+				}
+
+				if len(data) > 0 {
+					c.reportTopicID()
+					return data, nil
+				}
+				continue
+			}
+
 			c.tid = tid
 
 			foundKey := false
@@ -81,12 +161,17 @@ func (c *connection) Next() (func(context.Context) (map[dskey.Key][]byte, error)
 			}
 
 			if foundKey {
+				if err := c.coalesce(ctx); err != nil {
+					return nil, err
+				}
+
 				data, err := c.updatedData(ctx)
 				if err != nil {
 					return nil, fmt.Errorf("creating later data: %w", err)
 				}
 
 				if len(data) > 0 {
+					c.reportTopicID()
 					return data, nil
 				}
 			}
@@ -96,33 +181,244 @@ func (c *connection) Next() (func(context.Context) (map[dskey.Key][]byte, error)
 
 // updatedData returns all values from the datastore.getter.
 func (c *connection) updatedData(ctx context.Context) (map[dskey.Key][]byte, error) {
-	if !c.skipWorkpool {
-		done, err := c.autoupdate.pool.Wait(ctx)
-		if err != nil {
-			return nil, err
-		}
-		defer done()
+	data, err := c.currentData(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.filter.filter(data)
+
+	return data, nil
+}
+
+// updatedDataWithRemoved is like updatedData but also returns the keys with
+// the value nil, that where sent before but are not requested anymore.
+func (c *connection) updatedDataWithRemoved(ctx context.Context) (map[dskey.Key][]byte, error) {
+	data, err := c.currentData(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.filter.addRemoved(data)
+	c.filter.filter(data)
+
+	return data, nil
+}
+
+// receive blocks until there is new data in the topic or a new keysbuilder.
+//
+// If a new keysbuilder was received, the other return values are empty.
+func (c *connection) receive(ctx context.Context) (uint64, []dskey.Key, KeysBuilder, error) {
+	if c.kbUpdates == nil {
+		tid, changedKeys, err := c.autoupdate.topic.Receive(ctx, c.tid)
+		return tid, changedKeys, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type topicResult struct {
+		tid         uint64
+		changedKeys []dskey.Key
+		err         error
 	}
 
-	recorder := dsrecorder.New(c.autoupdate.datastore)
-	ctx, restricter := c.autoupdate.restricter(ctx, recorder, c.uid)
+	received := make(chan topicResult, 1)
+	go func() {
+		tid, changedKeys, err := c.autoupdate.topic.Receive(ctx, c.tid)
+		received <- topicResult{tid, changedKeys, err}
+	}()
 
-	keys, err := c.kb.Update(ctx, restricter)
+	select {
+	case kb := <-c.kbUpdates:
+		// The result from the topic is discarded. Since c.tid is not updated,
+		// the next call to receive returns the same keys.
+		cancel()
+		<-received
+		return 0, nil, kb, nil
+
+	case r := <-received:
+		return r.tid, r.changedKeys, nil, r.err
+	}
+}
+
+// currentData returns the restricted data for the keysbuilder from the
+// datastore. It also updates the hotkeys.
+//
+// If the connection shares its computation, the data is only computed once for
+// all connections with the same topic id.
+func (c *connection) currentData(ctx context.Context) (map[dskey.Key][]byte, error) {
+	if c.shared == nil {
+		return c.restrictedData(ctx, c.autoupdate.datastore)
+	}
+
+	data, hotkeys, err := c.shared.get(ctx, c.tid)
+	if err != nil {
+		return nil, err
+	}
+
+	c.hotkeys = hotkeys
+	return data, nil
+}
+
+// restrictedData returns the restricted data for the keysbuilder. It also
+// updates the hotkeys.
+func (c *connection) restrictedData(ctx context.Context, getter datastore.Getter) (map[dskey.Key][]byte, error) {
+	done, err := c.autoupdate.pool.Wait(ctx, c.uid, c.priority)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	recorder := dsrecorder.New(getter)
+	counter := newReadCounter(recorder)
+	ctx, restricter := c.autoupdate.restricter(ctx, counter, c.uid)
+
+	keys, err := c.buildKeys(ctx, restricter, counter)
 	if err != nil {
 		return nil, fmt.Errorf("create keys for keysbuilder: %w", err)
 	}
 
-	data, err := restricter.Get(ctx, keys...)
+	data, err := c.restrict(ctx, restricter, keys)
 	if err != nil {
 		return nil, fmt.Errorf("get restricted data: %w", err)
 	}
+
+	// If the keys or the data were only rebuilt partly, the keys, that were
+	// read to build the other parts, are not in the recorder.
 	c.hotkeys = recorder.Keys()
+	if c.keys != nil {
+		for key := range c.keys.reads {
+			c.hotkeys[key] = struct{}{}
+		}
+	}
 
-	c.filter.filter(data)
+	if c.restriction != nil {
+		c.restriction.state.AddKeys(c.hotkeys)
+	}
 
 	return data, nil
 }
 
+// resumedData returns the data for a connection, that resumes after
+// c.resumeTID.
+//
+// It only returns the keys, that have changed since the topic id. If this can
+// not be determined, all data is returned.
+func (c *connection) resumedData(ctx context.Context) (map[dskey.Key][]byte, error) {
+	changedKeys, known, err := c.changedSince(ctx, c.resumeTID)
+	if err != nil {
+		return nil, fmt.Errorf("get changed keys since %d: %w", c.resumeTID, err)
+	}
+
+	counter := newReadCounter(c.autoupdate.datastore)
+	data, err := c.restrictedData(ctx, counter)
+	if err != nil {
+		return nil, err
+	}
+
+	if !known {
+		c.filter.filter(data)
+		return data, nil
+	}
+
+	// If a changed key was used to find or restrict other keys, all data has
+	// to be sent.
+	resumed := make(map[dskey.Key][]byte)
+	for _, key := range changedKeys {
+		count := counter.count(key)
+		if count == 0 {
+			continue
+		}
+
+		value, isData := data[key]
+		if readAsDependency(count) || !isData {
+			c.filter.filter(data)
+			return data, nil
+		}
+
+		resumed[key] = value
+	}
+
+	c.filter.filter(data)
+	return resumed, nil
+}
+
+// changedSince returns all keys, that have changed since the topic id and
+// sets c.tid to the current topic id.
+//
+// The second return value is false, if the topic id is unknown.
+func (c *connection) changedSince(ctx context.Context, tid uint64) ([]dskey.Key, bool, error) {
+	lastID := c.autoupdate.topic.LastID()
+	c.tid = lastID
+
+	if tid > lastID {
+		// The id is from the future, for example from before a restart.
+		return nil, false, nil
+	}
+
+	if tid == lastID {
+		return nil, true, nil
+	}
+
+	lastID, changedKeys, err := c.autoupdate.topic.Receive(ctx, tid)
+	if err != nil {
+		var errUnknownID topic.UnknownIDError
+		if errors.As(err, &errUnknownID) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	c.tid = lastID
+
+	return changedKeys, true, nil
+}
+
+// coalesce blocks until the minimum interval since the last message is over.
+// The changes in this time are part of the next message.
+func (c *connection) coalesce(ctx context.Context) error {
+	interval := c.minInterval
+	if c.autoupdate.loadInterval > interval && c.autoupdate.pool.busy() {
+		interval = c.autoupdate.loadInterval
+	}
+
+	wait := time.Until(c.lastMessage.Add(interval))
+	if interval == 0 || wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// The next message is created from the current data. So it contains all
+	// changes until now.
+	c.tid = c.autoupdate.topic.LastID()
+	return nil
+}
+
+// reportTopicID calls the registered functions for a message.
+func (c *connection) reportTopicID() {
+	c.lastMessage = time.Now()
+
+	if c.onTopicID != nil {
+		c.onTopicID(c.tid)
+	}
+
+	if c.onPrevious != nil {
+		c.onPrevious(c.filter.previous)
+	}
+
+	if c.onUpdateID != nil {
+		c.onUpdateID(c.autoupdate.updateIDs.get(c.tid))
+	}
+}
+
 // notInSlice returns elements that are in slice a but not in b.
 func notInSlice(a, b []dskey.Key) []dskey.Key {
 	bSet := make(map[dskey.Key]struct{}, len(b))
@@ -138,3 +434,56 @@ func notInSlice(a, b []dskey.Key) []dskey.Key {
 	}
 	return missing
 }
+
+// readCounter is a datastore.Getter that counts, how often each key is
+// requested.
+type readCounter struct {
+	getter datastore.Getter
+
+	mu     sync.Mutex
+	counts map[dskey.Key]int
+}
+
+func newReadCounter(getter datastore.Getter) *readCounter {
+	return &readCounter{
+		getter: getter,
+		counts: make(map[dskey.Key]int),
+	}
+}
+
+func (r *readCounter) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	r.mu.Lock()
+	for _, k := range keys {
+		r.counts[k]++
+	}
+	r.mu.Unlock()
+
+	return r.getter.Get(ctx, keys...)
+}
+
+// reset returns the counts and starts counting from zero.
+func (r *readCounter) reset() map[dskey.Key]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counts := r.counts
+	r.counts = make(map[dskey.Key]int)
+	return counts
+}
+
+func (r *readCounter) count(key dskey.Key) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.counts[key]
+}
+
+// readAsDependency returns true, if a key, that was read count times while the
+// data was calculated, could have changed the value of other keys.
+//
+// A key that is only read once was only read as requested data. A key that is
+// read more often was also used by the keysbuilder or the restricter. If it
+// changes, other keys could become visible or invisible.
+func readAsDependency(count int) bool {
+	return count > 1
+}
@@ -3,12 +3,16 @@ package autoupdate_test
 import (
 	"context"
 	"errors"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/keysbuilder"
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/oserror"
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/restrict"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dsmock"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/environment"
@@ -484,3 +488,555 @@ func TestKeyRequestedAgain(t *testing.T) {
 		t.Errorf("Got organization_tag/2/id: %q, expected 2", v)
 	}
 }
+
+func TestConnectionResume(t *testing.T) {
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, bg := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		organization/1/organization_tag_ids: [1]
+		organization_tag/1/name: tag1
+		organization_tag/2/name: tag2
+		user/1/name: Hello World
+		user/1/username: hello
+	`))
+	go bg(shutdownCtx, oserror.Handle)
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, RestrictAllowed)
+
+	newKB := func() autoupdate.KeysBuilder {
+		kb, err := keysbuilder.ManyFromJSON(strings.NewReader(`[
+			{"collection":"user","ids":[1],"fields":{"name":null,"username":null}},
+			{
+				"collection":"organization",
+				"ids":[1],
+				"fields":{
+					"organization_tag_ids":{
+						"type":"relation-list",
+						"collection":"organization_tag",
+						"fields":{"name":null}
+					}
+				}
+			}
+		]`))
+		if err != nil {
+			t.Fatalf("Can not build request: %v", err)
+		}
+		return kb
+	}
+
+	var tid uint64
+	conn, err := s.Connect(shutdownCtx, 1, newKB(), autoupdate.WithTopicID(func(id uint64) { tid = id }))
+	if err != nil {
+		t.Fatalf("creating conection: %v", err)
+	}
+	next, _ := conn()
+
+	if _, err := next(shutdownCtx); err != nil {
+		t.Fatalf("Getting first data: %v", err)
+	}
+
+	// sendAndWait sends data to the datastore and returns the topic id after
+	// the change.
+	sendAndWait := func(data map[dskey.Key][]byte) uint64 {
+		ds.Send(data)
+		if _, err := next(shutdownCtx); err != nil {
+			t.Fatalf("Getting data: %v", err)
+		}
+		return tid
+	}
+
+	firstID := sendAndWait(dsmock.YAMLData(`user/1/name: new name`))
+	secondID := sendAndWait(dsmock.YAMLData(`user/1/username: new username`))
+
+	resume := func(tid uint64) map[dskey.Key][]byte {
+		conn, err := s.Connect(shutdownCtx, 1, newKB(), autoupdate.WithResume(tid))
+		if err != nil {
+			t.Fatalf("creating conection: %v", err)
+		}
+		next, _ := conn()
+
+		data, err := next(shutdownCtx)
+		if err != nil {
+			t.Fatalf("Getting resumed data: %v", err)
+		}
+		return data
+	}
+
+	t.Run("changed key", func(t *testing.T) {
+		got := resume(firstID)
+
+		expect := map[dskey.Key][]byte{dskey.MustKey("user/1/username"): []byte(`"new username"`)}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("Got %v, expected %v", got, expect)
+		}
+	})
+
+	t.Run("nothing changed", func(t *testing.T) {
+		got := resume(secondID)
+
+		if len(got) != 0 {
+			t.Errorf("Got %v, expected empty data", got)
+		}
+	})
+
+	t.Run("unknown id", func(t *testing.T) {
+		got := resume(secondID + 100)
+
+		if len(got) != 4 {
+			t.Errorf("Got %v, expected all data", got)
+		}
+	})
+
+	t.Run("changed relation", func(t *testing.T) {
+		sendAndWait(dsmock.YAMLData(`organization/1/organization_tag_ids: [1,2]`))
+
+		got := resume(secondID)
+
+		if len(got) != 5 {
+			t.Errorf("Got %v, expected all data", got)
+		}
+	})
+}
+
+func TestConnectionKeysBuilderUpdate(t *testing.T) {
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, bg := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		user/1/name: Hello World
+		user/1/username: hello
+		user/2/name: Second
+	`))
+	go bg(shutdownCtx, oserror.Handle)
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, RestrictAllowed)
+	kb, _ := keysbuilder.FromKeys("user/1/name", "user/1/username")
+
+	updates := make(chan autoupdate.KeysBuilder, 1)
+	conn, err := s.Connect(shutdownCtx, 1, kb, autoupdate.WithKeysBuilderUpdates(updates))
+	if err != nil {
+		t.Fatalf("creating conection: %v", err)
+	}
+	next, _ := conn()
+
+	if _, err := next(shutdownCtx); err != nil {
+		t.Fatalf("Getting first data: %v", err)
+	}
+
+	newKB, _ := keysbuilder.FromKeys("user/1/name", "user/2/name")
+	updates <- newKB
+
+	data, err := next(shutdownCtx)
+	if err != nil {
+		t.Fatalf("Getting data after keysbuilder update: %v", err)
+	}
+
+	expect := map[dskey.Key][]byte{
+		dskey.MustKey("user/1/username"): nil,
+		dskey.MustKey("user/2/name"):     []byte(`"Second"`),
+	}
+	if !reflect.DeepEqual(data, expect) {
+		t.Errorf("Got %v, expected %v", data, expect)
+	}
+
+	ds.Send(dsmock.YAMLData(`user/2/name: new name`))
+
+	data, err = next(shutdownCtx)
+	if err != nil {
+		t.Fatalf("Getting data after datastore update: %v", err)
+	}
+
+	expect = map[dskey.Key][]byte{
+		dskey.MustKey("user/2/name"): []byte(`"new name"`),
+	}
+	if !reflect.DeepEqual(data, expect) {
+		t.Errorf("Got %v, expected %v", data, expect)
+	}
+}
+
+func TestConnectionPreviousValues(t *testing.T) {
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, bg := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		user/1/name: Hello World
+		user/1/username: hello
+	`))
+	go bg(shutdownCtx, oserror.Handle)
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, RestrictAllowed)
+	kb, _ := keysbuilder.FromKeys("user/1/name", "user/1/username")
+
+	var previous map[dskey.Key][]byte
+	conn, err := s.Connect(shutdownCtx, 1, kb, autoupdate.WithPreviousValues(func(p map[dskey.Key][]byte) { previous = p }))
+	if err != nil {
+		t.Fatalf("creating conection: %v", err)
+	}
+	next, _ := conn()
+
+	if _, err := next(shutdownCtx); err != nil {
+		t.Fatalf("Getting first data: %v", err)
+	}
+
+	if len(previous) != 0 {
+		t.Errorf("Got previous values %v after first message, expected none", previous)
+	}
+
+	ds.Send(dsmock.YAMLData(`user/1/name: new name`))
+
+	if _, err := next(shutdownCtx); err != nil {
+		t.Fatalf("Getting second data: %v", err)
+	}
+
+	expect := map[dskey.Key][]byte{
+		dskey.MustKey("user/1/name"): []byte(`"Hello World"`),
+	}
+	if !reflect.DeepEqual(previous, expect) {
+		t.Errorf("Got %v, expected %v", previous, expect)
+	}
+}
+
+func TestConnectionKnownHashes(t *testing.T) {
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, bg := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		user/1/name: Hello World
+		user/1/username: hello
+		user/1/password: secret
+	`))
+	go bg(shutdownCtx, oserror.Handle)
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, RestrictAllowed)
+	kb, _ := keysbuilder.FromKeys("user/1/name", "user/1/username", "user/1/first_name")
+
+	known := map[dskey.Key]uint64{
+		dskey.MustKey("user/1/name"):       autoupdate.ValueHash([]byte(`"Hello World"`)),
+		dskey.MustKey("user/1/username"):   autoupdate.ValueHash([]byte(`"old value"`)),
+		dskey.MustKey("user/1/first_name"): autoupdate.ValueHash([]byte(`"deleted"`)),
+	}
+
+	conn, err := s.Connect(shutdownCtx, 1, kb, autoupdate.WithKnownHashes(known))
+	if err != nil {
+		t.Fatalf("creating conection: %v", err)
+	}
+	next, _ := conn()
+
+	data, err := next(shutdownCtx)
+	if err != nil {
+		t.Fatalf("Getting first data: %v", err)
+	}
+
+	expect := map[dskey.Key][]byte{
+		dskey.MustKey("user/1/username"):   []byte(`"hello"`),
+		dskey.MustKey("user/1/first_name"): nil,
+	}
+	if !reflect.DeepEqual(data, expect) {
+		t.Errorf("Got %v, expected %v", data, expect)
+	}
+}
+
+func TestConnectionSharedComputation(t *testing.T) {
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, bg := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		user/1/name: hugo
+		user/1/email: hugo@example.com
+		user/2/name: emil
+	`))
+	go bg(shutdownCtx, oserror.Handle)
+
+	var restricterCalls int
+	restricter := func(ctx context.Context, getter datastore.Getter, uid int) (context.Context, datastore.Getter) {
+		restricterCalls++
+		return RestrictAllowed(ctx, getter, uid)
+	}
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, restricter)
+
+	connect := func(uid int, keys ...string) func(context.Context) (map[dskey.Key][]byte, error) {
+		kb, err := keysbuilder.FromKeys(keys...)
+		if err != nil {
+			t.Fatalf("creating keysbuilder: %v", err)
+		}
+
+		conn, err := s.Connect(shutdownCtx, uid, kb)
+		if err != nil {
+			t.Fatalf("creating conection: %v", err)
+		}
+
+		next, _ := conn()
+		return next
+	}
+
+	next1 := connect(1, "user/1/name", "user/1/email")
+	next2 := connect(1, "user/1/name", "user/1/email")
+
+	for _, next := range []func(context.Context) (map[dskey.Key][]byte, error){next1, next2} {
+		data, err := next(context.Background())
+		if err != nil {
+			t.Fatalf("next(): %v", err)
+		}
+
+		if len(data) != 2 {
+			t.Errorf("got %v, expected two keys", data)
+		}
+	}
+
+	if restricterCalls != 1 {
+		t.Errorf("restricter was called %d times for the first data, expected 1", restricterCalls)
+	}
+
+	ds.Send(map[dskey.Key][]byte{userNameKey: []byte(`"emil"`)})
+
+	for _, next := range []func(context.Context) (map[dskey.Key][]byte, error){next1, next2} {
+		data, err := next(context.Background())
+		if err != nil {
+			t.Fatalf("next(): %v", err)
+		}
+
+		expect := map[dskey.Key][]byte{userNameKey: []byte(`"emil"`)}
+		if !reflect.DeepEqual(data, expect) {
+			t.Errorf("got %v, expected %v", data, expect)
+		}
+	}
+
+	if restricterCalls != 2 {
+		t.Errorf("restricter was called %d times after the update, expected 2", restricterCalls)
+	}
+
+	t.Run("other user", func(t *testing.T) {
+		next := connect(2, "user/1/name", "user/1/email")
+		if _, err := next(context.Background()); err != nil {
+			t.Fatalf("next(): %v", err)
+		}
+
+		if restricterCalls != 3 {
+			t.Errorf("restricter was called %d times, expected 3", restricterCalls)
+		}
+	})
+}
+
+func TestConnectionIncrementalKeys(t *testing.T) {
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, bg := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		user/1/group_ids: [1]
+		group/1/name: admin
+		group/2/name: delegate
+	`))
+	go bg(shutdownCtx, oserror.Handle)
+
+	// requests are the keys of each call to the restricter.
+	var requests [][]dskey.Key
+	restricter := func(ctx context.Context, getter datastore.Getter, uid int) (context.Context, datastore.Getter) {
+		return RestrictAllowed(ctx, getterFunc(func(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+			requests = append(requests, keys)
+			return getter.Get(ctx, keys...)
+		}), uid)
+	}
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, restricter)
+
+	kb, err := keysbuilder.FromJSON(strings.NewReader(`{
+		"ids": [1],
+		"collection": "user",
+		"fields": {
+			"group_ids": {
+				"type": "relation-list",
+				"collection": "group",
+				"fields": {"name": null}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("creating keysbuilder: %v", err)
+	}
+
+	conn, err := s.Connect(shutdownCtx, 1, kb)
+	if err != nil {
+		t.Fatalf("creating conection: %v", err)
+	}
+	next, _ := conn()
+
+	if _, err := next(context.Background()); err != nil {
+		t.Fatalf("next(): %v", err)
+	}
+
+	t.Run("data changed", func(t *testing.T) {
+		requests = nil
+		ds.Send(map[dskey.Key][]byte{dskey.MustKey("group/1/name"): []byte(`"chair"`)})
+
+		data, err := next(context.Background())
+		if err != nil {
+			t.Fatalf("next(): %v", err)
+		}
+
+		expect := map[dskey.Key][]byte{dskey.MustKey("group/1/name"): []byte(`"chair"`)}
+		if !reflect.DeepEqual(data, expect) {
+			t.Errorf("got %v, expected %v", data, expect)
+		}
+
+		// Only the data is fetched. The keys are not built again.
+		if len(requests) != 1 {
+			t.Errorf("got %d requests, expected 1: %v", len(requests), requests)
+		}
+	})
+
+	t.Run("relation changed", func(t *testing.T) {
+		requests = nil
+		ds.Send(map[dskey.Key][]byte{dskey.MustKey("user/1/group_ids"): []byte(`[2]`)})
+
+		data, err := next(context.Background())
+		if err != nil {
+			t.Fatalf("next(): %v", err)
+		}
+
+		expect := map[dskey.Key][]byte{
+			dskey.MustKey("user/1/group_ids"): []byte(`[2]`),
+			dskey.MustKey("group/2/name"):     []byte(`"delegate"`),
+		}
+		if !reflect.DeepEqual(data, expect) {
+			t.Errorf("got %v, expected %v", data, expect)
+		}
+
+		expectRequests := [][]dskey.Key{{dskey.MustKey("user/1/group_ids")}}
+		if len(requests) != 2 || !reflect.DeepEqual(requests[:1], expectRequests) {
+			t.Errorf("got requests %v, expected %v and the data", requests, expectRequests)
+		}
+	})
+}
+
+func TestConnectionIncrementalRestriction(t *testing.T) {
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, bg := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+	meeting/30/id: 30
+	user/1/group_$30_ids: [10]
+	user/1/group_$_ids: ["30"]
+	group/10:
+		meeting_id: 30
+		permissions:
+		- agenda_item.can_see
+	agenda_item/1:
+		meeting_id: 30
+		item_number: one
+	`))
+	go bg(shutdownCtx, oserror.Handle)
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, restrict.Middleware)
+
+	kb, err := keysbuilder.FromKeys("agenda_item/1/item_number")
+	if err != nil {
+		t.Fatalf("creating keysbuilder: %v", err)
+	}
+
+	conn, err := s.Connect(shutdownCtx, 1, kb)
+	if err != nil {
+		t.Fatalf("creating conection: %v", err)
+	}
+	next, _ := conn()
+
+	key := dskey.MustKey("agenda_item/1/item_number")
+	for _, tt := range []struct {
+		name   string
+		change map[dskey.Key][]byte
+		expect map[dskey.Key][]byte
+	}{
+		{
+			"first data",
+			nil,
+			map[dskey.Key][]byte{key: []byte(`"one"`)},
+		},
+		{
+			"value changed",
+			map[dskey.Key][]byte{key: []byte(`"first"`)},
+			map[dskey.Key][]byte{key: []byte(`"first"`)},
+		},
+		{
+			"permission changed",
+			map[dskey.Key][]byte{dskey.MustKey("group/10/permissions"): []byte(`[]`)},
+			map[dskey.Key][]byte{key: nil},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.change != nil {
+				ds.Send(tt.change)
+			}
+
+			data, err := next(context.Background())
+			if err != nil {
+				t.Fatalf("next(): %v", err)
+			}
+
+			if !reflect.DeepEqual(data, tt.expect) {
+				t.Errorf("got %v, expected %v", data, tt.expect)
+			}
+		})
+	}
+}
+
+func TestConnectionMinInterval(t *testing.T) {
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, bg := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+	user/1/name: hugo
+	user/1/email: hugo@example.com
+	`))
+	go bg(shutdownCtx, oserror.Handle)
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, RestrictAllowed)
+
+	kb, err := keysbuilder.FromKeys("user/1/name", "user/1/email")
+	if err != nil {
+		t.Fatalf("creating keysbuilder: %v", err)
+	}
+
+	interval := 100 * time.Millisecond
+	conn, err := s.Connect(shutdownCtx, 1, kb, autoupdate.WithMinInterval(interval))
+	if err != nil {
+		t.Fatalf("creating conection: %v", err)
+	}
+	next, _ := conn()
+
+	if _, err := next(context.Background()); err != nil {
+		t.Fatalf("next(): %v", err)
+	}
+	firstMessage := time.Now()
+
+	type result struct {
+		data map[dskey.Key][]byte
+		err  error
+	}
+	received := make(chan result, 1)
+	go func() {
+		data, err := next(context.Background())
+		received <- result{data, err}
+	}()
+
+	ds.Send(map[dskey.Key][]byte{userNameKey: []byte(`"emil"`)})
+	time.Sleep(interval / 4)
+	ds.Send(map[dskey.Key][]byte{dskey.MustKey("user/1/email"): []byte(`"emil@example.com"`)})
+
+	r := <-received
+	if r.err != nil {
+		t.Fatalf("next(): %v", r.err)
+	}
+
+	if since := time.Since(firstMessage); since < interval {
+		t.Errorf("got message after %s, expected at least %s", since, interval)
+	}
+
+	expect := map[dskey.Key][]byte{
+		userNameKey:                   []byte(`"emil"`),
+		dskey.MustKey("user/1/email"): []byte(`"emil@example.com"`),
+	}
+	if !reflect.DeepEqual(r.data, expect) {
+		t.Errorf("got %v, expected both changes in one message %v", r.data, expect)
+	}
+}
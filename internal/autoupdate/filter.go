@@ -1,22 +1,28 @@
 package autoupdate
 
 import (
-	"hash/maphash"
-
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/cespare/xxhash/v2"
 )
 
-func createHash(hasher *maphash.Hash, value []byte) uint64 {
-	hasher.Reset()
-
-	// This can not return any error.
-	_, _ = hasher.Write(value)
-	return hasher.Sum64()
+// ValueHash returns the hash of a value, that is used to find out, if the value
+// has changed.
+//
+// It is the xxhash64 of the json value with the seed 0. Clients can use the
+// same hash to tell the values they already have.
+func ValueHash(value []byte) uint64 {
+	return xxhash.Sum64(value)
 }
 
 type filter struct {
-	hasher  maphash.Hash
 	history map[dskey.Key]uint64
+
+	// If keepValues is true, the filter also saves the values, that where
+	// sent to the client. On each call, the old values of the returned keys
+	// are saved in previous.
+	keepValues bool
+	values     map[dskey.Key][]byte
+	previous   map[dskey.Key][]byte
 }
 
 // filter removes nil values from a map. If filter is called multiple times it
@@ -26,9 +32,17 @@ func (f *filter) filter(data map[dskey.Key][]byte) {
 		f.history = make(map[dskey.Key]uint64)
 	}
 
+	if f.keepValues {
+		if f.values == nil {
+			f.values = make(map[dskey.Key][]byte)
+		}
+		f.previous = make(map[dskey.Key][]byte)
+	}
+
 	for k := range f.history {
 		if _, ok := data[k]; !ok {
 			delete(f.history, k)
+			delete(f.values, k)
 		}
 	}
 
@@ -40,15 +54,63 @@ func (f *filter) filter(data map[dskey.Key][]byte) {
 				delete(data, key)
 			}
 			f.history[key] = 0
+			f.setValue(key, nil)
 			continue
 		}
 
-		newHash := createHash(&f.hasher, value)
+		newHash := ValueHash(value)
 		if oldHash, inHistory := f.history[key]; inHistory && newHash == oldHash {
 			delete(data, key)
 			continue
 		}
 		f.history[key] = newHash
+		f.setValue(key, value)
+	}
+}
+
+// setValue saves the value that is sent to the client, if keepValues is true.
+func (f *filter) setValue(key dskey.Key, value []byte) {
+	if !f.keepValues {
+		return
+	}
+
+	if old, ok := f.values[key]; ok {
+		f.previous[key] = old
+	}
+
+	if value == nil {
+		delete(f.values, key)
+		return
+	}
+	f.values[key] = value
+}
+
+// addRemoved adds all keys with the value nil to data, that where sent before
+// but are not in data.
+//
+// Has to be called before filter.
+func (f *filter) addRemoved(data map[dskey.Key][]byte) {
+	for key, hash := range f.history {
+		if _, ok := data[key]; !ok && hash != 0 {
+			data[key] = nil
+		}
+	}
+}
+
+// seed initializes the filter with the hashes of values, that the client
+// already has. It has to be called before the first call to filter.
+//
+// A value with the hash 0 is ignored.
+func (f *filter) seed(hashes map[dskey.Key]uint64) {
+	if f.history == nil {
+		f.history = make(map[dskey.Key]uint64, len(hashes))
+	}
+
+	for key, hash := range hashes {
+		if hash == 0 {
+			continue
+		}
+		f.history[key] = hash
 	}
 }
 
@@ -174,3 +174,24 @@ func TestFilterChangeTwice(t *testing.T) {
 		})
 	}
 }
+
+func TestFilterAddRemoved(t *testing.T) {
+	var f filter
+	f.filter(map[dskey.Key][]byte{
+		myKey1: []byte("v1"),
+		myKey2: nil,
+	})
+
+	data := map[dskey.Key][]byte{}
+	f.addRemoved(data)
+	f.filter(data)
+
+	// myKey2 was not sent to the client, so it does not have to be removed.
+	expect := map[dskey.Key][]byte{
+		myKey1: nil,
+	}
+
+	if !reflect.DeepEqual(data, expect) {
+		t.Errorf("got %v, expected %v", data, expect)
+	}
+}
@@ -0,0 +1,322 @@
+package autoupdate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/restrict"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+)
+
+// historyPageLimit is the default and maximum amount of entries, that
+// HistoryEntries returns. For each entry, the data at two positions is read.
+const historyPageLimit = 100
+
+// HistoryFilter selects the entries of the history information.
+type HistoryFilter struct {
+	// From and To are unix timestamps. Only entries between them are
+	// returned. Zero means no limit.
+	From int
+	To   int
+
+	// UserID only returns entries of this user. Zero means all users.
+	UserID int
+
+	// Offset and Limit select a page of the filtered entries. A limit of zero
+	// or more then 100 means 100 entries.
+	Offset int
+	Limit  int
+}
+
+// HistoryEntry is one entry of the history information.
+type HistoryEntry struct {
+	Position    int             `json:"position"`
+	UserID      int             `json:"user_id"`
+	Information json.RawMessage `json:"information"`
+	Timestamp   float64         `json:"timestamp"`
+
+	// UserName is the name of the user. It is empty, if the user does not
+	// exist anymore or the request user can not see it.
+	UserName string `json:"user_name,omitempty"`
+
+	// ChangedFields are the fields of the fqid, that changed at the position.
+	// It is nil, if the request user can not see any of them.
+	ChangedFields []string `json:"changed_fields,omitempty"`
+}
+
+// HistoryEntries returns the history information for an fqid like
+// HistoryInformation, but filtered and enriched.
+//
+// The second return value is the amount of entries before the offset and
+// limit are applied.
+func (a *Autoupdate) HistoryEntries(ctx context.Context, uid int, fqid string, filter HistoryFilter) ([]HistoryEntry, int, error) {
+	buf := new(bytes.Buffer)
+	if err := a.HistoryInformation(ctx, uid, fqid, buf); err != nil {
+		return nil, 0, err
+	}
+
+	entries, err := parseHistoryInformation(buf.Bytes(), fqid)
+	if err != nil {
+		return nil, 0, fmt.Errorf("parsing history information: %w", err)
+	}
+
+	filtered := entries[:0]
+	for _, entry := range entries {
+		if filter.From != 0 && entry.Timestamp < float64(filter.From) {
+			continue
+		}
+
+		if filter.To != 0 && entry.Timestamp > float64(filter.To) {
+			continue
+		}
+
+		if filter.UserID != 0 && entry.UserID != filter.UserID {
+			continue
+		}
+
+		filtered = append(filtered, entry)
+	}
+
+	limit := filter.Limit
+	if limit == 0 || limit > historyPageLimit {
+		limit = historyPageLimit
+	}
+
+	total := len(filtered)
+	filtered = page(filtered, filter.Offset, limit)
+
+	if err := a.addUserNames(ctx, uid, filtered); err != nil {
+		return nil, 0, fmt.Errorf("adding user names: %w", err)
+	}
+
+	if err := a.addChangedFields(ctx, uid, fqid, filtered); err != nil {
+		return nil, 0, fmt.Errorf("adding changed fields: %w", err)
+	}
+
+	return filtered, total, nil
+}
+
+// parseHistoryInformation decodes the response of the datastore reader.
+//
+// The reader returns the entries of each requested fqid as object from fqid
+// to a list of entries. A list of entries is also accepted.
+func parseHistoryInformation(data []byte, fqid string) ([]HistoryEntry, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	if data[0] != '{' {
+		var entries []HistoryEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("decoding list of entries: %w", err)
+		}
+		return entries, nil
+	}
+
+	var byFQID map[string][]HistoryEntry
+	if err := json.Unmarshal(data, &byFQID); err != nil {
+		return nil, fmt.Errorf("decoding entries by fqid: %w", err)
+	}
+	return byFQID[fqid], nil
+}
+
+// page returns the entries from offset with at most limit entries.
+func page(entries []HistoryEntry, offset, limit int) []HistoryEntry {
+	if offset >= len(entries) {
+		return nil
+	}
+	entries = entries[offset:]
+
+	if limit > 0 && limit < len(entries) {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// addUserNames sets the name of the user of each entry.
+//
+// The names are restricted for the request user with the current data.
+func (a *Autoupdate) addUserNames(ctx context.Context, uid int, entries []HistoryEntry) error {
+	var keys []dskey.Key
+	seen := make(map[int]bool)
+	for _, entry := range entries {
+		if entry.UserID == 0 || seen[entry.UserID] {
+			continue
+		}
+		seen[entry.UserID] = true
+
+		for _, field := range []string{"username", "title", "first_name", "last_name"} {
+			keys = append(keys, dskey.Key{Collection: "user", ID: entry.UserID, Field: field})
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	ctx, restricter := a.restricter(ctx, a.datastore, uid)
+	data, err := restricter.Get(ctx, keys...)
+	if err != nil {
+		return fmt.Errorf("getting user data: %w", err)
+	}
+
+	for i, entry := range entries {
+		if entry.UserID == 0 {
+			continue
+		}
+		entries[i].UserName = userName(data, entry.UserID)
+	}
+	return nil
+}
+
+// userName returns the name of a user like the client shows it.
+//
+// It is the title, first name and last name of the user or the username, if
+// they are empty.
+func userName(data map[dskey.Key][]byte, userID int) string {
+	value := func(field string) string {
+		var v string
+		if raw := data[dskey.Key{Collection: "user", ID: userID, Field: field}]; raw != nil {
+			// Invalid values are handled like empty values.
+			_ = json.Unmarshal(raw, &v)
+		}
+		return v
+	}
+
+	var parts []string
+	for _, field := range []string{"title", "first_name", "last_name"} {
+		if v := strings.TrimSpace(value(field)); v != "" {
+			parts = append(parts, v)
+		}
+	}
+
+	if len(parts) == 0 {
+		return value("username")
+	}
+	return strings.Join(parts, " ")
+}
+
+// addChangedFields sets the fields of the fqid, that changed at the position
+// of each entry.
+//
+// The changed fields are found with the unrestricted data. Only those fields
+// are restricted for the request user like other history data, so fields,
+// that the user can not see, are not listed. If the user can not see any of
+// them, the changed fields are left out. For the first position, all existing
+// fields are changed.
+func (a *Autoupdate) addChangedFields(ctx context.Context, uid int, fqid string, entries []HistoryEntry) error {
+	keys, err := fqidKeys(fqid)
+	if err != nil {
+		return err
+	}
+
+	// Each position is only read once, also if it is the position of one
+	// entry and the position before another entry.
+	atPosition := make(map[int]map[dskey.Key][]byte)
+	get := func(position int) (map[dskey.Key][]byte, error) {
+		// Position 0 means the current data, so there is nothing before
+		// position 1.
+		if position < 1 {
+			return nil, nil
+		}
+
+		if data, ok := atPosition[position]; ok {
+			return data, nil
+		}
+
+		data, err := datastore.NewGetPosition(a.datastore, position).Get(ctx, keys...)
+		if err != nil {
+			return nil, fmt.Errorf("getting data at position %d: %w", position, err)
+		}
+		atPosition[position] = data
+		return data, nil
+	}
+
+	for i, entry := range entries {
+		data, err := get(entry.Position)
+		if err != nil {
+			return err
+		}
+
+		before, err := get(entry.Position - 1)
+		if err != nil {
+			return err
+		}
+
+		var touched []dskey.Key
+		for _, key := range keys {
+			if !bytes.Equal(data[key], before[key]) {
+				touched = append(touched, key)
+			}
+		}
+
+		if len(touched) == 0 {
+			entries[i].ChangedFields = []string{}
+			continue
+		}
+
+		visible, err := a.visibleFields(ctx, uid, entry.Position, touched)
+		if err != nil {
+			return err
+		}
+
+		if len(visible) == 0 {
+			continue
+		}
+
+		sort.Strings(visible)
+		entries[i].ChangedFields = visible
+	}
+	return nil
+}
+
+// visibleFields returns the fields of the keys, that the request user can see
+// at the position or the position before.
+func (a *Autoupdate) visibleFields(ctx context.Context, uid int, position int, keys []dskey.Key) ([]string, error) {
+	visible := make(map[dskey.Key]bool, len(keys))
+	for _, p := range []int{position, position - 1} {
+		if p < 1 {
+			continue
+		}
+
+		data, err := a.history(uid, p).Get(ctx, keys...)
+		if err != nil {
+			return nil, fmt.Errorf("getting restricted data at position %d: %w", p, err)
+		}
+
+		for _, key := range keys {
+			if data[key] != nil {
+				visible[key] = true
+			}
+		}
+	}
+
+	var fields []string
+	for _, key := range keys {
+		if visible[key] {
+			fields = append(fields, key.Field)
+		}
+	}
+	return fields, nil
+}
+
+// fqidKeys returns the keys of all fields of an fqid.
+func fqidKeys(fqid string) ([]dskey.Key, error) {
+	idField, err := dskey.FromString(fqid + "/id")
+	if err != nil {
+		return nil, invalidInputError{fmt.Sprintf("fqid %s is invalid", fqid)}
+	}
+
+	fields := restrict.FieldsForCollection(idField.Collection)
+	keys := make([]dskey.Key, len(fields))
+	for i, field := range fields {
+		keys[i] = dskey.Key{Collection: idField.Collection, ID: idField.ID, Field: field}
+	}
+	return keys, nil
+}
@@ -0,0 +1,235 @@
+package autoupdate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/restrict"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/ostcar/topic"
+)
+
+// incrementalKeysBuilder is a KeysBuilder, that can rebuild only the parts of
+// its keys, that depend on changed keys.
+type incrementalKeysBuilder interface {
+	KeysBuilder
+	UpdateChanged(ctx context.Context, ds datastore.Getter, changed []dskey.Key) (added []dskey.Key, removed []dskey.Key, err error)
+	Expands(key dskey.Key) bool
+}
+
+// keysState is the result of the last update of an incremental keysbuilder.
+type keysState struct {
+	// tid is the topic id of the data, the keys where built from.
+	tid        uint64
+	cacheReset uint64
+	keys       map[dskey.Key]struct{}
+
+	// reads counts, how often each key was read by the keysbuilder and the
+	// restricter while the keys where built.
+	reads map[dskey.Key]int
+}
+
+// buildKeys returns the keys of the keysbuilder.
+//
+// If the keysbuilder supports it, only the parts of the keys are rebuilt, that
+// depend on keys, that changed since the last call.
+func (c *connection) buildKeys(ctx context.Context, restricter datastore.Getter, counter *readCounter) ([]dskey.Key, error) {
+	kb, ok := c.kb.(incrementalKeysBuilder)
+	if !ok {
+		return c.kb.Update(ctx, restricter)
+	}
+
+	state := c.keys
+	c.keys = nil
+	if state != nil && state.cacheReset != c.autoupdate.cacheResets.Load() {
+		state = nil
+	}
+
+	var changed []dskey.Key
+	incremental := false
+	if state != nil {
+		var err error
+		changed, incremental, err = state.changedKeys(ctx, c.autoupdate.topic, kb)
+		if err != nil {
+			return nil, fmt.Errorf("get changed keys since %d: %w", state.tid, err)
+		}
+	}
+
+	if !incremental {
+		tid := c.autoupdate.topic.LastID()
+		cacheReset := c.autoupdate.cacheResets.Load()
+		keys, err := kb.Update(ctx, restricter)
+		if err != nil {
+			return nil, err
+		}
+
+		state = &keysState{
+			tid:        tid,
+			cacheReset: cacheReset,
+			keys:       make(map[dskey.Key]struct{}, len(keys)),
+			reads:      counter.reset(),
+		}
+		for _, key := range keys {
+			state.keys[key] = struct{}{}
+		}
+		c.keys = state
+		return keys, nil
+	}
+
+	if len(changed) > 0 {
+		added, removed, err := kb.UpdateChanged(ctx, restricter, changed)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range removed {
+			delete(state.keys, key)
+		}
+
+		for _, key := range added {
+			state.keys[key] = struct{}{}
+		}
+
+		reads := counter.reset()
+		for key, count := range reads {
+			state.reads[key] += count
+		}
+
+		// The changed keys were read again, but only as requested keys.
+		for _, key := range changed {
+			if reads[key] > 0 {
+				state.reads[key]--
+			}
+		}
+	}
+
+	c.keys = state
+
+	keys := make([]dskey.Key, 0, len(state.keys))
+	for key := range state.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// changedKeys returns the keys, that changed since the last update and where
+// used to find other keys. They have to be fetched again.
+//
+// The second return value is false, if all keys have to be rebuilt. This is the
+// case, if the changed keys can not be determined or if a changed key was used
+// by the restricter.
+func (s *keysState) changedKeys(ctx context.Context, t *topic.Topic[dskey.Key], kb incrementalKeysBuilder) ([]dskey.Key, bool, error) {
+	tid, changedKeys, known, err := changedSinceTID(ctx, t, s.tid)
+	if err != nil || !known {
+		return nil, false, err
+	}
+	s.tid = tid
+
+	// A changed key, that was only used by the keysbuilder to find other keys,
+	// can be refetched. Otherwise all keys have to be built again.
+	var refetch []dskey.Key
+	for _, key := range changedKeys {
+		count := s.reads[key]
+		if count == 0 {
+			continue
+		}
+
+		if readAsDependency(count) || !kb.Expands(key) {
+			return nil, false, nil
+		}
+
+		refetch = append(refetch, key)
+	}
+	return refetch, true, nil
+}
+
+// incrementalRestricter is a restricter, that can reuse the result of the last
+// restriction.
+type incrementalRestricter interface {
+	GetChanged(ctx context.Context, state *restrict.State, changed []dskey.Key, keys ...dskey.Key) (map[dskey.Key][]byte, error)
+}
+
+// restrictionState is the result of the last restriction of a connection.
+type restrictionState struct {
+	// tid is the topic id of the restricted data.
+	tid        uint64
+	cacheReset uint64
+	state      restrict.State
+}
+
+// restrict returns the restricted values for the keys.
+//
+// If the restricter supports it, only the parts of the data are restricted
+// again, that depend on keys, that changed since the last call.
+func (c *connection) restrict(ctx context.Context, restricter datastore.Getter, keys []dskey.Key) (map[dskey.Key][]byte, error) {
+	ir, ok := restricter.(incrementalRestricter)
+	if !ok {
+		return restricter.Get(ctx, keys...)
+	}
+
+	state := c.restriction
+	c.restriction = nil
+	if state != nil && state.cacheReset != c.autoupdate.cacheResets.Load() {
+		state = nil
+	}
+
+	var changed []dskey.Key
+	if state != nil {
+		tid, changedKeys, known, err := changedSinceTID(ctx, c.autoupdate.topic, state.tid)
+		if err != nil {
+			return nil, fmt.Errorf("get changed keys since %d: %w", state.tid, err)
+		}
+
+		if known {
+			state.tid = tid
+			changed = changedKeys
+		} else {
+			state = nil
+		}
+	}
+
+	if state == nil {
+		state = &restrictionState{
+			tid:        c.autoupdate.topic.LastID(),
+			cacheReset: c.autoupdate.cacheResets.Load(),
+		}
+	}
+
+	data, err := ir.GetChanged(ctx, &state.state, changed, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	c.restriction = state
+	return data, nil
+}
+
+// changedSinceTID returns the keys, that changed since the topic id and the
+// current topic id.
+//
+// The third return value is false, if the changed keys can not be determined,
+// for example, because the topic id was already pruned.
+func changedSinceTID(ctx context.Context, t *topic.Topic[dskey.Key], tid uint64) (uint64, []dskey.Key, bool, error) {
+	lastID := t.LastID()
+	if tid > lastID {
+		// The id is from the future, for example from before a restart.
+		return 0, nil, false, nil
+	}
+
+	if tid == lastID {
+		return tid, nil, true, nil
+	}
+
+	lastID, changedKeys, err := t.Receive(ctx, tid)
+	if err != nil {
+		var errUnknownID topic.UnknownIDError
+		if errors.As(err, &errUnknownID) {
+			return 0, nil, false, nil
+		}
+		return 0, nil, false, err
+	}
+
+	return lastID, changedKeys, true, nil
+}
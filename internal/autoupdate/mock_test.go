@@ -3,6 +3,7 @@ package autoupdate_test
 import (
 	"context"
 	"fmt"
+	"io"
 	"time"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
@@ -82,3 +83,51 @@ func (r mockRestricter) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.K
 	}
 	return data, nil
 }
+
+// historyDatastore is a MockDatastore with a fake history. Each position has
+// its own data.
+type historyDatastore struct {
+	*dsmock.MockDatastore
+	history     map[int]map[dskey.Key][]byte
+	information string
+}
+
+func (h *historyDatastore) HistoryInformation(ctx context.Context, fqid string, w io.Writer) error {
+	if h.information == "" {
+		return h.MockDatastore.HistoryInformation(ctx, fqid, w)
+	}
+
+	_, err := io.WriteString(w, h.information)
+	return err
+}
+
+func (h *historyDatastore) GetPosition(ctx context.Context, position int, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	data, ok := h.history[position]
+	if !ok {
+		return nil, fmt.Errorf("unknown position %d", position)
+	}
+
+	result := make(map[dskey.Key][]byte, len(keys))
+	for _, key := range keys {
+		result[key] = data[key]
+	}
+	return result, nil
+}
+
+// MaxPosition returns the highest position of the history.
+func (h *historyDatastore) MaxPosition(ctx context.Context) (int, error) {
+	var max int
+	for position := range h.history {
+		if position > max {
+			max = position
+		}
+	}
+	return max, nil
+}
+
+// getterFunc is a function that implements the datastore.Getter interface.
+type getterFunc func(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error)
+
+func (f getterFunc) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	return f(ctx, keys...)
+}
@@ -0,0 +1,142 @@
+package autoupdate
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+)
+
+// maxPositioner is a Datastore, that can tell its highest position.
+type maxPositioner interface {
+	MaxPosition(ctx context.Context) (int, error)
+}
+
+// playback is the state of a connection, that replays the history.
+type playback struct {
+	position int
+	steps    <-chan int
+}
+
+// WithPlayback lets the connection start at a position in the history.
+//
+// The first message contains the data at the position. Each value from steps
+// moves the connection forward by this many positions. The next message only
+// contains the keys, that have changed. Steps without changes do not create a
+// message.
+//
+// A value of zero or less, or a step to the current position of the datastore
+// or further, turns the connection into a normal autoupdate connection.
+//
+// The position of each message is reported to the function of WithUpdateID.
+func WithPlayback(position int, steps <-chan int) ConnectOption {
+	return func(c *connection) {
+		c.playback = &playback{position: position, steps: steps}
+	}
+}
+
+// playbackData returns the next data of a connection with playback.
+//
+// The second return value is true, if the connection reached the current
+// position. In this case, the data are the differences to the last position
+// and can be empty.
+func (c *connection) playbackData(ctx context.Context) (map[dskey.Key][]byte, bool, error) {
+	if c.filter.empty() {
+		data, err := c.historyData(ctx, c.playback.position)
+		if err != nil {
+			return nil, false, fmt.Errorf("creating data at position %d: %w", c.playback.position, err)
+		}
+
+		c.filter.filter(data)
+		c.reportPosition()
+		return data, false, nil
+	}
+
+	for {
+		var step int
+		select {
+		case step = <-c.playback.steps:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+
+		target := c.playback.position + step
+		head, err := c.headPosition(ctx)
+		if err != nil {
+			return nil, false, fmt.Errorf("getting current position: %w", err)
+		}
+
+		if step <= 0 || (head > 0 && target >= head) {
+			c.playback = nil
+			c.tid = c.autoupdate.topic.LastID()
+
+			data, err := c.updatedDataWithRemoved(ctx)
+			if err != nil {
+				return nil, false, fmt.Errorf("creating current data: %w", err)
+			}
+			return data, true, nil
+		}
+
+		c.playback.position = target
+		data, err := c.historyData(ctx, target)
+		if err != nil {
+			return nil, false, fmt.Errorf("creating data at position %d: %w", target, err)
+		}
+
+		c.filter.addRemoved(data)
+		c.filter.filter(data)
+
+		if len(data) > 0 {
+			c.reportPosition()
+			return data, false, nil
+		}
+	}
+}
+
+// headPosition returns the current position of the datastore or 0, if it is
+// unknown.
+func (c *connection) headPosition(ctx context.Context) (int, error) {
+	if mp, ok := c.autoupdate.datastore.(maxPositioner); ok {
+		return mp.MaxPosition(ctx)
+	}
+
+	return c.autoupdate.datastore.LastUpdateID().Position, nil
+}
+
+// historyData returns the restricted data for the keysbuilder at a position.
+func (c *connection) historyData(ctx context.Context, position int) (map[dskey.Key][]byte, error) {
+	done, err := c.autoupdate.pool.Wait(ctx, c.uid, c.priority)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	restricter := c.autoupdate.history(c.uid, position)
+
+	// The keys are built from old data, so the next update can not use them.
+	c.keys = nil
+	keys, err := c.kb.Update(ctx, restricter)
+	if err != nil {
+		return nil, fmt.Errorf("create keys for keysbuilder: %w", err)
+	}
+
+	data, err := restricter.Get(ctx, keys...)
+	if err != nil {
+		return nil, fmt.Errorf("get restricted data: %w", err)
+	}
+
+	return data, nil
+}
+
+// reportPosition calls the registered functions for a message of the
+// playback.
+func (c *connection) reportPosition() {
+	if c.onPrevious != nil {
+		c.onPrevious(c.filter.previous)
+	}
+
+	if c.onUpdateID != nil {
+		c.onUpdateID(datastore.UpdateID{Position: c.playback.position})
+	}
+}
@@ -0,0 +1,130 @@
+package autoupdate_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/keysbuilder"
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/oserror"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dsmock"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/environment"
+)
+
+func TestPlayback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, bg := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		user/1/organization_management_level: superadmin
+		user/1/username: current
+		user/1/first_name: hugo
+	`))
+	go bg(ctx, oserror.Handle)
+
+	ds := &historyDatastore{
+		MockDatastore: mock,
+		history: map[int]map[dskey.Key][]byte{
+			1: dsmock.YAMLData(`---
+				user/1/username: first
+				user/1/first_name: hugo
+			`),
+			2: dsmock.YAMLData(`---
+				user/1/username: first
+				user/1/first_name: hugo
+			`),
+			3: dsmock.YAMLData(`---
+				user/1/username: second
+			`),
+			4: dsmock.YAMLData(`---
+				user/1/username: current
+				user/1/first_name: hugo
+			`),
+		},
+	}
+
+	s, _, _ := autoupdate.New(environment.ForTests{}, ds, RestrictAllowed)
+	kb, _ := keysbuilder.FromKeys("user/1/username", "user/1/first_name")
+
+	var position int
+	steps := make(chan int, 10)
+	conn, err := s.Connect(
+		ctx,
+		1,
+		kb,
+		autoupdate.WithPlayback(1, steps),
+		autoupdate.WithUpdateID(func(id datastore.UpdateID) { position = id.Position }),
+	)
+	if err != nil {
+		t.Fatalf("creating conection: %v", err)
+	}
+	next, _ := conn()
+
+	for _, tt := range []struct {
+		name     string
+		step     int
+		expect   map[dskey.Key][]byte
+		position int
+	}{
+		{
+			"first position",
+			0,
+			map[dskey.Key][]byte{
+				dskey.MustKey("user/1/username"):   []byte(`"first"`),
+				dskey.MustKey("user/1/first_name"): []byte(`"hugo"`),
+			},
+			1,
+		},
+		{
+			"step without changes is skipped",
+			1,
+			nil,
+			0,
+		},
+		{
+			"step with changes",
+			1,
+			map[dskey.Key][]byte{
+				dskey.MustKey("user/1/username"):   []byte(`"second"`),
+				dskey.MustKey("user/1/first_name"): nil,
+			},
+			3,
+		},
+		{
+			"reaches head and goes live",
+			1,
+			map[dskey.Key][]byte{
+				dskey.MustKey("user/1/username"):   []byte(`"current"`),
+				dskey.MustKey("user/1/first_name"): []byte(`"hugo"`),
+			},
+			0,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name != "first position" {
+				steps <- tt.step
+			}
+
+			if tt.expect == nil {
+				// The step should not create a message.
+				return
+			}
+
+			data, err := next(ctx)
+			if err != nil {
+				t.Fatalf("next: %v", err)
+			}
+
+			if !reflect.DeepEqual(data, tt.expect) {
+				t.Errorf("got %v, expected %v", data, tt.expect)
+			}
+
+			if position != tt.position {
+				t.Errorf("got position %d, expected %d", position, tt.position)
+			}
+		})
+	}
+}
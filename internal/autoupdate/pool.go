@@ -1,21 +1,94 @@
 package autoupdate
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
 
-type token struct{}
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/metric"
+)
 
+// priority is the class of a connection in the work pool. Waiting work of a
+// higher class is started before waiting work of a lower class.
+type priority int
+
+// priorityAging is the time after that waiting work is handled like work of
+// the next higher class. So work of a low class is not starved by work of
+// higher classes.
+const priorityAging = time.Second
+
+const (
+	priorityAnonymous priority = iota
+	priorityDelegate
+	priorityAdmin
+	priorityPresenter
+	priorityProjector
+
+	priorityCount
+)
+
+func (p priority) String() string {
+	switch p {
+	case priorityAnonymous:
+		return "anonymous"
+	case priorityDelegate:
+		return "delegate"
+	case priorityAdmin:
+		return "admin"
+	case priorityPresenter:
+		return "presenter"
+	case priorityProjector:
+		return "projector"
+	default:
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+}
+
+// workPool limits the amount of connections, that calculate there data at the
+// same time.
+//
+// If all workers are busy, the work is queued. The next work is taken from the
+// highest priority class. Waiting work rises one class for each aging interval
+// it waited. Inside a class, the users take turns. So a user with many
+// connections can not starve other users.
 type workPool struct {
-	sem chan token
+	limit    int
+	maxQueue int
+	timeout  time.Duration
+	aging    time.Duration
+
+	mu      sync.Mutex
+	running int
+	waiting int
+	queues  [priorityCount]fairQueue
+
+	// Values for the metric. The wait values are reset each time the metric
+	// is gathered.
+	waitCount int
+	waitTotal time.Duration
+	waitMax   time.Duration
+	timeouts  int
+	rejected  int
 }
 
-func newWorkPool(limit int) *workPool {
+// newWorkPool creates a work pool with limit workers.
+//
+// maxQueue is the amount of work, that can wait for a worker and timeout is
+// the maximum time, work waits for a worker. Zero means no limit.
+func newWorkPool(limit int, maxQueue int, timeout time.Duration) *workPool {
 	return &workPool{
-		sem: make(chan token, limit),
+		limit:    limit,
+		maxQueue: maxQueue,
+		timeout:  timeout,
+		aging:    priorityAging,
 	}
 }
 
-func (w *workPool) Do(ctx context.Context, f func() error) error {
-	done, err := w.Wait(ctx)
+// Do calls f, when a worker is free.
+func (w *workPool) Do(ctx context.Context, uid int, prio priority, f func() error) error {
+	done, err := w.Wait(ctx, uid, prio)
 	if err != nil {
 		return err
 	}
@@ -24,14 +97,247 @@ func (w *workPool) Do(ctx context.Context, f func() error) error {
 	return f()
 }
 
-func (w *workPool) Wait(ctx context.Context) (func(), error) {
+// Wait blocks until a worker is free for the user. The returned function has
+// to be called, when the work is done.
+//
+// Returns an overloadedError, if the queue is full or the work waited too
+// long.
+func (w *workPool) Wait(ctx context.Context, uid int, prio priority) (func(), error) {
+	w.mu.Lock()
+	if w.running < w.limit && w.waiting == 0 {
+		w.running++
+		w.mu.Unlock()
+		return w.release, nil
+	}
+
+	if w.maxQueue > 0 && w.waiting >= w.maxQueue {
+		w.rejected++
+		w.mu.Unlock()
+		return nil, overloadedError{msg: "too many clients are waiting"}
+	}
+
+	waiter := &waiter{ready: make(chan struct{}), since: time.Now()}
+	w.queues[prio].push(uid, waiter)
+	w.waiting++
+	w.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if w.timeout > 0 {
+		timer := time.NewTimer(w.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	timedOut := false
 	select {
-	case w.sem <- token{}:
+	case <-waiter.ready:
+		return w.release, nil
+
 	case <-ctx.Done():
-		return nil, ctx.Err()
+		err = ctx.Err()
+
+	case <-timeout:
+		err = overloadedError{msg: fmt.Sprintf("waited more then %s for a worker", w.timeout)}
+		timedOut = true
 	}
 
-	return func() {
-		<-w.sem
-	}, nil
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.queues[prio].remove(uid, waiter) {
+		// The waiter got a worker at the same time. Give it to the next one.
+		w.releaseLocked()
+		return nil, err
+	}
+
+	w.waiting--
+	if timedOut {
+		w.timeouts++
+	}
+	return nil, err
+}
+
+// release gives a worker to the next waiting work.
+func (w *workPool) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.releaseLocked()
+}
+
+// releaseLocked is like release but has to be called with the lock.
+func (w *workPool) releaseLocked() {
+	// The next work is the work with the highest class, after the time the
+	// first work of each class waited is added. On a tie, the higher class
+	// wins.
+	now := time.Now()
+	next := priority(-1)
+	var nextScore time.Duration
+	for prio := priorityCount - 1; prio >= 0; prio-- {
+		waiter := w.queues[prio].peek()
+		if waiter == nil {
+			continue
+		}
+
+		score := time.Duration(prio)*w.aging + now.Sub(waiter.since)
+		if next == -1 || score > nextScore {
+			next = prio
+			nextScore = score
+		}
+	}
+
+	if next == -1 {
+		w.running--
+		return
+	}
+
+	waiter := w.queues[next].pop()
+	w.waiting--
+
+	waited := now.Sub(waiter.since)
+	w.waitCount++
+	w.waitTotal += waited
+	if waited > w.waitMax {
+		w.waitMax = waited
+	}
+
+	// The worker is not freed but given to the waiter.
+	close(waiter.ready)
+}
+
+// busy returns true, if all workers are in use.
+func (w *workPool) busy() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.running >= w.limit
+}
+
+func (w *workPool) metric(values metric.Container) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	values.Add("autoupdate_workers_busy", w.running)
+	values.Add("autoupdate_queue_len", w.waiting)
+	for prio := priority(0); prio < priorityCount; prio++ {
+		values.Add("autoupdate_queue_len_"+prio.String(), w.queues[prio].len)
+	}
+
+	var waitAvg time.Duration
+	if w.waitCount > 0 {
+		waitAvg = w.waitTotal / time.Duration(w.waitCount)
+	}
+	values.Add("autoupdate_queue_wait_count", w.waitCount)
+	values.Add("autoupdate_queue_wait_avg_ms", int(waitAvg.Milliseconds()))
+	values.Add("autoupdate_queue_wait_max_ms", int(w.waitMax.Milliseconds()))
+	values.Add("autoupdate_queue_timeouts", w.timeouts)
+	values.Add("autoupdate_queue_rejected", w.rejected)
+
+	w.waitCount = 0
+	w.waitTotal = 0
+	w.waitMax = 0
+}
+
+// waiter is work, that waits for a worker.
+type waiter struct {
+	ready chan struct{}
+	since time.Time
+}
+
+// fairQueue holds the waiting work of one priority class. The users take
+// turns.
+type fairQueue struct {
+	len   int
+	users map[int][]*waiter
+
+	// order are the users with waiting work. The first user is the next.
+	order []int
+}
+
+func (q *fairQueue) push(uid int, w *waiter) {
+	if q.users == nil {
+		q.users = make(map[int][]*waiter)
+	}
+
+	if len(q.users[uid]) == 0 {
+		q.order = append(q.order, uid)
+	}
+	q.users[uid] = append(q.users[uid], w)
+	q.len++
+}
+
+// peek returns the next waiter without removing it or nil, if the queue is
+// empty.
+func (q *fairQueue) peek() *waiter {
+	if len(q.order) == 0 {
+		return nil
+	}
+	return q.users[q.order[0]][0]
+}
+
+// pop returns the next waiter or nil, if the queue is empty.
+func (q *fairQueue) pop() *waiter {
+	if len(q.order) == 0 {
+		return nil
+	}
+
+	uid := q.order[0]
+	q.order = q.order[1:]
+
+	waiters := q.users[uid]
+	w := waiters[0]
+	if len(waiters) == 1 {
+		delete(q.users, uid)
+	} else {
+		q.users[uid] = waiters[1:]
+		q.order = append(q.order, uid)
+	}
+	q.len--
+	return w
+}
+
+// remove removes the waiter from the queue. Returns false, if the waiter is
+// not in the queue.
+func (q *fairQueue) remove(uid int, w *waiter) bool {
+	waiters := q.users[uid]
+	for i, other := range waiters {
+		if other != w {
+			continue
+		}
+
+		if len(waiters) > 1 {
+			q.users[uid] = append(waiters[:i:i], waiters[i+1:]...)
+			q.len--
+			return true
+		}
+
+		delete(q.users, uid)
+		for j, id := range q.order {
+			if id == uid {
+				q.order = append(q.order[:j:j], q.order[j+1:]...)
+				break
+			}
+		}
+		q.len--
+		return true
+	}
+	return false
+}
+
+// overloadedError is returned, when a connection can not get a worker.
+type overloadedError struct {
+	msg string
+}
+
+func (e overloadedError) Error() string {
+	return fmt.Sprintf("service is overloaded: %s", e.msg)
+}
+
+func (e overloadedError) Type() string {
+	return "overloaded"
+}
+
+func (e overloadedError) StatusCode() int {
+	return http.StatusServiceUnavailable
 }
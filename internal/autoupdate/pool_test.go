@@ -0,0 +1,275 @@
+package autoupdate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dsmock"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/environment"
+)
+
+// queue adds a waiter to the pool and waits until it is queued. The name is
+// sent to order, when the waiter gets the worker.
+func queue(t *testing.T, pool *workPool, uid int, prio priority, name string, order chan<- string) {
+	t.Helper()
+
+	pool.mu.Lock()
+	before := pool.waiting
+	pool.mu.Unlock()
+
+	go func() {
+		done, err := pool.Wait(context.Background(), uid, prio)
+		if err != nil {
+			order <- err.Error()
+			return
+		}
+		order <- name
+		done()
+	}()
+
+	for {
+		pool.mu.Lock()
+		waiting := pool.waiting
+		pool.mu.Unlock()
+
+		if waiting > before {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkPoolOrder(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		queue  func(t *testing.T, pool *workPool, order chan<- string)
+		expect []string
+	}{
+		{
+			"priority",
+			func(t *testing.T, pool *workPool, order chan<- string) {
+				queue(t, pool, 0, priorityAnonymous, "anonymous", order)
+				queue(t, pool, 1, priorityDelegate, "delegate", order)
+				queue(t, pool, 2, priorityProjector, "projector", order)
+				queue(t, pool, 3, priorityAdmin, "admin", order)
+			},
+			[]string{"projector", "admin", "delegate", "anonymous"},
+		},
+		{
+			"fair between users",
+			func(t *testing.T, pool *workPool, order chan<- string) {
+				queue(t, pool, 1, priorityDelegate, "user1", order)
+				queue(t, pool, 1, priorityDelegate, "user1", order)
+				queue(t, pool, 1, priorityDelegate, "user1", order)
+				queue(t, pool, 2, priorityDelegate, "user2", order)
+			},
+			[]string{"user1", "user2", "user1", "user1"},
+		},
+		{
+			"aging",
+			func(t *testing.T, pool *workPool, order chan<- string) {
+				pool.aging = 10 * time.Millisecond
+				queue(t, pool, 0, priorityAnonymous, "anonymous", order)
+				time.Sleep(100 * time.Millisecond)
+				queue(t, pool, 1, priorityDelegate, "delegate", order)
+				queue(t, pool, 2, priorityProjector, "projector", order)
+			},
+			[]string{"anonymous", "projector", "delegate"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newWorkPool(1, 0, 0)
+			done, err := pool.Wait(context.Background(), 1, priorityDelegate)
+			if err != nil {
+				t.Fatalf("Wait: %v", err)
+			}
+
+			order := make(chan string, len(tt.expect))
+			tt.queue(t, pool, order)
+			done()
+
+			for i, expect := range tt.expect {
+				if got := <-order; got != expect {
+					t.Errorf("worker %d got %s, expected %s", i, got, expect)
+				}
+			}
+
+			if pool.busy() {
+				t.Errorf("pool is busy after all work is done")
+			}
+		})
+	}
+}
+
+func TestWorkPoolOverloaded(t *testing.T) {
+	t.Run("queue full", func(t *testing.T) {
+		pool := newWorkPool(1, 1, 0)
+		done, _ := pool.Wait(context.Background(), 1, priorityDelegate)
+		defer done()
+
+		order := make(chan string, 1)
+		queue(t, pool, 2, priorityDelegate, "user2", order)
+
+		_, err := pool.Wait(context.Background(), 3, priorityProjector)
+
+		var errOverloaded overloadedError
+		if !errors.As(err, &errOverloaded) {
+			t.Errorf("got error %v, expected overloaded error", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		pool := newWorkPool(1, 0, time.Millisecond)
+		done, _ := pool.Wait(context.Background(), 1, priorityDelegate)
+
+		_, err := pool.Wait(context.Background(), 2, priorityDelegate)
+
+		var errOverloaded overloadedError
+		if !errors.As(err, &errOverloaded) {
+			t.Errorf("got error %v, expected overloaded error", err)
+		}
+
+		if pool.waiting != 0 || pool.timeouts != 1 {
+			t.Errorf("got %d waiting and %d timeouts, expected 0 and 1", pool.waiting, pool.timeouts)
+		}
+
+		done()
+		if pool.busy() {
+			t.Errorf("pool is busy after all work is done")
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		pool := newWorkPool(1, 0, 0)
+		done, _ := pool.Wait(context.Background(), 1, priorityDelegate)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := pool.Wait(ctx, 2, priorityDelegate); !errors.Is(err, context.Canceled) {
+			t.Errorf("got error %v, expected context.Canceled", err)
+		}
+
+		done()
+		if pool.busy() {
+			t.Errorf("pool is busy after all work is done")
+		}
+	})
+}
+
+func TestPriority(t *testing.T) {
+	ds, _ := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+	meeting/30:
+		admin_group_id: 1
+		default_group_id: 3
+	group:
+		1:
+			meeting_id: 30
+		2:
+			meeting_id: 30
+			permissions: [projector.can_manage]
+		3:
+			meeting_id: 30
+			permissions: [projector.can_see]
+
+	user:
+		1:
+			group_$_ids: ["30"]
+			group_$30_ids: [1]
+		2:
+			group_$_ids: ["30"]
+			group_$30_ids: [2]
+		3:
+			group_$_ids: ["30"]
+			group_$30_ids: [3]
+		4:
+			organization_management_level: can_manage_organization
+		5:
+			group_$_ids: ["30"]
+			group_$30_ids: [3]
+			is_physical_person: false
+		6:
+			is_physical_person: false
+	`))
+
+	a, _, err := New(environment.ForTests{}, ds, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		uid    int
+		expect priority
+	}{
+		{"anonymous", 0, priorityAnonymous},
+		{"delegate", 3, priorityDelegate},
+		{"meeting admin", 1, priorityAdmin},
+		{"organization manager", 4, priorityAdmin},
+		{"presenter", 2, priorityPresenter},
+		{"projector screen", 5, priorityProjector},
+		{"no physical person without meeting", 6, priorityDelegate},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.priority(context.Background(), tt.uid)
+			if err != nil {
+				t.Fatalf("priority: %v", err)
+			}
+
+			if got != tt.expect {
+				t.Errorf("got %s, expected %s", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestPriorityCache(t *testing.T) {
+	ds, _ := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+	user/1/username: hugo
+	`))
+
+	a, _, err := New(environment.ForTests{}, ds, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if got, _ := a.priority(context.Background(), 1); got != priorityDelegate {
+		t.Fatalf("got %s, expected %s", got, priorityDelegate)
+	}
+
+	// Change the cached value to see, if it is used.
+	a.priorities[1] = cachedPriority{tid: a.priorities[1].tid, prio: priorityAdmin}
+
+	if got, _ := a.priority(context.Background(), 1); got != priorityAdmin {
+		t.Errorf("got %s before an update, expected cached %s", got, priorityAdmin)
+	}
+
+	a.topic.Publish(dskey.MustKey("user/1/username"))
+
+	if got, _ := a.priority(context.Background(), 1); got != priorityDelegate {
+		t.Errorf("got %s after an update, expected %s", got, priorityDelegate)
+	}
+}
+
+func TestBatchDataUsesWorker(t *testing.T) {
+	ds, _ := dsmock.NewMockDatastore(nil)
+	a, _, err := New(environment.ForTests{"CONCURENT_WORKER": "1", "AUTOUPDATE_QUEUE_SIZE": "1"}, ds, nil)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	done, _ := a.pool.Wait(context.Background(), 1, priorityDelegate)
+	defer done()
+
+	order := make(chan string, 1)
+	queue(t, a.pool, 2, priorityDelegate, "user2", order)
+
+	_, err = a.BatchData(context.Background(), 0, nil)
+
+	var errOverloaded overloadedError
+	if !errors.As(err, &errOverloaded) {
+		t.Errorf("got error %v, expected overloaded error", err)
+	}
+}
@@ -0,0 +1,121 @@
+package autoupdate
+
+import (
+	"context"
+	"sync"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+)
+
+// fingerprinter is a KeysBuilder, that can tell, if it requests the same keys
+// as another KeysBuilder.
+type fingerprinter interface {
+	Fingerprint() string
+}
+
+// sharedKey identifies connections, that get the same data.
+type sharedKey struct {
+	uid int
+	kb  string
+}
+
+// sharedRegistry holds the shared computations of connections of the same user
+// with the same keysbuilder.
+//
+// A computation is removed, when the last connection is detached.
+type sharedRegistry struct {
+	mu      sync.Mutex
+	entries map[sharedKey]*sharedComputation
+}
+
+// attach returns the shared computation for the key. The returned function
+// has to be called once, when the connection is closed.
+//
+// If the computation is new, it uses the keysbuilder of c. So c must not use
+// its keysbuilder outside of the shared computation.
+func (r *sharedRegistry) attach(key sharedKey, c *connection) (*sharedComputation, func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.entries == nil {
+		r.entries = make(map[sharedKey]*sharedComputation)
+	}
+
+	sc, ok := r.entries[key]
+	if !ok {
+		sc = &sharedComputation{
+			sem: make(chan struct{}, 1),
+			worker: &connection{
+				autoupdate: c.autoupdate,
+				uid:        c.uid,
+				kb:         c.kb,
+				priority:   c.priority,
+			},
+		}
+		r.entries[key] = sc
+	}
+	sc.refs++
+
+	detach := func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		sc.refs--
+		if sc.refs == 0 {
+			delete(r.entries, key)
+		}
+	}
+	return sc, detach
+}
+
+// sharedComputation is the last result for connections with the same
+// sharedKey.
+type sharedComputation struct {
+	refs int // Protected by the mutex of the sharedRegistry.
+
+	// sem is a lock, that can be canceled with a context. Only one connection
+	// computes the data at the same time. The others wait for the result.
+	sem chan struct{}
+
+	// worker computes the data for all connections. It holds the keysbuilder
+	// and the state of the last update, so the next update can be
+	// incremental, regardless of the connection, that triggers it.
+	worker *connection
+
+	valid   bool
+	tid     uint64
+	data    map[dskey.Key][]byte
+	hotkeys map[dskey.Key]struct{}
+}
+
+// get returns the data for the topic id. If the data for this or a newer topic
+// id was already computed by another connection, it is returned. Otherwise it
+// is computed by the worker.
+//
+// The returned map is a copy, so each connection can filter it.
+func (s *sharedComputation) get(ctx context.Context, tid uint64) (map[dskey.Key][]byte, map[dskey.Key]struct{}, error) {
+	select {
+	case s.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	defer func() { <-s.sem }()
+
+	if !s.valid || s.tid < tid {
+		data, err := s.worker.restrictedData(ctx, s.worker.autoupdate.datastore)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		s.valid = true
+		s.tid = tid
+		s.data = data
+		s.hotkeys = s.worker.hotkeys
+	}
+
+	data := make(map[dskey.Key][]byte, len(s.data))
+	for k, v := range s.data {
+		data[k] = v
+	}
+	return data, s.hotkeys, nil
+}
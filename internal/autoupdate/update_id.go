@@ -0,0 +1,67 @@
+package autoupdate
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+)
+
+// updateIDs saves the datastore update id for the topic ids.
+type updateIDs struct {
+	mu      sync.Mutex
+	entries []updateIDEntry
+}
+
+type updateIDEntry struct {
+	tid     uint64
+	id      datastore.UpdateID
+	created time.Time
+}
+
+// add saves the update id for a topic id. The topic ids have to be added in
+// increasing order.
+func (u *updateIDs) add(tid uint64, id datastore.UpdateID) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.entries = append(u.entries, updateIDEntry{tid: tid, id: id, created: time.Now()})
+}
+
+// get returns the update id for a topic id. This is the id of the last update
+// with a topic id lower or equal to tid.
+//
+// Returns an empty id, if there is no such update.
+func (u *updateIDs) get(tid uint64) datastore.UpdateID {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	idx := sort.Search(len(u.entries), func(i int) bool {
+		return u.entries[i].tid > tid
+	})
+
+	if idx == 0 {
+		return datastore.UpdateID{}
+	}
+	return u.entries[idx-1].id
+}
+
+// prune removes entries that where created before t.
+//
+// The last entry before t is kept, because it is the id for all topic ids up
+// to the next entry.
+func (u *updateIDs) prune(t time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	idx := sort.Search(len(u.entries), func(i int) bool {
+		return !u.entries[i].created.Before(t)
+	})
+
+	if idx <= 1 {
+		return
+	}
+
+	u.entries = append(u.entries[:0], u.entries[idx-1:]...)
+}
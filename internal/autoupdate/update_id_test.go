@@ -0,0 +1,46 @@
+package autoupdate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+)
+
+func TestUpdateIDs(t *testing.T) {
+	var ids updateIDs
+	ids.add(2, datastore.UpdateID{StreamID: "2-0"})
+	ids.add(5, datastore.UpdateID{StreamID: "5-0"})
+
+	for _, tt := range []struct {
+		tid    uint64
+		expect string
+	}{
+		{1, ""},
+		{2, "2-0"},
+		{4, "2-0"},
+		{5, "5-0"},
+		{10, "5-0"},
+	} {
+		if got := ids.get(tt.tid).StreamID; got != tt.expect {
+			t.Errorf("get(%d) returned `%s`, expected `%s`", tt.tid, got, tt.expect)
+		}
+	}
+}
+
+func TestUpdateIDsPrune(t *testing.T) {
+	var ids updateIDs
+	ids.add(1, datastore.UpdateID{StreamID: "1-0"})
+	ids.add(2, datastore.UpdateID{StreamID: "2-0"})
+	ids.add(3, datastore.UpdateID{StreamID: "3-0"})
+
+	ids.prune(time.Now().Add(time.Hour))
+
+	if got := len(ids.entries); got != 1 {
+		t.Fatalf("Got %d entries after prune, expected 1", got)
+	}
+
+	if got := ids.get(4).StreamID; got != "3-0" {
+		t.Errorf("get(4) returned `%s`, expected `3-0`", got)
+	}
+}
@@ -0,0 +1,134 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/keysbuilder"
+)
+
+// maxBatchSize is the maximal number of requests in one batch.
+const maxBatchSize = 100
+
+type batchDataer interface {
+	BatchData(ctx context.Context, userID int, requests []autoupdate.SingleRequest) ([]autoupdate.SingleResult, error)
+}
+
+// batchRequest is one request of a batch.
+type batchRequest struct {
+	Body     json.RawMessage `json:"body"`
+	Position int             `json:"position"`
+}
+
+// batchResult is the response for one request of a batch. It has either data
+// or an error.
+type batchResult struct {
+	Data  any         `json:"data,omitempty"`
+	Error *batchError `json:"error,omitempty"`
+}
+
+// batchError is the error of one request of a batch.
+type batchError struct {
+	Type string `json:"type"`
+	Msg  string `json:"msg"`
+}
+
+// HandleBatch registers a route to get the data of many single requests at
+// once.
+//
+// The body is a list of requests like:
+//
+//	[{"body": [KEYSBUILDER]}, {"body": [KEYSBUILDER], "position": 42}]
+//
+// The response is a list with the result of each request at the same index:
+//
+//	[{"data": {"user/1/username": "admin"}}, {"error": {"type": "SyntaxError", "msg": "No data"}}]
+func HandleBatch(mux *http.ServeMux, auth Authenticater, batcher batchDataer) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "no-store, max-age=0")
+		uid := auth.FromContext(r.Context())
+		format := negotiateFormat(w, r)
+
+		var requests []batchRequest
+		if err := json.NewDecoder(r.Body).Decode(&requests); err != nil {
+			format.handleErrorWithStatus(w, invalidRequestError{fmt.Errorf("body has to be a list of requests: %w", err)})
+			return
+		}
+
+		if len(requests) > maxBatchSize {
+			format.handleErrorWithStatus(w, invalidRequestError{fmt.Errorf("a batch can have at most %d requests, not %d", maxBatchSize, len(requests))})
+			return
+		}
+
+		results := make([]batchResult, len(requests))
+
+		// The requests with a valid keysbuilder are sent together. index maps
+		// them to the position in the results.
+		var singleRequests []autoupdate.SingleRequest
+		var index []int
+		for i, request := range requests {
+			builder, err := keysbuilder.ManyFromJSON(bytes.NewReader(request.Body))
+			if err != nil {
+				results[i] = newBatchError(fmt.Errorf("building keysbuilder: %w", err))
+				continue
+			}
+
+			singleRequests = append(singleRequests, autoupdate.SingleRequest{KeysBuilder: builder, Position: request.Position})
+			index = append(index, i)
+		}
+
+		batchResults, err := batcher.BatchData(r.Context(), uid, singleRequests)
+		if err != nil {
+			format.handleErrorWithStatus(w, fmt.Errorf("getting batch data: %w", err))
+			return
+		}
+
+		for i, result := range batchResults {
+			if result.Err != nil {
+				results[index[i]] = newBatchError(result.Err)
+				continue
+			}
+			results[index[i]] = batchResult{Data: convertData(result.Data)}
+		}
+
+		if err := r.Context().Err(); err != nil {
+			format.handleErrorWithStatus(w, err)
+			return
+		}
+
+		format.setContentType(w)
+		if err := format.encode(w, results); err != nil {
+			format.handleErrorWithoutStatus(w, fmt.Errorf("encoding results: %w", err))
+			return
+		}
+	})
+
+	mux.Handle(
+		prefixPublic+"/batch",
+		validRequest(
+			authMiddleware(
+				handler,
+				auth,
+			),
+		),
+	)
+}
+
+// newBatchError returns the result for a request that failed.
+//
+// Internal errors are not send to the client. The request gets a general
+// error message instead.
+func newBatchError(err error) batchResult {
+	errType, msg, ok := clientError(err)
+	if !ok {
+		// The request was canceled or the connection is broken. The details
+		// are not interesting for the client.
+		errType, msg = "InternalError", "The request was canceled."
+	}
+	return batchResult{Error: &batchError{Type: errType, Msg: msg}}
+}
@@ -0,0 +1,106 @@
+package http_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
+	ahttp "github.com/OpenSlides/openslides-autoupdate-service/internal/http"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+)
+
+// batcherMock returns the position of each request as value. Requests with the
+// position 13 fail and requests with the position 14 are canceled.
+type batcherMock struct{}
+
+func (batcherMock) BatchData(ctx context.Context, userID int, requests []autoupdate.SingleRequest) ([]autoupdate.SingleResult, error) {
+	results := make([]autoupdate.SingleResult, len(requests))
+	for i, request := range requests {
+		if request.Position == 13 {
+			results[i].Err = fmt.Errorf("some internal error")
+			continue
+		}
+
+		if request.Position == 14 {
+			results[i].Err = context.Canceled
+			continue
+		}
+
+		results[i].Data = map[dskey.Key][]byte{myKey1: []byte(fmt.Sprint(request.Position))}
+	}
+	return results, nil
+}
+
+func TestBatch(t *testing.T) {
+	mux := http.NewServeMux()
+	ahttp.HandleBatch(mux, fakeAuth(1), batcherMock{})
+
+	for _, tt := range []struct {
+		name   string
+		body   string
+		status int
+		expect string
+	}{
+		{
+			"one request",
+			`[{"body":[{"ids":[1],"collection":"user","fields":{"name":null}}]}]`,
+			200,
+			`[{"data":{"collection/1/field":0}}]` + "\n",
+		},
+		{
+			"invalid keysbuilder",
+			`[{"body":[{"ids":[1],"collection":"user","fields":{"name":null}}],"position":5},{"body":[]},{"body":[{"ids":[1],"collection":"user","fields":{"name":null}}],"position":7}]`,
+			200,
+			`[{"data":{"collection/1/field":5}},{"error":{"type":"SyntaxError","msg":"No data"}},{"data":{"collection/1/field":7}}]` + "\n",
+		},
+		{
+			"internal error",
+			`[{"body":[{"ids":[1],"collection":"user","fields":{"name":null}}],"position":13}]`,
+			200,
+			`[{"error":{"type":"InternalError","msg":"Something went wrong on the server. The admin is already informed."}}]` + "\n",
+		},
+		{
+			"canceled",
+			`[{"body":[{"ids":[1],"collection":"user","fields":{"name":null}}],"position":14}]`,
+			200,
+			`[{"error":{"type":"InternalError","msg":"The request was canceled."}}]` + "\n",
+		},
+		{
+			"empty batch",
+			`[]`,
+			200,
+			`[]` + "\n",
+		},
+		{
+			"invalid body",
+			`{"body":[]}`,
+			400,
+			"",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/system/autoupdate/batch", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			res := rec.Result()
+			if res.StatusCode != tt.status {
+				t.Errorf("got status %s, expected %d", res.Status, tt.status)
+			}
+
+			if tt.expect == "" {
+				return
+			}
+
+			got, _ := io.ReadAll(res.Body)
+			if string(got) != tt.expect {
+				t.Errorf("got `%s`, expected `%s`", got, tt.expect)
+			}
+		})
+	}
+}
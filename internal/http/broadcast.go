@@ -0,0 +1,468 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/klauspost/compress/zstd"
+)
+
+// broadcastBuffer is the amount of messages, that are buffered for each
+// client of a broadcast. A client, that is slower, is disconnected.
+const broadcastBuffer = 16
+
+// errBroadcastTooSlow is returned to a client, that can not read the messages
+// of a broadcast fast enough.
+var errBroadcastTooSlow = errors.New("client is too slow to receive the messages")
+
+// errBroadcastScopeChanged is returned to a user, whose permissions changed
+// while it was part of a broadcast.
+var errBroadcastScopeChanged = errors.New("the permissions of the user changed")
+
+// errNotJoined is returned by sendBroadcast, if the user does not get the same
+// data as the broadcast. The client has to use its own connection.
+var errNotJoined = errors.New("user does not get the data of the broadcast")
+
+// broadcastScoper is a Connecter, that can tell, which users get the same
+// restricted data.
+type broadcastScoper interface {
+	BroadcastScope(ctx context.Context, userID int) (string, error)
+}
+
+// frameEncoder compresses the messages of broadcasts. Each message is its own
+// zstd frame. EncodeAll can be used at the same time from many goroutines.
+var frameEncoder = mustFrameEncoder()
+
+// mustFrameEncoder creates the encoder for frameEncoder. It only fails with
+// invalid options, so the error is a bug.
+func mustFrameEncoder() *zstd.Encoder {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		panic(fmt.Sprintf("creating zstd frame encoder: %v", err))
+	}
+	return encoder
+}
+
+// isBroadcastRequest returns true, if the request is a plain stream. Only the
+// keysbuilder, the format and the compression define the messages of such a
+// stream.
+func isBroadcastRequest(r *http.Request) bool {
+	if isEventStream(r) {
+		return false
+	}
+
+	query := r.URL.Query()
+	for _, name := range []string{"single", "position", "playback", "long_poll", "delta", "with_position", "skip_first", "profile_restrict"} {
+		if query.Has(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// broadcastKey identifies clients, that get exactly the same bytes.
+type broadcastKey struct {
+	// scope is empty for anonymous clients. For other users, it is the value
+	// from BroadcastScope.
+	scope       string
+	kb          string
+	contentType string
+	compress    bool
+	zstdFrames  bool
+	minInterval time.Duration
+}
+
+// broadcasts holds the running broadcasts.
+//
+// A broadcast is one autoupdate connection for many clients. The data is
+// computed and encoded once and the same bytes are written to each client.
+//
+// Anonymous clients share a broadcast. Projector screens with the same scope
+// share a broadcast, that is computed for the first screen. The restriction
+// can still give two screens different data, for example the own user object.
+// So a screen only joins a running broadcast, if its restricted data is the
+// same as the current data of the broadcast. It leaves the broadcast, when its
+// scope changes.
+type broadcasts struct {
+	connecter Connecter
+
+	mu      sync.Mutex
+	running map[broadcastKey]*broadcast
+}
+
+func newBroadcasts(connecter Connecter) *broadcasts {
+	return &broadcasts{
+		connecter: connecter,
+		running:   make(map[broadcastKey]*broadcast),
+	}
+}
+
+// scope returns the broadcast scope of a user. It is empty, if the user can
+// not share a broadcast.
+func (bs *broadcasts) scope(ctx context.Context, uid int) (string, error) {
+	scoper, ok := bs.connecter.(broadcastScoper)
+	if !ok || uid == 0 {
+		return "", nil
+	}
+
+	return scoper.BroadcastScope(ctx, uid)
+}
+
+// broadcast is an autoupdate connection with many clients.
+type broadcast struct {
+	key      broadcastKey
+	uid      int
+	encoding messageEncoding
+	cancel   context.CancelFunc
+
+	mu      sync.Mutex
+	clients map[chan []byte]struct{}
+	started bool
+	err     error
+
+	// current is the data, that a client has after the last message.
+	// snapshot is the encoded current data for new clients. It is created
+	// when it is needed.
+	current  map[dskey.Key][]byte
+	snapshot []byte
+}
+
+// subscribe adds a client to the broadcast for the key. It starts the
+// broadcast, if it is not running.
+//
+// The returned channel gets the encoded messages. It is closed, when the
+// broadcast stops or the client is too slow. Then the returned function
+// returns the reason. The returned function to unsubscribe has to be called,
+// when the client is finished.
+//
+// A user with a scope only joins a running broadcast of another user, if it
+// gets the same data. Otherwise, errNotJoined is returned.
+func (bs *broadcasts) subscribe(ctx context.Context, key broadcastKey, uid int, kb autoupdate.KeysBuilder, encoding messageEncoding) (<-chan []byte, func() error, func(), error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	b, ok := bs.running[key]
+	if ok && key.scope != "" && b.uid != uid {
+		// Computing the data of the user takes time. The lock is released in
+		// the meantime.
+		bs.mu.Unlock()
+		same, err := b.sameData(ctx, bs.connecter, uid, kb)
+		bs.mu.Lock()
+
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("checking data of the broadcast: %w", err)
+		}
+
+		if !same || bs.running[key] != b {
+			return nil, nil, nil, errNotJoined
+		}
+	}
+
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		b = &broadcast{
+			key:      key,
+			uid:      uid,
+			encoding: encoding,
+			cancel:   cancel,
+			clients:  make(map[chan []byte]struct{}),
+			current:  make(map[dskey.Key][]byte),
+		}
+		bs.running[key] = b
+		go b.run(ctx, bs, kb)
+	}
+
+	messages := make(chan []byte, broadcastBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		close(messages)
+	} else {
+		b.clients[messages] = struct{}{}
+
+		if b.started {
+			snapshot, err := b.encodedSnapshot()
+			if err != nil {
+				b.stop(fmt.Errorf("encoding current data: %w", err))
+			} else {
+				messages <- snapshot
+			}
+		}
+	}
+
+	errFunc := func() error {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.err != nil {
+			return b.err
+		}
+		return errBroadcastTooSlow
+	}
+
+	unsubscribe := func() {
+		bs.mu.Lock()
+		defer bs.mu.Unlock()
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.clients[messages]; ok {
+			delete(b.clients, messages)
+			close(messages)
+		}
+
+		if len(b.clients) == 0 && bs.running[key] == b {
+			delete(bs.running, key)
+			b.cancel()
+		}
+	}
+
+	return messages, errFunc, unsubscribe, nil
+}
+
+// sameData returns true, if the user gets the current data of the broadcast.
+//
+// If the broadcast did not send its first message, the data can not be
+// compared and false is returned.
+func (b *broadcast) sameData(ctx context.Context, connecter Connecter, uid int, kb autoupdate.KeysBuilder) (bool, error) {
+	data, err := connecter.SingleData(ctx, uid, kb, 0)
+	if err != nil {
+		return false, fmt.Errorf("getting data of user %d: %w", uid, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.started {
+		return false, nil
+	}
+
+	var count int
+	for key, value := range data {
+		if value == nil {
+			continue
+		}
+
+		if !bytes.Equal(b.current[key], value) {
+			return false, nil
+		}
+		count++
+	}
+	return count == len(b.current), nil
+}
+
+// run reads the messages of the autoupdate connection and sends them to the
+// clients.
+//
+// Blocks until the context is done or the connection returns an error. It
+// also stops, when the scope of the user, that the data is computed for,
+// changes.
+func (b *broadcast) run(ctx context.Context, bs *broadcasts, kb autoupdate.KeysBuilder) {
+	next, err := bs.connecter.Connect(ctx, b.uid, kb, autoupdate.WithMinInterval(b.key.minInterval))
+	if err != nil {
+		b.mu.Lock()
+		b.stop(fmt.Errorf("getting connection: %w", err))
+		b.mu.Unlock()
+		return
+	}
+
+	for f, ok := next(); ok; f, ok = next() {
+		data, err := f(ctx)
+		if err != nil {
+			b.mu.Lock()
+			b.stop(fmt.Errorf("getting next message: %w", err))
+			b.mu.Unlock()
+			return
+		}
+
+		if b.key.scope != "" {
+			scope, err := bs.scope(ctx, b.uid)
+			if err == nil && scope != b.key.scope {
+				err = errBroadcastScopeChanged
+			}
+
+			if err != nil {
+				b.mu.Lock()
+				b.stop(err)
+				b.mu.Unlock()
+				return
+			}
+		}
+
+		message, err := b.encode(data)
+
+		b.mu.Lock()
+		if err != nil {
+			b.stop(fmt.Errorf("encoding message: %w", err))
+			b.mu.Unlock()
+			return
+		}
+
+		b.started = true
+		b.snapshot = nil
+		for key, value := range data {
+			if value == nil {
+				delete(b.current, key)
+				continue
+			}
+			b.current[key] = value
+		}
+
+		for client := range b.clients {
+			select {
+			case client <- message:
+			default:
+				delete(b.clients, client)
+				close(client)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// stop closes all clients with the error.
+//
+// Has to be called with the lock.
+func (b *broadcast) stop(err error) {
+	b.err = err
+	for client := range b.clients {
+		delete(b.clients, client)
+		close(client)
+	}
+}
+
+// encodedSnapshot returns the encoded current data.
+//
+// Has to be called with the lock.
+func (b *broadcast) encodedSnapshot() ([]byte, error) {
+	if b.snapshot == nil {
+		snapshot, err := b.encode(b.current)
+		if err != nil {
+			return nil, err
+		}
+		b.snapshot = snapshot
+	}
+	return b.snapshot, nil
+}
+
+// encode returns the bytes of a message, like they are written to the client.
+func (b *broadcast) encode(data map[dskey.Key][]byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := writeData(buf, data, b.encoding); err != nil {
+		return nil, err
+	}
+
+	if b.key.zstdFrames {
+		return frameEncoder.EncodeAll(buf.Bytes(), nil), nil
+	}
+	return buf.Bytes(), nil
+}
+
+// sendBroadcast writes the messages of a broadcast until the context is done.
+//
+// It is like sendMessages but for clients, that share one connection. If the
+// user can not join the broadcast, errNotJoined is returned before anything is
+// written.
+func sendBroadcast(ctx context.Context, w *streamWriter, bs *broadcasts, key broadcastKey, uid int, kb autoupdate.KeysBuilder, encoding messageEncoding, heartbeat time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	messages, errFunc, unsubscribe, err := bs.subscribe(ctx, key, uid, kb, encoding)
+	if err != nil {
+		return err
+	}
+	defer unsubscribe()
+
+	if heartbeat > 0 {
+		stopHeartbeat := w.startHeartbeat(ctx, heartbeat, func(w io.Writer) error {
+			return writeMessage(w, controlFrame{Control: ControlMessage{Type: controlHeartbeat}}, encoding)
+		}, cancel)
+		defer stopHeartbeat()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case message, ok := <-messages:
+			if !ok {
+				return errFunc()
+			}
+
+			// The scope of a user can change with each update. The user must
+			// not get data of a scope, that it left.
+			if key.scope != "" {
+				scope, err := bs.scope(ctx, uid)
+				if err != nil {
+					return fmt.Errorf("checking broadcast scope: %w", err)
+				}
+
+				if scope != key.scope {
+					return errBroadcastScopeChanged
+				}
+			}
+
+			if err := w.write(func(w io.Writer) error { return writeEncoded(w, message) }); err != nil {
+				return fmt.Errorf("write data: %w", err)
+			}
+		}
+	}
+}
+
+// writeEncoded writes a message, that is already encoded for the client.
+func writeEncoded(w io.Writer, message []byte) error {
+	if fw, ok := w.(*frameWriter); ok {
+		w = fw.ResponseWriter
+	}
+
+	_, err := w.Write(message)
+	return err
+}
+
+// frameWriter is a http.ResponseWriter that compresses each write as its own
+// zstd frame.
+//
+// A stream of zstd frames is a valid zstd stream. So messages, that are
+// compressed only once, can be mixed with messages, that are compressed for
+// one client.
+type frameWriter struct {
+	http.ResponseWriter
+}
+
+// newFrameWriter creates a frameWriter and sets the response headers.
+func newFrameWriter(w http.ResponseWriter) *frameWriter {
+	w.Header().Set("Content-Encoding", "zstd")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Del("Content-Length")
+	return &frameWriter{ResponseWriter: w}
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	if _, err := w.ResponseWriter.Write(frameEncoder.EncodeAll(p, nil)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush flushes the underlying ResponseWriter.
+func (w *frameWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *frameWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,294 @@
+package http_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
+	ahttp "github.com/OpenSlides/openslides-autoupdate-service/internal/http"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/klauspost/compress/zstd"
+)
+
+// countingConnecter counts the connections. Each connection returns the first
+// data and afterwards the values from the channel.
+type countingConnecter struct {
+	connects atomic.Int32
+	data     chan map[dskey.Key][]byte
+}
+
+func (c *countingConnecter) Connect(ctx context.Context, userID int, kb autoupdate.KeysBuilder, options ...autoupdate.ConnectOption) (autoupdate.DataProvider, error) {
+	c.connects.Add(1)
+
+	first := true
+	f := func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		if first {
+			first = false
+			return map[dskey.Key][]byte{dskey.MustKey("user/1/name"): []byte(`"first"`)}, nil
+		}
+
+		select {
+		case data := <-c.data:
+			return data, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true }, nil
+}
+
+func (c *countingConnecter) SingleData(ctx context.Context, userID int, kb autoupdate.KeysBuilder, position int) (map[dskey.Key][]byte, error) {
+	return nil, nil
+}
+
+func (c *countingConnecter) LastUpdateID() datastore.UpdateID {
+	return datastore.UpdateID{}
+}
+
+// scopedConnecter is a countingConnecter, where users have a broadcast scope.
+type scopedConnecter struct {
+	*countingConnecter
+
+	mu     sync.Mutex
+	scopes map[int]string
+	single map[int]map[dskey.Key][]byte
+}
+
+func (c *scopedConnecter) BroadcastScope(ctx context.Context, userID int) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.scopes[userID], nil
+}
+
+func (c *scopedConnecter) SingleData(ctx context.Context, userID int, kb autoupdate.KeysBuilder, position int) (map[dskey.Key][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.single[userID], nil
+}
+
+// queryAuth is an Authenticater, that takes the user id from the query
+// parameter uid.
+type queryAuth struct{}
+
+type queryAuthKey struct{}
+
+func (queryAuth) Authenticate(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	uid, _ := strconv.Atoi(r.URL.Query().Get("uid"))
+	return context.WithValue(r.Context(), queryAuthKey{}, uid), nil
+}
+
+func (queryAuth) FromContext(ctx context.Context) int {
+	uid, _ := ctx.Value(queryAuthKey{}).(int)
+	return uid
+}
+
+func TestBroadcast(t *testing.T) {
+	connect := func(t *testing.T, ctx context.Context, url string, encoding string) *bufio.Reader {
+		t.Helper()
+
+		req, err := http.NewRequestWithContext(ctx, "GET", url+"/system/autoupdate?k=user/1/name", nil)
+		if err != nil {
+			t.Fatalf("creating request: %v", err)
+		}
+		req.Header.Set("Accept-Encoding", encoding)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("got status %s", resp.Status)
+		}
+
+		var body io.Reader = resp.Body
+		if encoding == "zstd" {
+			decoder, err := zstd.NewReader(resp.Body)
+			if err != nil {
+				t.Fatalf("creating decoder: %v", err)
+			}
+			t.Cleanup(decoder.Close)
+			body = decoder
+		}
+		return bufio.NewReader(body)
+	}
+
+	readLine := func(t *testing.T, r *bufio.Reader) string {
+		t.Helper()
+
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading line: %v", err)
+		}
+		return line
+	}
+
+	start := func(t *testing.T, uid int) (*countingConnecter, string) {
+		t.Helper()
+
+		connecter := &countingConnecter{data: make(chan map[dskey.Key][]byte)}
+		mux := http.NewServeMux()
+		ahttp.HandleAutoupdate(mux, fakeAuth(uid), connecter, ahttp.AutoupdateOptions{})
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+		return connecter, srv.URL
+	}
+
+	for _, encoding := range []string{"identity", "zstd"} {
+		t.Run(encoding, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			connecter, url := start(t, 0)
+
+			clients := make([]*bufio.Reader, 2)
+			for i := range clients {
+				clients[i] = connect(t, ctx, url, encoding)
+				if got := readLine(t, clients[i]); got != `{"user/1/name":"first"}`+"\n" {
+					t.Errorf("client %d: got first message %q", i, got)
+				}
+			}
+
+			connecter.data <- map[dskey.Key][]byte{dskey.MustKey("user/1/name"): []byte(`"second"`)}
+
+			for i, client := range clients {
+				if got := readLine(t, client); got != `{"user/1/name":"second"}`+"\n" {
+					t.Errorf("client %d: got second message %q", i, got)
+				}
+			}
+
+			// A client, that connects later, gets the current data.
+			late := connect(t, ctx, url, encoding)
+			if got := readLine(t, late); got != `{"user/1/name":"second"}`+"\n" {
+				t.Errorf("late client: got first message %q", got)
+			}
+
+			if got := connecter.connects.Load(); got != 1 {
+				t.Errorf("got %d connections to the autoupdate service, expected 1", got)
+			}
+		})
+	}
+
+	t.Run("user", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		connecter, url := start(t, 1)
+
+		for i := 0; i < 2; i++ {
+			readLine(t, connect(t, ctx, url, "identity"))
+		}
+
+		if got := connecter.connects.Load(); got != 2 {
+			t.Errorf("got %d connections to the autoupdate service, expected 2", got)
+		}
+	})
+}
+
+func TestBroadcastProjector(t *testing.T) {
+	firstData := map[dskey.Key][]byte{dskey.MustKey("user/1/name"): []byte(`"first"`)}
+	otherData := map[dskey.Key][]byte{dskey.MustKey("user/1/name"): []byte(`"other"`)}
+
+	start := func(t *testing.T) (*scopedConnecter, string) {
+		t.Helper()
+
+		connecter := &scopedConnecter{
+			countingConnecter: &countingConnecter{data: make(chan map[dskey.Key][]byte)},
+			scopes:            map[int]string{1: "screen", 2: "screen", 3: "screen", 4: "other screen"},
+			single:            map[int]map[dskey.Key][]byte{1: firstData, 2: firstData, 3: otherData, 4: firstData},
+		}
+		mux := http.NewServeMux()
+		ahttp.HandleAutoupdate(mux, queryAuth{}, connecter, ahttp.AutoupdateOptions{})
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+		return connecter, srv.URL
+	}
+
+	connect := func(t *testing.T, ctx context.Context, url string, uid int) *bufio.Reader {
+		t.Helper()
+
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/system/autoupdate?k=user/1/name&uid=%d", url, uid), nil)
+		if err != nil {
+			t.Fatalf("creating request: %v", err)
+		}
+		req.Header.Set("Accept-Encoding", "identity")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("got status %s", resp.Status)
+		}
+
+		reader := bufio.NewReader(resp.Body)
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatalf("reading first message: %v", err)
+		}
+		return reader
+	}
+
+	for _, tt := range []struct {
+		name    string
+		uids    []int
+		connect int32
+	}{
+		{"same scope and data", []int{1, 2}, 1},
+		{"same user", []int{1, 1}, 1},
+		{"other data", []int{1, 3}, 2},
+		{"other scope", []int{1, 4}, 2},
+		{"no scope", []int{1, 5}, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			connecter, url := start(t)
+			for _, uid := range tt.uids {
+				connect(t, ctx, url, uid)
+			}
+
+			if got := connecter.connects.Load(); got != tt.connect {
+				t.Errorf("got %d connections to the autoupdate service, expected %d", got, tt.connect)
+			}
+		})
+	}
+
+	t.Run("scope changed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		connecter, url := start(t)
+		connect(t, ctx, url, 1)
+		client := connect(t, ctx, url, 2)
+
+		connecter.mu.Lock()
+		connecter.scopes[2] = "other screen"
+		connecter.mu.Unlock()
+
+		connecter.data <- map[dskey.Key][]byte{dskey.MustKey("user/1/name"): []byte(`"second"`)}
+
+		line, err := client.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading line: %v", err)
+		}
+
+		if strings.Contains(line, "second") {
+			t.Errorf("got message %q after the scope changed", line)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package http
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// supportedEncodings are the content encodings, the service can use. The first
+// encoding is preferred, if the client accepts many encodings with the same
+// quality.
+var supportedEncodings = []string{"zstd", "gzip"}
+
+// negotiateEncoding returns the content encoding from the Accept-Encoding
+// header of the request. Returns an empty string, if the client does not
+// accept a supported encoding.
+func negotiateEncoding(r *http.Request) string {
+	qualities := make(map[string]float64)
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(part, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+
+			quality := 1.0
+			if rawQuality, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				q, err := strconv.ParseFloat(rawQuality, 64)
+				if err != nil {
+					continue
+				}
+				quality = q
+			}
+			qualities[name] = quality
+		}
+	}
+
+	var best string
+	var bestQuality float64
+	for _, encoding := range supportedEncodings {
+		quality, ok := qualities[encoding]
+		if !ok {
+			quality, ok = qualities["*"]
+		}
+
+		if ok && quality > bestQuality {
+			best = encoding
+			bestQuality = quality
+		}
+	}
+	return best
+}
+
+// compressor is a writer that compresses the data.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter is a http.ResponseWriter that compresses all data with one
+// compressor.
+//
+// Each call to Flush flushes the compressor, so the client can decompress all
+// data, that was written before. Later messages use the compression window of
+// earlier messages.
+type compressWriter struct {
+	http.ResponseWriter
+	compressor compressor
+}
+
+// newCompressWriter creates a compressWriter and sets the response headers.
+//
+// Close has to be called, when the response is finished.
+func newCompressWriter(w http.ResponseWriter, encoding string) (*compressWriter, error) {
+	var c compressor
+	switch encoding {
+	case "gzip":
+		c = gzip.NewWriter(w)
+
+	case "zstd":
+		// Each connection has its own encoder. Use the options with less
+		// memory and without background goroutines.
+		encoder, err := zstd.NewWriter(
+			w,
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithLowerEncoderMem(true),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("creating zstd encoder: %w", err)
+		}
+		c = encoder
+
+	default:
+		return nil, fmt.Errorf("unsupported encoding %s", encoding)
+	}
+
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Del("Content-Length")
+
+	return &compressWriter{ResponseWriter: w, compressor: c}, nil
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	return w.compressor.Write(p)
+}
+
+// Flush flushes the compressor and the underlying ResponseWriter.
+func (w *compressWriter) Flush() {
+	if err := w.compressor.Flush(); err != nil {
+		return
+	}
+
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close writes the end of the compressed stream.
+func (w *compressWriter) Close() error {
+	return w.compressor.Close()
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,105 @@
+package http_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ahttp "github.com/OpenSlides/openslides-autoupdate-service/internal/http"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestContentEncoding(t *testing.T) {
+	f := func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		return map[dskey.Key][]byte{myKey1: []byte(`"bar"`)}, nil
+	}
+	connecter := &connecterMock{
+		f: func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true },
+	}
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{})
+
+	for _, tt := range []struct {
+		name           string
+		acceptEncoding string
+		expectEncoding string
+	}{
+		{"no header", "", ""},
+		{"gzip", "gzip", "gzip"},
+		{"zstd", "zstd", "zstd"},
+		{"prefer zstd", "gzip, zstd", "zstd"},
+		{"quality", "gzip;q=1.0, zstd;q=0.5", "gzip"},
+		{"wildcard", "*", "zstd"},
+		{"disabled", "gzip;q=0", ""},
+		{"unsupported", "br", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/system/autoupdate?k=user/1/name&single=1", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			res := rec.Result()
+
+			if got := res.Header.Get("Content-Encoding"); got != tt.expectEncoding {
+				t.Fatalf("Got Content-Encoding `%s`, expected `%s`", got, tt.expectEncoding)
+			}
+
+			var body io.Reader = res.Body
+			switch tt.expectEncoding {
+			case "gzip":
+				r, err := gzip.NewReader(res.Body)
+				if err != nil {
+					t.Fatalf("creating gzip reader: %v", err)
+				}
+				body = r
+
+			case "zstd":
+				r, err := zstd.NewReader(res.Body)
+				if err != nil {
+					t.Fatalf("creating zstd reader: %v", err)
+				}
+				defer r.Close()
+				body = r
+			}
+
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+
+			expect := `{"collection/1/field":"bar"}` + "\n"
+			if string(got) != expect {
+				t.Errorf("Got `%s`, expected `%s`", got, expect)
+			}
+		})
+	}
+}
+
+func TestContentEncodingWithCompressParameter(t *testing.T) {
+	f := func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		return map[dskey.Key][]byte{myKey1: []byte(`"bar"`)}, nil
+	}
+	connecter := &connecterMock{
+		f: func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true },
+	}
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{})
+
+	req := httptest.NewRequest("GET", "/system/autoupdate?k=user/1/name&single=1&compress=1", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if got := rec.Result().Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("Got Content-Encoding `%s`, expected none", got)
+	}
+}
@@ -0,0 +1,368 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// controlReconnect tells the client to reconnect after the delay. The
+	// server closes the connection after this message.
+	controlReconnect = "reconnect"
+
+	// controlReload tells the client to reload the app, for example after a
+	// new client version was deployed.
+	controlReload = "reload"
+
+	// controlMaintenance tells the client to show a maintenance notice.
+	controlMaintenance = "maintenance"
+
+	// controlHeartbeat is sent, when there was no other message for some
+	// time. The client can use it to detect dead connections.
+	controlHeartbeat = "heartbeat"
+
+	// reconnectJitter is the maximal delay for the reconnect messages while
+	// the server is shutting down.
+	reconnectJitter = time.Second
+)
+
+// ControlMessage is a message from the server to the client that is not data.
+type ControlMessage struct {
+	Type string `json:"type"`
+
+	// Delay in milliseconds until the client should reconnect.
+	Delay int `json:"delay,omitempty"`
+
+	// Message is a text for the maintenance notice.
+	Message string `json:"message,omitempty"`
+}
+
+// controlFrame is the encoding of a control message in a stream. Data messages
+// are never an object with the only key `control`.
+type controlFrame struct {
+	Control ControlMessage `json:"control"`
+}
+
+// ControlHub sends control messages to all open connections.
+//
+// Has to be created with NewControlHub().
+type ControlHub struct {
+	mu            sync.Mutex
+	subscriptions map[*controlSubscription]struct{}
+	draining      bool
+}
+
+// NewControlHub initializes a ControlHub.
+func NewControlHub() *ControlHub {
+	return &ControlHub{
+		subscriptions: make(map[*controlSubscription]struct{}),
+	}
+}
+
+// controlSubscription receives the control messages for one connection.
+type controlSubscription struct {
+	messages chan ControlMessage
+}
+
+// send sends a message to the connection. If the connection does not read its
+// messages, the message is dropped.
+func (s *controlSubscription) send(msg ControlMessage) {
+	select {
+	case s.messages <- msg:
+	default:
+	}
+}
+
+// subscribe registers a connection. The returned function has to be called,
+// when the connection is closed.
+//
+// If the hub is draining, the connection gets a reconnect message
+// immediately.
+func (h *ControlHub) subscribe() (*controlSubscription, func()) {
+	sub := &controlSubscription{messages: make(chan ControlMessage, 10)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.draining {
+		sub.send(ControlMessage{Type: controlReconnect, Delay: randomMilliseconds(reconnectJitter)})
+		return sub, func() {}
+	}
+
+	h.subscriptions[sub] = struct{}{}
+	return sub, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subscriptions, sub)
+	}
+}
+
+// Broadcast sends a control message to all open connections.
+//
+// For reconnect messages, the delay is the window, in which the clients should
+// reconnect. Each client gets a random delay in this window.
+func (h *ControlHub) Broadcast(msg ControlMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscriptions {
+		clientMsg := msg
+		if msg.Type == controlReconnect {
+			clientMsg.Delay = randomMilliseconds(time.Duration(msg.Delay) * time.Millisecond)
+		}
+		sub.send(clientMsg)
+	}
+}
+
+// Drain sends a reconnect message to all open connections. The messages are
+// spread over the window, so the clients do not reconnect at the same time.
+// Streams without control messages are closed at this time instead.
+//
+// Connections, that are opened while draining, get a reconnect message
+// immediately.
+//
+// Blocks until the window is over or the context is done. Returns immediately,
+// if there are no open connections.
+func (h *ControlHub) Drain(ctx context.Context, window time.Duration) {
+	if window < 0 {
+		window = 0
+	}
+
+	h.mu.Lock()
+	h.draining = true
+	subscriptions := h.subscriptions
+	h.subscriptions = make(map[*controlSubscription]struct{})
+	h.mu.Unlock()
+
+	if len(subscriptions) == 0 {
+		return
+	}
+
+	deadline := time.Now().Add(window)
+
+	var wg sync.WaitGroup
+	for sub := range subscriptions {
+		wg.Add(1)
+		go func(sub *controlSubscription) {
+			defer wg.Done()
+
+			select {
+			case <-time.After(time.Duration(rand.Int63n(int64(window) + 1))):
+				sub.send(ControlMessage{Type: controlReconnect, Delay: randomMilliseconds(reconnectJitter)})
+			case <-ctx.Done():
+			}
+		}(sub)
+	}
+	wg.Wait()
+
+	select {
+	case <-time.After(time.Until(deadline)):
+	case <-ctx.Done():
+	}
+}
+
+// randomMilliseconds returns a random duration in milliseconds between 0 and
+// max.
+func randomMilliseconds(max time.Duration) int {
+	if max <= 0 {
+		return 0
+	}
+	return int(rand.Int63n(max.Milliseconds() + 1))
+}
+
+// listen writes the control messages for one connection with write, until the
+// context is done. After a reconnect message, stop is called, so the
+// connection gets closed.
+//
+// If write is nil, the messages are not written. The connection is only closed
+// on a reconnect message. This is used for streams, that do not understand
+// control messages, so they are also closed, when the server is drained.
+//
+// The returned function stops listening and blocks until a running write is
+// done. It has to be called before the connection is closed.
+//
+// Does nothing, if the hub is nil.
+func (h *ControlHub) listen(ctx context.Context, write func(ControlMessage) error, stop func()) func() {
+	if h == nil {
+		return func() {}
+	}
+
+	sub, unsubscribe := h.subscribe()
+	return runInBackground(ctx, func(ctx context.Context) {
+		defer unsubscribe()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case msg := <-sub.messages:
+				if write == nil {
+					if msg.Type == controlReconnect {
+						stop()
+						return
+					}
+					continue
+				}
+
+				if err := write(msg); err != nil || msg.Type == controlReconnect {
+					stop()
+					return
+				}
+			}
+		}
+	})
+}
+
+// runInBackground calls f in a goroutine. The returned function cancels the
+// context of f and blocks until f returned.
+func runInBackground(ctx context.Context, f func(ctx context.Context)) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f(ctx)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// streamWriter writes the messages of a stream. It can be used from many
+// goroutines.
+type streamWriter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	lastWrite time.Time
+}
+
+// write calls f with the underlying writer and flushes it afterwards. f has to
+// write exactly one message.
+func (s *streamWriter) write(f func(w io.Writer) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeLocked(f)
+}
+
+// writeLocked is like write but has to be called with the lock.
+func (s *streamWriter) writeLocked(f func(w io.Writer) error) error {
+	if err := f(s.w); err != nil {
+		return err
+	}
+
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	s.lastWrite = time.Now()
+	return nil
+}
+
+// startHeartbeat writes a message with f, when nothing was written for the
+// interval.
+//
+// The heartbeat has to be written in the interval. Otherwise, or if the write
+// fails, stop is called. So a dead connection is detected, even if there is no
+// data for the client.
+//
+// The returned function stops the heartbeat and blocks until a running write
+// is done. It has to be called before the connection is closed.
+func (s *streamWriter) startHeartbeat(ctx context.Context, interval time.Duration, f func(w io.Writer) error, stop func()) func() {
+	return runInBackground(ctx, func(ctx context.Context) {
+		s.heartbeat(ctx, interval, f, stop)
+	})
+}
+
+// heartbeat is like startHeartbeat but blocks until the context is done.
+func (s *streamWriter) heartbeat(ctx context.Context, interval time.Duration, f func(w io.Writer) error, stop func()) {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		s.mu.Lock()
+		idle := time.Since(s.lastWrite)
+		s.mu.Unlock()
+
+		if idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+
+		if err := s.writeWithTimeout(f, interval); err != nil {
+			stop()
+			return
+		}
+		timer.Reset(interval)
+	}
+}
+
+// writeWithTimeout is like write but fails, if the message could not be
+// written in the given time.
+//
+// The deadline is set and removed while holding the lock, so it does not apply
+// to other messages.
+//
+// The timeout only works, if the underlying writer is a http.ResponseWriter
+// that supports write deadlines.
+func (s *streamWriter) writeWithTimeout(f func(w io.Writer) error, timeout time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rw, ok := s.w.(http.ResponseWriter)
+	if !ok {
+		return s.writeLocked(f)
+	}
+
+	controller := http.NewResponseController(rw)
+	if err := controller.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		// The writer does not support deadlines.
+		return s.writeLocked(f)
+	}
+	defer controller.SetWriteDeadline(time.Time{})
+
+	return s.writeLocked(f)
+}
+
+// HandleControl registers an internal route to send control messages to all
+// clients.
+//
+// The body is a control message like:
+//
+//	{"type": "reload"}
+//	{"type": "maintenance", "message": "The server is restarted at 18:00"}
+//	{"type": "reconnect", "delay": 30000}
+func HandleControl(mux *http.ServeMux, hub *ControlHub) {
+	mux.HandleFunc(
+		prefixInternal+"/control",
+		func(w http.ResponseWriter, r *http.Request) {
+			var msg ControlMessage
+			if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+				handleErrorInternal(w, invalidRequestError{fmt.Errorf("decoding body: %w", err)})
+				return
+			}
+
+			switch msg.Type {
+			case controlReconnect, controlReload, controlMaintenance:
+			default:
+				handleErrorInternal(w, invalidRequestError{fmt.Errorf("unknown control type %q", msg.Type)})
+				return
+			}
+
+			hub.Broadcast(msg)
+		},
+	)
+}
@@ -0,0 +1,271 @@
+package http_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
+	ahttp "github.com/OpenSlides/openslides-autoupdate-service/internal/http"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"golang.org/x/net/websocket"
+)
+
+func TestControl(t *testing.T) {
+	control := ahttp.NewControlHub()
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), new(onceConnecter), ahttp.AutoupdateOptions{Control: control})
+	ahttp.HandleControl(mux, control)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/system/autoupdate?k=user/1/name&control=1")
+	if err != nil {
+		t.Fatalf("sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	readLine := func() string {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading line: %v", err)
+		}
+		return strings.TrimSpace(line)
+	}
+
+	sendControl := func(body string) int {
+		resp, err := http.Post(srv.URL+"/internal/autoupdate/control", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("sending control message: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := readLine(); got != `{"collection/1/field":"bar"}` {
+		t.Fatalf("first message is %s", got)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		body   string
+		expect string
+	}{
+		{
+			"reload",
+			`{"type":"reload"}`,
+			`{"control":{"type":"reload"}}`,
+		},
+		{
+			"maintenance",
+			`{"type":"maintenance","message":"update at 18:00"}`,
+			`{"control":{"type":"maintenance","message":"update at 18:00"}}`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := sendControl(tt.body); status != 200 {
+				t.Fatalf("control route returned status %d", status)
+			}
+
+			if got := readLine(); got != tt.expect {
+				t.Errorf("got `%s`, expected `%s`", got, tt.expect)
+			}
+		})
+	}
+
+	t.Run("unknown type", func(t *testing.T) {
+		if status := sendControl(`{"type":"foo"}`); status != 400 {
+			t.Errorf("control route returned status %d, expected 400", status)
+		}
+	})
+
+	t.Run("reconnect closes the stream", func(t *testing.T) {
+		sendControl(`{"type":"reconnect"}`)
+
+		if got := readLine(); got != `{"control":{"type":"reconnect"}}` {
+			t.Errorf("got `%s`, expected reconnect message", got)
+		}
+
+		if rest, err := io.ReadAll(reader); err != nil || len(rest) != 0 {
+			t.Errorf("stream was not closed after reconnect: %q, %v", rest, err)
+		}
+	})
+}
+
+func TestControlEventStream(t *testing.T) {
+	control := ahttp.NewControlHub()
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), new(onceConnecter), ahttp.AutoupdateOptions{Control: control})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/system/autoupdate?k=user/1/name&control=1", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("sending request: %v", err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	// Read the first event.
+	for i := 0; i < 3; i++ {
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatalf("reading first event: %v", err)
+		}
+	}
+
+	control.Broadcast(ahttp.ControlMessage{Type: "reload"})
+
+	got, err := io.ReadAll(io.LimitReader(reader, int64(len("event: control\ndata: {\"control\":{\"type\":\"reload\"}}\n\n"))))
+	if err != nil {
+		t.Fatalf("reading control event: %v", err)
+	}
+
+	expect := "event: control\ndata: {\"control\":{\"type\":\"reload\"}}\n\n"
+	if string(got) != expect {
+		t.Errorf("got `%s`, expected `%s`", got, expect)
+	}
+}
+
+func TestControlWebsocket(t *testing.T) {
+	control := ahttp.NewControlHub()
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdateWebsocket(mux, fakeAuth(1), new(onceConnecter), nil, control)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/system/autoupdate/ws", "", srv.URL)
+	if err != nil {
+		t.Fatalf("dial websocket: %v", err)
+	}
+	defer ws.Close()
+
+	// Wait for the first message, so the connection listens to the hub.
+	websocket.Message.Send(ws, `{"type":"subscribe","id":"first","body":[{"ids":[1],"collection":"user","fields":{"name":null}}]}`)
+	var msg string
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		t.Fatalf("receiving message: %v", err)
+	}
+
+	control.Broadcast(ahttp.ControlMessage{Type: "maintenance", Message: "soon"})
+
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		t.Fatalf("receiving control message: %v", err)
+	}
+
+	expect := `{"id":"","control":{"type":"maintenance","message":"soon"}}`
+	if msg != expect {
+		t.Errorf("got `%s`, expected `%s`", msg, expect)
+	}
+}
+
+// gateConnecter is a Connecter where the first message of each connection is
+// returned, when release is closed. Then it blocks until the context is done.
+type gateConnecter struct {
+	release chan struct{}
+}
+
+func (c *gateConnecter) Connect(ctx context.Context, userID int, kb autoupdate.KeysBuilder, options ...autoupdate.ConnectOption) (autoupdate.DataProvider, error) {
+	first := true
+	f := func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		if first {
+			first = false
+			select {
+			case <-c.release:
+				return map[dskey.Key][]byte{myKey1: []byte(`"bar"`)}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true }, nil
+}
+
+func (c *gateConnecter) SingleData(ctx context.Context, userID int, kb autoupdate.KeysBuilder, position int) (map[dskey.Key][]byte, error) {
+	return map[dskey.Key][]byte{myKey1: []byte(`"bar"`)}, nil
+}
+
+func (c *gateConnecter) LastUpdateID() datastore.UpdateID {
+	return datastore.UpdateID{}
+}
+
+func TestHeartbeat(t *testing.T) {
+	const heartbeat = `{"control":{"type":"heartbeat"}}`
+	const data = `{"collection/1/field":"bar"}`
+
+	connecter := &gateConnecter{release: make(chan struct{})}
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{Heartbeat: 10 * time.Millisecond})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	t.Run("with control", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/system/autoupdate?k=user/1/name&control=1")
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		defer resp.Body.Close()
+		reader := bufio.NewReader(resp.Body)
+
+		readLine := func() string {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading line: %v", err)
+			}
+			return strings.TrimSpace(line)
+		}
+
+		// There is no data until the connecter is released.
+		if got := readLine(); got != heartbeat {
+			t.Fatalf("got `%s`, expected `%s`", got, heartbeat)
+		}
+
+		close(connecter.release)
+		for {
+			got := readLine()
+			if got == data {
+				break
+			}
+
+			if got != heartbeat {
+				t.Fatalf("got `%s`, expected data or heartbeat", got)
+			}
+		}
+
+		if got := readLine(); got != heartbeat {
+			t.Errorf("got `%s` after the data, expected `%s`", got, heartbeat)
+		}
+	})
+
+	t.Run("without control", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/system/autoupdate?k=user/1/name", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		// The body is read until the request times out.
+		got, _ := io.ReadAll(resp.Body)
+		if string(got) != data+"\n" {
+			t.Errorf("got `%s`, expected only the data", got)
+		}
+	})
+}
@@ -0,0 +1,392 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+)
+
+const (
+	// deltaMerge sends each changed value as RFC 7386 merge patch against the
+	// value the client already has. A merge patch can not set an object member
+	// to null, since null removes the member.
+	deltaMerge = "merge"
+
+	// deltaJSONPatch sends each message after the first as RFC 6902 json patch
+	// against the data the client already has.
+	deltaJSONPatch = "json-patch"
+
+	// deltaListDiff sends the changes of relation-list fields as added and
+	// removed ids. All other values are sent complete.
+	deltaListDiff = "list-diff"
+)
+
+// relationLister tells, which keys are relation lists.
+type relationLister interface {
+	IsRelationList(key dskey.Key) bool
+}
+
+// deltaEncoder converts the messages of a connection to patches against the
+// data, that was sent to the client before.
+type deltaEncoder struct {
+	mode     string
+	lists    relationLister
+	previous map[dskey.Key][]byte
+	started  bool
+}
+
+// newDeltaEncoder returns a deltaEncoder for the value of the query parameter
+// `delta`. Returns nil, if mode is empty.
+//
+// lists is only used for the mode list-diff.
+func newDeltaEncoder(mode string, lists relationLister) (*deltaEncoder, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case deltaMerge, deltaJSONPatch, deltaListDiff:
+		return &deltaEncoder{mode: mode, lists: lists}, nil
+	default:
+		return nil, invalidRequestError{fmt.Errorf("delta has to be %s, %s or %s, not %s", deltaMerge, deltaJSONPatch, deltaListDiff, mode)}
+	}
+}
+
+// connectOptions returns the options for the autoupdate connection, so the
+// encoder gets the old values.
+//
+// With the mode list-diff, the encoder reads the state of the keysbuilder, so
+// the connection has to update it itself.
+func (d *deltaEncoder) connectOptions() []autoupdate.ConnectOption {
+	options := []autoupdate.ConnectOption{
+		autoupdate.WithPreviousValues(func(previous map[dskey.Key][]byte) {
+			d.previous = previous
+		}),
+	}
+
+	if d.mode == deltaListDiff {
+		options = append(options, autoupdate.WithOwnComputation())
+	}
+	return options
+}
+
+// encode returns the message for data, that can be encoded to json.
+//
+// With the mode merge, the message is a json object. Each value is a merge
+// patch against the old value. So the message itself is a merge patch against
+// all data of the client.
+//
+// With the mode json-patch, the first message is a json object with the full
+// values. All other messages are a json patch document (a list of operations)
+// that applies to all data of the client.
+//
+// With the mode list-diff, the message is a json object. The values of
+// relation lists are objects with the added and removed ids.
+func (d *deltaEncoder) encode(data map[dskey.Key][]byte) (any, error) {
+	switch d.mode {
+	case deltaListDiff:
+		converted := make(map[string]json.RawMessage, len(data))
+		for key, value := range data {
+			old, ok := d.previous[key]
+			if !ok || value == nil || !d.lists.IsRelationList(key) {
+				converted[key.String()] = value
+				continue
+			}
+
+			diff, err := listDiff(old, value)
+			if err != nil {
+				return nil, fmt.Errorf("creating list diff for %s: %w", key, err)
+			}
+			converted[key.String()] = diff
+		}
+		return converted, nil
+
+	case deltaMerge:
+		converted := make(map[string]json.RawMessage, len(data))
+		for key, value := range data {
+			old, ok := d.previous[key]
+			if !ok || value == nil {
+				converted[key.String()] = value
+				continue
+			}
+
+			patch, err := mergePatch(old, value)
+			if err != nil {
+				return nil, fmt.Errorf("creating merge patch for %s: %w", key, err)
+			}
+			converted[key.String()] = patch
+		}
+		return converted, nil
+	}
+
+	if !d.started {
+		d.started = true
+		return convertData(data), nil
+	}
+
+	keys := make([]dskey.Key, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	operations := []patchOperation{}
+	for _, key := range keys {
+		operations = append(operations, jsonPatch("/"+escapePointer(key.String()), d.previous[key], data[key])...)
+	}
+	return operations, nil
+}
+
+// mergePatch returns a RFC 7386 merge patch that changes old to new.
+//
+// If one of the values is not a json object, the patch is the new value. A
+// member with the new value null is removed by the patch.
+func mergePatch(old, new json.RawMessage) (json.RawMessage, error) {
+	oldObject, ok := decodeObject(old)
+	if !ok {
+		return new, nil
+	}
+
+	newObject, ok := decodeObject(new)
+	if !ok {
+		return new, nil
+	}
+
+	patch := make(map[string]json.RawMessage)
+	for member := range oldObject {
+		if _, ok := newObject[member]; !ok {
+			patch[member] = json.RawMessage("null")
+		}
+	}
+
+	for member, value := range newObject {
+		oldValue, ok := oldObject[member]
+		if !ok {
+			patch[member] = value
+			continue
+		}
+
+		if bytes.Equal(oldValue, value) {
+			continue
+		}
+
+		memberPatch, err := mergePatch(oldValue, value)
+		if err != nil {
+			return nil, fmt.Errorf("member %s: %w", member, err)
+		}
+		patch[member] = memberPatch
+	}
+
+	encoded, err := json.Marshal(patch)
+	if err != nil {
+		return nil, fmt.Errorf("encoding patch: %w", err)
+	}
+	return encoded, nil
+}
+
+// listDiff returns a json object with the ids that where added and removed
+// from the relation list old.
+//
+// If the diff is not smaller then the new list or one of the values is not a
+// list, new is returned.
+func listDiff(old, new json.RawMessage) (json.RawMessage, error) {
+	oldList, ok := decodeList(old)
+	if !ok {
+		return new, nil
+	}
+
+	newList, ok := decodeList(new)
+	if !ok {
+		return new, nil
+	}
+
+	oldIDs := make(map[string]bool, len(oldList))
+	for _, id := range oldList {
+		oldIDs[string(id)] = true
+	}
+
+	newIDs := make(map[string]bool, len(newList))
+	for _, id := range newList {
+		newIDs[string(id)] = true
+	}
+
+	diff := struct {
+		Added   []json.RawMessage `json:"added"`
+		Removed []json.RawMessage `json:"removed"`
+	}{
+		Added:   []json.RawMessage{},
+		Removed: []json.RawMessage{},
+	}
+
+	for _, id := range newList {
+		if !oldIDs[string(id)] {
+			diff.Added = append(diff.Added, id)
+		}
+	}
+
+	for _, id := range oldList {
+		if !newIDs[string(id)] {
+			diff.Removed = append(diff.Removed, id)
+		}
+	}
+
+	encoded, err := json.Marshal(diff)
+	if err != nil {
+		return nil, fmt.Errorf("encoding diff: %w", err)
+	}
+
+	if len(encoded) >= len(new) {
+		return new, nil
+	}
+	return encoded, nil
+}
+
+// patchOperation is one operation of a RFC 6902 json patch.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// jsonPatch returns the json patch operations to change old to new at path.
+//
+// A nil value means, that the value does not exist.
+func jsonPatch(path string, old, new json.RawMessage) []patchOperation {
+	switch {
+	case old == nil && new == nil:
+		return nil
+	case old == nil:
+		return []patchOperation{{Op: "add", Path: path, Value: new}}
+	case new == nil:
+		return []patchOperation{{Op: "remove", Path: path}}
+	case bytes.Equal(old, new):
+		return nil
+	}
+
+	replace := []patchOperation{{Op: "replace", Path: path, Value: new}}
+
+	var operations []patchOperation
+	var ok bool
+	if oldObject, isObject := decodeObject(old); isObject {
+		if newObject, isObject := decodeObject(new); isObject {
+			operations, ok = objectPatch(path, oldObject, newObject), true
+		}
+	}
+
+	if oldList, isList := decodeList(old); isList {
+		if newList, isList := decodeList(new); isList {
+			operations, ok = listPatch(path, oldList, newList), true
+		}
+	}
+
+	if !ok || patchSize(operations) >= patchSize(replace) {
+		return replace
+	}
+	return operations
+}
+
+// objectPatch returns the json patch operations to change one json object to
+// another.
+func objectPatch(path string, old, new map[string]json.RawMessage) []patchOperation {
+	var operations []patchOperation
+	for _, member := range sortedMembers(old) {
+		if _, ok := new[member]; !ok {
+			operations = append(operations, patchOperation{Op: "remove", Path: path + "/" + escapePointer(member)})
+		}
+	}
+
+	for _, member := range sortedMembers(new) {
+		operations = append(operations, jsonPatch(path+"/"+escapePointer(member), old[member], new[member])...)
+	}
+	return operations
+}
+
+// listPatch returns the json patch operations to change one json list to
+// another.
+//
+// Only the part between the common prefix and the common suffix of the lists
+// is changed.
+func listPatch(path string, old, new []json.RawMessage) []patchOperation {
+	prefix := 0
+	for prefix < len(old) && prefix < len(new) && bytes.Equal(old[prefix], new[prefix]) {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(old)-prefix && suffix < len(new)-prefix && bytes.Equal(old[len(old)-1-suffix], new[len(new)-1-suffix]) {
+		suffix++
+	}
+
+	removed := old[prefix : len(old)-suffix]
+	added := new[prefix : len(new)-suffix]
+
+	common := len(removed)
+	if len(added) < common {
+		common = len(added)
+	}
+
+	var operations []patchOperation
+	for i := 0; i < common; i++ {
+		operations = append(operations, jsonPatch(path+"/"+strconv.Itoa(prefix+i), removed[i], added[i])...)
+	}
+
+	// Removing an element moves the following elements, so the same index
+	// is removed many times.
+	for i := common; i < len(removed); i++ {
+		operations = append(operations, patchOperation{Op: "remove", Path: path + "/" + strconv.Itoa(prefix+common)})
+	}
+
+	for i := common; i < len(added); i++ {
+		operations = append(operations, patchOperation{Op: "add", Path: path + "/" + strconv.Itoa(prefix+i), Value: added[i]})
+	}
+	return operations
+}
+
+// patchSize returns the approximated size of the encoded operations.
+func patchSize(operations []patchOperation) int {
+	const overhead = len(`{"op":"","path":"","value":},`)
+
+	var size int
+	for _, op := range operations {
+		size += overhead + len(op.Op) + len(op.Path) + len(op.Value)
+	}
+	return size
+}
+
+// decodeObject decodes a json object. Returns false, if the value is not a
+// json object.
+func decodeObject(value json.RawMessage) (map[string]json.RawMessage, bool) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(value, &object); err != nil || object == nil {
+		return nil, false
+	}
+	return object, true
+}
+
+// decodeList decodes a json list. Returns false, if the value is not a json
+// list.
+func decodeList(value json.RawMessage) ([]json.RawMessage, bool) {
+	var list []json.RawMessage
+	if err := json.Unmarshal(value, &list); err != nil || list == nil {
+		return nil, false
+	}
+	return list, true
+}
+
+func sortedMembers(object map[string]json.RawMessage) []string {
+	members := make([]string, 0, len(object))
+	for member := range object {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// escapePointer escapes a reference token of a RFC 6901 json pointer.
+func escapePointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
@@ -0,0 +1,167 @@
+package http
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+)
+
+func TestMergePatch(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		old    string
+		new    string
+		expect string
+	}{
+		{"string", `"old"`, `"new"`, `"new"`},
+		{"list", `[1,2]`, `[1,2,3]`, `[1,2,3]`},
+		{"object to string", `{"a":1}`, `"new"`, `"new"`},
+		{"changed member", `{"a":1,"b":2}`, `{"a":1,"b":3}`, `{"b":3}`},
+		{"removed member", `{"a":1,"b":2}`, `{"a":1}`, `{"b":null}`},
+		{"added member", `{"a":1}`, `{"a":1,"b":2}`, `{"b":2}`},
+		{"nested object", `{"a":{"b":1,"c":2}}`, `{"a":{"b":1,"c":3}}`, `{"a":{"c":3}}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergePatch([]byte(tt.old), []byte(tt.new))
+			if err != nil {
+				t.Fatalf("mergePatch: %v", err)
+			}
+
+			if string(got) != tt.expect {
+				t.Errorf("Got `%s`, expected `%s`", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		old    string
+		new    string
+		expect string
+	}{
+		{"new value", ``, `"new"`, `[{"op":"add","path":"/k","value":"new"}]`},
+		{"removed value", `"old"`, ``, `[{"op":"remove","path":"/k"}]`},
+		{"same value", `"old"`, `"old"`, `null`},
+		{"string", `"old"`, `"new"`, `[{"op":"replace","path":"/k","value":"new"}]`},
+		{"list append", `[1,2,3,4,5,6,7,8,9,10]`, `[1,2,3,4,5,6,7,8,9,10,11]`, `[{"op":"add","path":"/k/10","value":11}]`},
+		{"list remove", `[1,2,3,4,5,6,7,8,9,10]`, `[1,2,3,4,6,7,8,9,10]`, `[{"op":"remove","path":"/k/4"}]`},
+		{"list replace", `[1,2]`, `[3]`, `[{"op":"replace","path":"/k","value":[3]}]`},
+		{"object", `{"text":"a long text that does not change","number":1}`, `{"text":"a long text that does not change","number":2,"x~/":1}`, `[{"op":"replace","path":"/k/number","value":2},{"op":"add","path":"/k/x~0~1","value":1}]`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var old, new json.RawMessage
+			if tt.old != "" {
+				old = json.RawMessage(tt.old)
+			}
+			if tt.new != "" {
+				new = json.RawMessage(tt.new)
+			}
+
+			got, err := json.Marshal(jsonPatch("/k", old, new))
+			if err != nil {
+				t.Fatalf("encoding patch: %v", err)
+			}
+
+			if string(got) != tt.expect {
+				t.Errorf("Got `%s`, expected `%s`", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestDeltaEncoderJSONPatch(t *testing.T) {
+	delta, err := newDeltaEncoder(deltaJSONPatch, nil)
+	if err != nil {
+		t.Fatalf("newDeltaEncoder: %v", err)
+	}
+
+	key := dskey.MustKey("user/1/name")
+
+	first, err := delta.encode(map[dskey.Key][]byte{key: []byte(`"old"`)})
+	if err != nil {
+		t.Fatalf("encode first message: %v", err)
+	}
+
+	if got, _ := json.Marshal(first); string(got) != `{"user/1/name":"old"}` {
+		t.Errorf("Got first message `%s`, expected `%s`", got, `{"user/1/name":"old"}`)
+	}
+
+	delta.previous = map[dskey.Key][]byte{key: []byte(`"old"`)}
+	second, err := delta.encode(map[dskey.Key][]byte{key: []byte(`"new"`)})
+	if err != nil {
+		t.Fatalf("encode second message: %v", err)
+	}
+
+	expect := `[{"op":"replace","path":"/user~11~1name","value":"new"}]`
+	if got, _ := json.Marshal(second); string(got) != expect {
+		t.Errorf("Got second message `%s`, expected `%s`", got, expect)
+	}
+}
+
+func TestNewDeltaEncoderInvalid(t *testing.T) {
+	if _, err := newDeltaEncoder("unknown", nil); err == nil {
+		t.Errorf("newDeltaEncoder returned no error for an invalid mode")
+	}
+}
+
+func TestListDiff(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		old    string
+		new    string
+		expect string
+	}{
+		{"added", `[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20]`, `[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21]`, `{"added":[21],"removed":[]}`},
+		{"removed", `[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20]`, `[1,2,3,4,5,7,8,9,10,11,12,13,14,15,16,17,18,19,20]`, `{"added":[],"removed":[6]}`},
+		{"generic", `["motion/1","motion/2","motion/3","motion/5","motion/6"]`, `["motion/1","motion/3","motion/4","motion/5","motion/6"]`, `{"added":["motion/4"],"removed":["motion/2"]}`},
+		{"short list", `[1]`, `[2]`, `[2]`},
+		{"no list", `"foo"`, `[1]`, `[1]`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := listDiff([]byte(tt.old), []byte(tt.new))
+			if err != nil {
+				t.Fatalf("listDiff: %v", err)
+			}
+
+			if string(got) != tt.expect {
+				t.Errorf("Got `%s`, expected `%s`", got, tt.expect)
+			}
+		})
+	}
+}
+
+type listMock map[dskey.Key]bool
+
+func (l listMock) IsRelationList(key dskey.Key) bool {
+	return l[key]
+}
+
+func TestDeltaEncoderListDiff(t *testing.T) {
+	listKey := dskey.MustKey("meeting/1/motion_ids")
+	otherKey := dskey.MustKey("meeting/1/user_ids")
+
+	delta, err := newDeltaEncoder(deltaListDiff, listMock{listKey: true})
+	if err != nil {
+		t.Fatalf("newDeltaEncoder: %v", err)
+	}
+
+	delta.previous = map[dskey.Key][]byte{
+		listKey:  []byte(`[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20]`),
+		otherKey: []byte(`[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20]`),
+	}
+	message, err := delta.encode(map[dskey.Key][]byte{
+		listKey:  []byte(`[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21]`),
+		otherKey: []byte(`[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21]`),
+	})
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	expect := `{"meeting/1/motion_ids":{"added":[21],"removed":[]},"meeting/1/user_ids":[1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21]}`
+	if got, _ := json.Marshal(message); string(got) != expect {
+		t.Errorf("Got `%s`, expected `%s`", got, expect)
+	}
+}
@@ -0,0 +1,105 @@
+package http_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ahttp "github.com/OpenSlides/openslides-autoupdate-service/internal/http"
+)
+
+func TestDrain(t *testing.T) {
+	control := ahttp.NewControlHub()
+
+	connecter := &gateConnecter{release: make(chan struct{})}
+	close(connecter.release)
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{Control: control})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	connect := func(query string) *bufio.Reader {
+		resp, err := http.Get(srv.URL + "/system/autoupdate?k=user/1/name" + query)
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return bufio.NewReader(resp.Body)
+	}
+
+	// readReconnect skips the data messages and checks, that the next
+	// control message is a reconnect message.
+	readReconnect := func(name string, reader *bufio.Reader) {
+		var msg struct {
+			Control *ahttp.ControlMessage `json:"control"`
+		}
+		var line string
+		for msg.Control == nil {
+			var err error
+			line, err = reader.ReadString('\n')
+			if err != nil {
+				t.Errorf("%s: reading message: %v", name, err)
+				return
+			}
+
+			if err := json.Unmarshal([]byte(line), &msg); err != nil {
+				t.Errorf("%s: decoding message `%s`: %v", name, line, err)
+				return
+			}
+		}
+
+		if msg.Control.Type != "reconnect" {
+			t.Errorf("%s: got message `%s`, expected reconnect", name, line)
+		}
+
+		if msg.Control.Delay < 0 || msg.Control.Delay > 1000 {
+			t.Errorf("%s: got delay %d", name, msg.Control.Delay)
+		}
+	}
+
+	// The first message of a connection is sent after it listens for control
+	// messages.
+	conn1 := connect("&control=1")
+	conn2 := connect("&control=1")
+	plain := connect("")
+	for _, conn := range []*bufio.Reader{conn1, conn2, plain} {
+		if _, err := conn.ReadString('\n'); err != nil {
+			t.Fatalf("reading first message: %v", err)
+		}
+	}
+
+	start := time.Now()
+	control.Drain(context.Background(), 50*time.Millisecond)
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("drain returned after %s, expected to wait for the window", elapsed)
+	}
+
+	readReconnect("connection 1", conn1)
+	readReconnect("connection 2", conn2)
+
+	t.Run("plain stream", func(t *testing.T) {
+		if line, err := plain.ReadString('\n'); err != io.EOF {
+			t.Errorf("got message `%s` and error %v, expected the stream to be closed", line, err)
+		}
+	})
+
+	t.Run("new connection while draining", func(t *testing.T) {
+		readReconnect("new connection", connect("&control=1"))
+	})
+}
+
+func TestDrainWithoutConnections(t *testing.T) {
+	start := time.Now()
+	ahttp.NewControlHub().Drain(context.Background(), time.Hour)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("drain without connections took %s", elapsed)
+	}
+}
@@ -0,0 +1,60 @@
+package http
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/cespare/xxhash/v2"
+)
+
+// newETag returns a strong entity tag for the data of a response.
+//
+// The tag is calculated from the data and not from the encoded body, so it does
+// not depend on the compression. The representation are the parts of the
+// request, that change the body, for example the format or the content
+// encoding. Each of them is added to the tag.
+func newETag(data map[dskey.Key][]byte, representation ...string) string {
+	values := make(map[string][]byte, len(data))
+	keys := make([]string, 0, len(data))
+	for key, value := range data {
+		values[key.String()] = value
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+
+	hash := xxhash.New()
+	for _, key := range keys {
+		value := values[key]
+		hash.WriteString(key + " " + strconv.Itoa(len(value)) + " ")
+		hash.Write(value)
+	}
+
+	tag := strconv.FormatUint(hash.Sum64(), 16)
+	for _, part := range representation {
+		if part != "" {
+			tag += "-" + part
+		}
+	}
+	return `"` + tag + `"`
+}
+
+// etagMatches returns true, if the value of an If-None-Match header matches
+// the entity tag.
+//
+// As defined in RFC 9110, the comparison is weak, so a tag with the prefix W/
+// also matches.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package http_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ahttp "github.com/OpenSlides/openslides-autoupdate-service/internal/http"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+)
+
+func TestETag(t *testing.T) {
+	value := `"bar"`
+	f := func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		return map[dskey.Key][]byte{myKey1: []byte(value)}, nil
+	}
+	connecter := &connecterMock{
+		f: func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true },
+	}
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{})
+
+	request := func(url string, etag string, header ...string) *http.Response {
+		req := httptest.NewRequest("GET", url, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	first := request("/system/autoupdate?k=user/1/name&single=1", "")
+	etag := first.Header.Get("ETag")
+	if etag == "" {
+		t.Fatalf("response has no etag")
+	}
+
+	if got := first.Header.Get("Cache-Control"); got != "private, no-cache" {
+		t.Errorf("got Cache-Control %s, expected private, no-cache", got)
+	}
+
+	t.Run("same data", func(t *testing.T) {
+		res := request("/system/autoupdate?k=user/1/name&single=1", etag)
+
+		if res.StatusCode != http.StatusNotModified {
+			t.Errorf("got status %s, expected 304", res.Status)
+		}
+
+		if body, _ := io.ReadAll(res.Body); len(body) != 0 {
+			t.Errorf("got body `%s`, expected no body", body)
+		}
+	})
+
+	t.Run("weak and list", func(t *testing.T) {
+		res := request("/system/autoupdate?k=user/1/name&single=1", `"other", W/`+etag)
+
+		if res.StatusCode != http.StatusNotModified {
+			t.Errorf("got status %s, expected 304", res.Status)
+		}
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		compressed := request("/system/autoupdate?k=user/1/name&single=1", "", "Accept-Encoding", "gzip")
+		gzipETag := compressed.Header.Get("ETag")
+		if gzipETag == etag {
+			t.Errorf("compressed response has the same etag as the uncompressed response")
+		}
+
+		res := request("/system/autoupdate?k=user/1/name&single=1", gzipETag, "Accept-Encoding", "gzip")
+
+		if res.StatusCode != http.StatusNotModified {
+			t.Errorf("got status %s, expected 304", res.Status)
+		}
+
+		if got := res.Header.Get("Content-Encoding"); got != "" {
+			t.Errorf("got Content-Encoding %s, expected none", got)
+		}
+
+		if body, _ := io.ReadAll(res.Body); len(body) != 0 {
+			t.Errorf("got body `%s`, expected no body", body)
+		}
+	})
+
+	t.Run("changed data", func(t *testing.T) {
+		value = `"new"`
+		defer func() { value = `"bar"` }()
+
+		res := request("/system/autoupdate?k=user/1/name&single=1", etag)
+
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("got status %s, expected 200", res.Status)
+		}
+
+		if res.Header.Get("ETag") == etag {
+			t.Errorf("etag did not change")
+		}
+	})
+
+	t.Run("position", func(t *testing.T) {
+		res := request("/system/autoupdate?k=user/1/name&position=42", "")
+
+		if got := res.Header.Get("Cache-Control"); got != "private, max-age=31536000, immutable" {
+			t.Errorf("got Cache-Control %s, expected immutable", got)
+		}
+	})
+}
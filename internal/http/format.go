@@ -0,0 +1,198 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/oserror"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// format is an encoding for the response body.
+//
+// The data of the service are json values. For the binary formats, they are
+// decoded and encoded again.
+type format struct {
+	// contentType is the value for the Content-Type header. It is empty for
+	// json, so the handler can decide the header.
+	contentType string
+
+	// marshal encodes go values. It is nil for json.
+	marshal func(v any) ([]byte, error)
+}
+
+var (
+	formatJSON    = format{}
+	formatMsgpack = format{contentType: "application/msgpack", marshal: msgpack.Marshal}
+	formatCBOR    = format{contentType: "application/cbor", marshal: cbor.Marshal}
+)
+
+// negotiateFormat returns the format from the Accept header of the request.
+// The first supported binary format is used. Defaults to json.
+//
+// The response depends on the Accept header, so it is added to the Vary header
+// of the response.
+func negotiateFormat(w http.ResponseWriter, r *http.Request) format {
+	w.Header().Add("Vary", "Accept")
+	return formatFromAccept(r)
+}
+
+// formatFromAccept is like negotiateFormat but does not change the response.
+func formatFromAccept(r *http.Request) format {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			switch strings.ToLower(strings.TrimSpace(mediaType)) {
+			case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+				return formatMsgpack
+			case "application/cbor":
+				return formatCBOR
+			}
+		}
+	}
+	return formatJSON
+}
+
+// binary returns true, if the format is not json.
+func (f format) binary() bool {
+	return f.marshal != nil
+}
+
+// name returns a short name of the format.
+func (f format) name() string {
+	if f.contentType == "" {
+		return "json"
+	}
+	_, name, _ := strings.Cut(f.contentType, "/")
+	return name
+}
+
+// setContentType sets the Content-Type header for binary formats.
+func (f format) setContentType(w http.ResponseWriter) {
+	if f.contentType != "" {
+		w.Header().Set("Content-Type", f.contentType)
+	}
+}
+
+// encode writes v to w.
+//
+// Json values are terminated by a newline. The binary formats are self
+// delimiting, so many values can be written after each other.
+func (f format) encode(w io.Writer, v any) error {
+	if !f.binary() {
+		return json.NewEncoder(w).Encode(v)
+	}
+
+	native, err := toNative(v)
+	if err != nil {
+		return fmt.Errorf("converting value: %w", err)
+	}
+
+	encoded, err := f.marshal(native)
+	if err != nil {
+		return fmt.Errorf("marshal value: %w", err)
+	}
+
+	if _, err := w.Write(encoded); err != nil {
+		return fmt.Errorf("writing value: %w", err)
+	}
+	return nil
+}
+
+// handleErrorWithStatus is like the function handleErrorWithStatus, but writes
+// the error in the format.
+func (f format) handleErrorWithStatus(w http.ResponseWriter, err error) {
+	f.handleError(w, err, true)
+}
+
+// handleErrorWithoutStatus is like the function handleErrorWithoutStatus, but
+// writes the error in the format.
+func (f format) handleErrorWithoutStatus(w http.ResponseWriter, err error) {
+	f.handleError(w, err, false)
+}
+
+func (f format) handleError(w http.ResponseWriter, err error, writeStatusCode bool) {
+	if !f.binary() {
+		handleError(w, err, writeStatusCode, false)
+		return
+	}
+
+	errType, msg, ok := clientError(err)
+	if !ok {
+		return
+	}
+
+	if writeStatusCode {
+		f.setContentType(w)
+		w.WriteHeader(errorStatusCode(err))
+	}
+
+	message := map[string]errorMessage{"error": {Type: errType, Msg: msg}}
+	if err := f.encode(w, message); err != nil {
+		oserror.Handle(fmt.Errorf("encoding error: %w", err))
+	}
+}
+
+// errorMessage is the error, that is send to the client.
+type errorMessage struct {
+	Type string `json:"type"`
+	Msg  string `json:"msg"`
+}
+
+// toNative converts a value, that can be encoded to json, to go values, that
+// only contain maps, lists, strings, numbers, booleans and nil.
+//
+// The value is encoded with encoding/json, so the binary formats use the same
+// names and values as json. Numbers without a fraction are converted to int64,
+// so the binary formats encode them as integers.
+func toNative(v any) (any, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encoding json: %w", err)
+	}
+	return decodeJSON(encoded)
+}
+
+// decodeJSON decodes one json value. An empty value is decoded as nil.
+func decodeJSON(value []byte) (any, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+
+	var decoded any
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("decoding json: %w", err)
+	}
+
+	return convertNumbers(decoded), nil
+}
+
+func convertNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+
+	case map[string]any:
+		for key, value := range v {
+			v[key] = convertNumbers(value)
+		}
+
+	case []any:
+		for i, value := range v {
+			v[i] = convertNumbers(value)
+		}
+	}
+	return v
+}
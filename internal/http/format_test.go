@@ -0,0 +1,231 @@
+package http_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	ahttp "github.com/OpenSlides/openslides-autoupdate-service/internal/http"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/net/websocket"
+)
+
+func TestBinaryFormat(t *testing.T) {
+	f := func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		return map[dskey.Key][]byte{
+			myKey1: []byte(`"bar"`),
+			myKey2: []byte(`[1,2.5,{"x":true}]`),
+		}, nil
+	}
+	connecter := &connecterMock{
+		f: func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true },
+	}
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{})
+
+	for _, tt := range []struct {
+		name        string
+		accept      string
+		contentType string
+		unmarshal   func([]byte, any) error
+	}{
+		{"msgpack", "application/msgpack", "application/msgpack", msgpack.Unmarshal},
+		{"x-msgpack", "application/x-msgpack", "application/msgpack", msgpack.Unmarshal},
+		{"cbor", "application/cbor", "application/cbor", cbor.Unmarshal},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/system/autoupdate?k=user/1/name&single=1", nil)
+			req.Header.Set("Accept", tt.accept)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if got := rec.Result().Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Got Content-Type `%s`, expected `%s`", got, tt.contentType)
+			}
+
+			var got struct {
+				Value1 string `msgpack:"collection/1/field" cbor:"collection/1/field"`
+				Value2 []any  `msgpack:"collection/2/field" cbor:"collection/2/field"`
+			}
+			if err := tt.unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("decoding body: %v", err)
+			}
+
+			if got.Value1 != "bar" {
+				t.Errorf("Got value `%s`, expected `bar`", got.Value1)
+			}
+
+			if len(got.Value2) != 3 {
+				t.Fatalf("Got %v, expected 3 values", got.Value2)
+			}
+
+			if reflect.ValueOf(got.Value2[0]).Kind() == reflect.Float64 {
+				t.Errorf("Got the integer as %T, expected an integer type", got.Value2[0])
+			}
+
+			if got.Value2[1] != 2.5 {
+				t.Errorf("Got %v, expected 2.5", got.Value2[1])
+			}
+		})
+	}
+}
+
+func TestBinaryFormatEventStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f := func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		cancel()
+		return map[dskey.Key][]byte{myKey1: []byte(`"bar"`)}, nil
+	}
+	connecter := &connecterMock{
+		f: func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true },
+	}
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{})
+
+	req := httptest.NewRequest("GET", "/system/autoupdate?k=user/1/name", nil).WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream, application/msgpack")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if got := rec.Result().Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Got Content-Type `%s`, expected `text/event-stream`", got)
+	}
+
+	_, data, _ := strings.Cut(rec.Body.String(), "\n")
+	if expect := "data: {\"collection/1/field\":\"bar\"}\n\n"; data != expect {
+		t.Errorf("Got content `%s`, expected `%s`", data, expect)
+	}
+}
+
+type restrictFQIDsStub map[string]map[string][]byte
+
+func (r restrictFQIDsStub) RestrictFQIDs(ctx context.Context, uid int, fqids []string) (map[string]map[string][]byte, error) {
+	return r, nil
+}
+
+func TestBinaryFormatRestrictFQIDs(t *testing.T) {
+	mux := http.NewServeMux()
+	ahttp.HandleRestrictFQIDs(mux, restrictFQIDsStub{"user/1": {"name": []byte(`"hugo"`)}})
+
+	req := httptest.NewRequest("POST", "/internal/autoupdate/restrict_fqids", strings.NewReader(`{"user_id":1,"fqids":["user/1"]}`))
+	req.Header.Set("Accept", "application/msgpack")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	var got map[string]map[string]string
+	if err := msgpack.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+
+	expect := map[string]map[string]string{"user/1": {"name": "hugo"}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Got %v, expected %v", got, expect)
+	}
+}
+
+func TestBinaryFormatHistoryInformation(t *testing.T) {
+	mux := http.NewServeMux()
+	hi := &HistoryInformationStub{}
+	ahttp.HandleHistoryInformation(mux, fakeAuth(1), hi)
+
+	req := httptest.NewRequest("GET", "/system/autoupdate/history_information?fqid=motion/42&details=1", nil)
+	req.Header.Set("Accept", "application/cbor")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if got := rec.Result().Header.Get("Content-Type"); got != "application/cbor" {
+		t.Errorf("Got Content-Type `%s`, expected `application/cbor`", got)
+	}
+
+	var got []struct {
+		Position int `cbor:"position"`
+		UserID   int `cbor:"user_id"`
+	}
+	if err := cbor.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+
+	expect := []struct {
+		Position int `cbor:"position"`
+		UserID   int `cbor:"user_id"`
+	}{{Position: 42, UserID: 5}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("Got %v, expected %v", got, expect)
+	}
+}
+
+func TestBinaryFormatError(t *testing.T) {
+	mux := http.NewServeMux()
+	ahttp.HandleHistoryInformation(mux, fakeAuth(1), &HistoryInformationStub{})
+
+	req := httptest.NewRequest("GET", "/system/autoupdate/history_information", nil)
+	req.Header.Set("Accept", "application/msgpack")
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	res := rec.Result()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Got status %s, expected 400", res.Status)
+	}
+
+	if got := res.Header.Get("Content-Type"); got != "application/msgpack" {
+		t.Errorf("Got Content-Type `%s`, expected `application/msgpack`", got)
+	}
+
+	if got := res.Header.Get("Vary"); got != "Accept" {
+		t.Errorf("Got Vary `%s`, expected `Accept`", got)
+	}
+
+	var got map[string]map[string]string
+	if err := msgpack.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+
+	if got["error"]["type"] != "invalid_request" {
+		t.Errorf("Got %v, expected an invalid_request error", got)
+	}
+}
+
+func TestBinaryFormatWebsocket(t *testing.T) {
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdateWebsocket(mux, fakeAuth(1), new(onceConnecter), nil, nil)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/system/autoupdate/ws", "msgpack", srv.URL)
+	if err != nil {
+		t.Fatalf("dial websocket: %v", err)
+	}
+	defer ws.Close()
+
+	websocket.Message.Send(ws, `{"type":"subscribe","id":"first","body":[{"ids":[1],"collection":"user","fields":{"name":null}}]}`)
+
+	var msg []byte
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		t.Fatalf("receiving message: %v", err)
+	}
+
+	var got struct {
+		ID   string            `msgpack:"id"`
+		Data map[string]string `msgpack:"data"`
+	}
+	if err := msgpack.Unmarshal(msg, &got); err != nil {
+		t.Fatalf("decoding message: %v", err)
+	}
+
+	if got.ID != "first" || got.Data["collection/1/field"] != "bar" {
+		t.Errorf("Got %v, expected the data of the subscription first", got)
+	}
+}
@@ -0,0 +1,42 @@
+package http_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ahttp "github.com/OpenSlides/openslides-autoupdate-service/internal/http"
+)
+
+// failingWriter is a ResponseWriter where each write fails like on a broken
+// connection.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("connection is broken")
+}
+
+func TestHeartbeatStopsOnWriteError(t *testing.T) {
+	// The connecter never returns data, so the heartbeat is the only write.
+	connecter := &gateConnecter{release: make(chan struct{})}
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{Heartbeat: time.Millisecond})
+
+	req := httptest.NewRequest("GET", "/system/autoupdate?k=user/1/name&control=1", nil)
+
+	done := make(chan struct{})
+	go func() {
+		mux.ServeHTTP(failingWriter{httptest.NewRecorder()}, req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("heartbeat did not stop the connection after a write error")
+	}
+}
@@ -14,11 +14,13 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/keysbuilder"
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/metric"
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/oserror"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
 	"github.com/klauspost/compress/zstd"
 )
@@ -29,26 +31,57 @@ const (
 )
 
 // Run starts the http server.
-func Run(ctx context.Context, addr string, auth Authenticater, autoupdate *autoupdate.Autoupdate) error {
+//
+// When the context is done, the open connections get a reconnect message or
+// are closed, if they do not get control messages. This is spread over the
+// drainWindow. Afterwards the server is stopped.
+//
+// Streams without messages get a heartbeat message after the time heartbeat.
+// Each user can have maxPollSessions long-polling sessions. Zero means no
+// limit.
+func Run(ctx context.Context, addr string, auth Authenticater, autoupdate *autoupdate.Autoupdate, drainWindow time.Duration, heartbeat time.Duration, maxPollSessions int) error {
 	requestCount := metric.NewCurrentCounter("connection")
 	metric.Register(requestCount.Metric)
 
+	pollCount := metric.NewCurrentCounter("long_poll_session")
+	metric.Register(pollCount.Metric)
+
+	control := NewControlHub()
+
 	mux := http.NewServeMux()
 	HandleHealth(mux)
-	HandleAutoupdate(mux, auth, autoupdate, requestCount)
+	HandleAutoupdate(mux, auth, autoupdate, AutoupdateOptions{
+		Counter:         requestCount,
+		Control:         control,
+		Heartbeat:       heartbeat,
+		PollCounter:     pollCount,
+		MaxPollSessions: maxPollSessions,
+	})
+	HandleAutoupdateWebsocket(mux, auth, autoupdate, requestCount, control)
 	HandleHistoryInformation(mux, auth, autoupdate)
+	HandleHistoryDiff(mux, auth, autoupdate)
 	HandleRestrictFQIDs(mux, autoupdate)
+	HandleBatch(mux, auth, autoupdate)
+	HandleControl(mux, control)
+
+	// The connections are not bound to ctx, so they can get the reconnect
+	// messages while draining.
+	srvCtx, cancelSrv := context.WithCancel(context.Background())
+	defer cancelSrv()
 
 	srv := &http.Server{
 		Addr:        addr,
 		Handler:     mux,
-		BaseContext: func(net.Listener) context.Context { return ctx },
+		BaseContext: func(net.Listener) context.Context { return srvCtx },
 	}
 
 	// Shutdown logic in separate goroutine.
 	wait := make(chan error)
 	go func() {
 		<-ctx.Done()
+		control.Drain(srvCtx, drainWindow)
+		cancelSrv()
+
 		if err := srv.Shutdown(context.Background()); err != nil {
 			// TODO EXTERNAL ERROR
 			wait <- fmt.Errorf("HTTP server shutdown: %w", err)
@@ -67,115 +100,542 @@ func Run(ctx context.Context, addr string, auth Authenticater, autoupdate *autou
 
 // Connecter returns an connect object.
 type Connecter interface {
-	Connect(ctx context.Context, userID int, kb autoupdate.KeysBuilder) (autoupdate.DataProvider, error)
+	Connect(ctx context.Context, userID int, kb autoupdate.KeysBuilder, options ...autoupdate.ConnectOption) (autoupdate.DataProvider, error)
 	SingleData(ctx context.Context, userID int, kb autoupdate.KeysBuilder, position int) (map[dskey.Key][]byte, error)
+	LastUpdateID() datastore.UpdateID
+}
+
+// AutoupdateOptions are the optional settings of HandleAutoupdate.
+type AutoupdateOptions struct {
+	// Counter counts the open connections. It can be nil.
+	Counter *metric.CurrentCounter
+
+	// Control sends its messages to streams with the query parameter
+	// `control`. It can be nil.
+	Control *ControlHub
+
+	// Heartbeat is the time without messages, after which a stream with the
+	// query parameter `control` gets a heartbeat message. Zero disables the
+	// heartbeat.
+	Heartbeat time.Duration
+
+	// PollCounter counts the open long-polling sessions. It can be nil.
+	PollCounter *metric.CurrentCounter
+
+	// MaxPollSessions is the maximum amount of long-polling sessions of one
+	// user. Zero means no limit.
+	MaxPollSessions int
 }
 
 // HandleAutoupdate builds the requested keys from the body of a request. The
 // body has to be in the format specified in the keysbuilder package.
-func HandleAutoupdate(mux *http.ServeMux, auth Authenticater, connecter Connecter, counter *metric.CurrentCounter) {
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Cache-Control", "no-store, max-age=0")
-		ctx := r.Context()
+func HandleAutoupdate(mux *http.ServeMux, auth Authenticater, connecter Connecter, opts AutoupdateOptions) {
+	handler := &autoupdateHandler{
+		auth:       auth,
+		connecter:  connecter,
+		opts:       opts,
+		polls:      newPollSessions(pollTimeout, pollTTL, opts.MaxPollSessions, opts.PollCounter),
+		broadcasts: newBroadcasts(connecter),
+
+		// The topic ids are only valid for this instance of the service. The
+		// epoch is part of each event id, so ids of other instances are not
+		// mistaken for own ids.
+		epoch: strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
 
-		defer r.Body.Close()
-		uid := auth.FromContext(r.Context())
+	mux.Handle(
+		prefixPublic,
+		validRequest(
+			authMiddleware(
+				countMiddleware(
+					handler,
+					opts.Counter,
+				),
+				auth,
+			),
+		),
+	)
+}
 
-		queryBuilder, err := keysbuilder.FromKeys(strings.Split(r.URL.Query().Get("k"), ",")...)
+// autoupdateHandler handles the requests of the autoupdate route. Each mode
+// (single, long polling, server-sent events and streams) has its own method.
+type autoupdateHandler struct {
+	auth       Authenticater
+	connecter  Connecter
+	opts       AutoupdateOptions
+	polls      *pollSessions
+	broadcasts *broadcasts
+	epoch      string
+}
+
+// autoupdateRequest is the parsed request to the autoupdate route.
+type autoupdateRequest struct {
+	uid         int
+	builder     *keysbuilder.Builder
+	knownHashes map[dskey.Key]uint64
+	position    int
+	playback    bool
+	minInterval time.Duration
+	encoding    messageEncoding
+	delta       *deltaEncoder
+
+	// broadcast is true, if the client shares its connection with other
+	// anonymous clients or projector screens. zstdFrames is true, if each
+	// message of the broadcast is its own zstd frame. scope is the broadcast
+	// scope of a projector screen.
+	broadcast  bool
+	zstdFrames bool
+	scope      string
+}
+
+func (h *autoupdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store, max-age=0")
+	defer r.Body.Close()
+
+	uid := h.auth.FromContext(r.Context())
+	format := negotiateFormat(w, r)
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		h.serveCursor(w, r, uid, cursor, format)
+		return
+	}
+
+	ctx, req, err := h.parseRequest(r, uid)
+	if err != nil {
+		format.handleErrorWithStatus(w, err)
+		return
+	}
+	req.encoding.format = format
+
+	// A single response is compressed by serveSingle after the entity tag is
+	// checked, so a response with status 304 is not compressed.
+	if r.URL.Query().Has("single") || (req.position != 0 && !req.playback) {
+		h.serveSingle(ctx, w, r, req)
+		return
+	}
+
+	// The query parameter compress compresses each message on its own. In
+	// this case, the response is not compressed again.
+	contentEncoding := negotiateEncoding(r)
+	if req.broadcast && contentEncoding == "zstd" && !req.encoding.compress {
+		w = newFrameWriter(w)
+		req.zstdFrames = true
+	} else if contentEncoding != "" && !req.encoding.compress {
+		cw, err := newCompressWriter(w, contentEncoding)
 		if err != nil {
-			handleErrorWithStatus(w, fmt.Errorf("building keysbuilder from query: %w", err))
+			format.handleErrorWithStatus(w, fmt.Errorf("creating compressor: %w", err))
 			return
 		}
+		defer cw.Close()
+		w = cw
+	}
+
+	switch {
+	case r.URL.Query().Has("long_poll"):
+		h.serveLongPoll(ctx, w, r, req)
+	case isEventStream(r):
+		h.serveEvents(ctx, w, r, req)
+	default:
+		h.serveStream(ctx, w, r, req)
+	}
+}
+
+// parseRequest reads the keys and the settings of a request.
+//
+// The returned context contains the body of the request for the error
+// messages.
+func (h *autoupdateHandler) parseRequest(r *http.Request, uid int) (context.Context, *autoupdateRequest, error) {
+	ctx := r.Context()
+
+	queryBuilder, err := keysbuilder.FromKeys(strings.Split(r.URL.Query().Get("k"), ",")...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("building keysbuilder from query: %w", err)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, nil, invalidRequestError{fmt.Errorf("reading body: %w", err)}
+	}
+
+	compactedBody := new(bytes.Buffer)
+	if err := json.Compact(compactedBody, body); err == nil {
+		// Ignore error, it will be handled in the keysbuilder function.
+		ctx = oserror.ContextWithBody(ctx, string(body))
+	}
+
+	body, knownHashes, err := parseKnownHashes(body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bodyBuilder, err := keysbuilder.ManyFromJSON(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, fmt.Errorf("building keysbuilder from body: %w", err)
+	}
+
+	req := autoupdateRequest{
+		uid:         uid,
+		builder:     keysbuilder.FromBuilders(queryBuilder, bodyBuilder),
+		knownHashes: knownHashes,
+		playback:    r.URL.Query().Has("playback"),
+	}
 
-		body, err := io.ReadAll(r.Body)
+	if rawPosition := r.URL.Query().Get("position"); rawPosition != "" {
+		req.position, err = strconv.Atoi(rawPosition)
 		if err != nil {
-			w.WriteHeader(400)
-			fmt.Fprintln(w, "Invalid body")
-			return
+			return nil, nil, invalidRequestError{fmt.Errorf("position has to be a number, not %s", rawPosition)}
 		}
+	}
 
-		compactedBody := new(bytes.Buffer)
-		if err := json.Compact(compactedBody, body); err == nil {
-			// Ignore error, it will be handled in the keysbuilder function.
-			ctx = oserror.ContextWithBody(ctx, string(body))
+	if req.playback && req.position == 0 {
+		return nil, nil, invalidRequestError{fmt.Errorf("playback needs a position")}
+	}
+
+	if rawInterval := r.URL.Query().Get("min_interval"); rawInterval != "" {
+		req.minInterval, err = time.ParseDuration(rawInterval)
+		if err != nil || req.minInterval < 0 {
+			return nil, nil, invalidRequestError{fmt.Errorf("min_interval has to be a duration like 500ms, not %s", rawInterval)}
 		}
+	}
 
-		bodyBuilder, err := keysbuilder.ManyFromJSON(bytes.NewReader(body))
+	if r.URL.Query().Has("profile_restrict") {
+		ctx = oserror.ContextWithTag(ctx, "profile_restrict")
+	}
+
+	req.encoding.compress = r.URL.Query().Has("compress")
+	req.encoding.withPosition = r.URL.Query().Has("with_position")
+
+	req.delta, err = newDeltaEncoder(r.URL.Query().Get("delta"), req.builder)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The patches are against the data of the connection. They do not apply
+	// to the data of an older connection or another position.
+	if req.delta != nil && req.position != 0 {
+		return nil, nil, invalidRequestError{fmt.Errorf("delta can not be used with position")}
+	}
+
+	// Anonymous clients and projector screens, that get the same bytes, share
+	// one connection. A gzip stream has a state, so the compressed messages
+	// can not be shared.
+	req.broadcast = knownHashes == nil && isBroadcastRequest(r)
+	if negotiateEncoding(r) == "gzip" && !req.encoding.compress {
+		req.broadcast = false
+	}
+
+	if req.broadcast && uid != 0 {
+		req.scope, err = h.broadcasts.scope(ctx, uid)
 		if err != nil {
-			handleErrorWithStatus(w, fmt.Errorf("building keysbuilder from body: %w", err))
-			return
+			return nil, nil, fmt.Errorf("getting broadcast scope: %w", err)
 		}
+		req.broadcast = req.scope != ""
+	}
 
-		builder := keysbuilder.FromBuilders(queryBuilder, bodyBuilder)
+	return ctx, &req, nil
+}
 
-		rawPosition := r.URL.Query().Get("position")
-		position := 0
-		if rawPosition != "" {
-			p, err := strconv.Atoi(rawPosition)
-			if err != nil {
-				handleErrorWithStatus(w, invalidRequestError{fmt.Errorf("position has to be a number, not %s", rawPosition)})
-				return
-			}
-			position = p
-		}
+// connectOptions returns the options for the autoupdate connection of a
+// request.
+func (h *autoupdateHandler) connectOptions(ctx context.Context, r *http.Request, req *autoupdateRequest) ([]autoupdate.ConnectOption, error) {
+	var options []autoupdate.ConnectOption
+	if req.knownHashes != nil {
+		options = append(options, autoupdate.WithKnownHashes(req.knownHashes))
+	}
 
-		if r.URL.Query().Has("profile_restrict") {
-			ctx = oserror.ContextWithTag(ctx, "profile_restrict")
+	if req.playback {
+		steps, err := playbackSteps(ctx, r.URL.Query().Get("playback"))
+		if err != nil {
+			return nil, err
 		}
+		options = append(options, autoupdate.WithPlayback(req.position, steps))
+	}
 
-		var compress bool
-		if r.URL.Query().Has("compress") {
-			compress = true
-		}
+	if req.minInterval > 0 {
+		options = append(options, autoupdate.WithMinInterval(req.minInterval))
+	}
 
-		if r.URL.Query().Has("single") || position != 0 {
-			data, err := connecter.SingleData(ctx, uid, builder, position)
-			if err != nil {
-				handleErrorWithStatus(w, fmt.Errorf("getting single data: %w", err))
-				return
-			}
+	return options, nil
+}
 
-			if err := writeData(w, data, compress); err != nil {
-				handleErrorWithoutStatus(w, err)
-			}
+// control returns the function to write control messages and the heartbeat
+// for a stream.
+//
+// Control messages and heartbeats are only sent to clients, that ask for them.
+// Other clients would take them for data. For them, the returned function is
+// nil, so they are only closed on a reconnect.
+func (h *autoupdateHandler) control(r *http.Request, write func(ControlMessage) error) (func(ControlMessage) error, time.Duration) {
+	if !r.URL.Query().Has("control") {
+		return nil, 0
+	}
+	return write, h.opts.Heartbeat
+}
+
+// serveCursor handles a request of a long-polling client. The keys are known
+// from the first request.
+func (h *autoupdateHandler) serveCursor(w http.ResponseWriter, r *http.Request, uid int, cursor string, format format) {
+	encoding := messageEncoding{format: format}
+	encoding.format.setContentType(w)
+
+	if contentEncoding := negotiateEncoding(r); contentEncoding != "" {
+		cw, err := newCompressWriter(w, contentEncoding)
+		if err != nil {
+			format.handleErrorWithStatus(w, fmt.Errorf("creating compressor: %w", err))
 			return
 		}
+		defer cw.Close()
+		w = cw
+	}
+
+	if err := continuePoll(r.Context(), w, uid, cursor, h.polls, encoding); err != nil {
+		format.handleErrorWithStatus(w, err)
+	}
+}
+
+// serveSingle writes the data once.
+func (h *autoupdateHandler) serveSingle(ctx context.Context, w http.ResponseWriter, r *http.Request, req *autoupdateRequest) {
+	encoding := req.encoding
+
+	encoding.updateID = datastore.UpdateID{Position: req.position}
+	if req.position == 0 {
+		encoding.updateID = h.connecter.LastUpdateID()
+	}
+
+	data, err := h.connecter.SingleData(ctx, req.uid, req.builder, req.position)
+	if err != nil {
+		encoding.format.handleErrorWithStatus(w, fmt.Errorf("getting single data: %w", err))
+		return
+	}
+
+	// The query parameter compress compresses each message on its own. In
+	// this case, the response is not compressed again.
+	contentEncoding := negotiateEncoding(r)
+	if encoding.compress {
+		contentEncoding = ""
+	}
+
+	representation := []string{encoding.format.name(), contentEncoding}
+	if encoding.compress {
+		representation = append(representation, "compress")
+	}
+	if encoding.withPosition {
+		representation = append(representation, strconv.Itoa(encoding.updateID.Position), encoding.updateID.StreamID)
+	}
+
+	encoding.format.setContentType(w)
+	etag := newETag(data, representation...)
+	w.Header().Set("ETag", etag)
+
+	// The data is restricted for the user, so only the browser is allowed to
+	// cache it. Data at a position never changes.
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if req.position != 0 {
+		w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	}
 
-		var wr io.Writer = w
-		if r.URL.Query().Has("skip_first") {
-			// TODO: This will not compress the first data. For the performance
-			// tool this does not matter.
-			wr = newSkipFirst(w)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		if contentEncoding != "" {
+			w.Header().Add("Vary", "Accept-Encoding")
 		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 
-		if err := sendMessages(ctx, wr, uid, builder, connecter, compress); err != nil {
-			handleErrorWithoutStatus(w, err)
+	if contentEncoding != "" {
+		cw, err := newCompressWriter(w, contentEncoding)
+		if err != nil {
+			encoding.format.handleErrorWithStatus(w, fmt.Errorf("creating compressor: %w", err))
 			return
 		}
+		defer cw.Close()
+		w = cw
+	}
+
+	if err := writeData(w, data, encoding); err != nil {
+		encoding.format.handleErrorWithoutStatus(w, err)
+	}
+}
+
+// serveLongPoll starts a long-polling session and writes the first data.
+func (h *autoupdateHandler) serveLongPoll(ctx context.Context, w http.ResponseWriter, r *http.Request, req *autoupdateRequest) {
+	if req.delta != nil || req.encoding.withPosition {
+		req.encoding.format.handleErrorWithStatus(w, invalidRequestError{fmt.Errorf("long polling does not support delta or with_position")})
+		return
+	}
+
+	options, err := h.connectOptions(ctx, r, req)
+	if err != nil {
+		req.encoding.format.handleErrorWithStatus(w, err)
+		return
+	}
+
+	encoding := req.encoding
+	encoding.format.setContentType(w)
+	if err := startPoll(ctx, w, req.uid, req.builder, h.connecter, h.polls, encoding, options...); err != nil {
+		req.encoding.format.handleErrorWithStatus(w, err)
+	}
+}
+
+// serveEvents writes the messages as server-sent events.
+func (h *autoupdateHandler) serveEvents(ctx context.Context, w http.ResponseWriter, r *http.Request, req *autoupdateRequest) {
+	lastEventID, err := parseLastEventID(r, h.epoch)
+	if err != nil {
+		handleErrorWithStatus(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	options, err := h.connectOptions(ctx, r, req)
+	if err != nil {
+		handleErrorWithStatus(w, err)
+		return
+	}
+
+	if lastEventID != 0 {
+		if req.delta != nil {
+			handleErrorWithStatus(w, invalidRequestError{fmt.Errorf("delta can not be used with Last-Event-ID")})
+			return
+		}
+		options = append(options, autoupdate.WithResume(lastEventID))
+	}
+
+	// Server-sent events are text, so they always use json.
+	encoding := req.encoding
+	encoding.format = formatJSON
+	encoding.delta = req.delta
+	w.Header().Set("Content-Type", "text/event-stream")
+
+	sw := &streamWriter{w: w}
+	writeControl, heartbeat := h.control(r, func(msg ControlMessage) error {
+		return sw.write(func(w io.Writer) error { return writeControlEvent(w, msg) })
 	})
+	stopControl := h.opts.Control.listen(ctx, writeControl, cancel)
+	defer stopControl()
+
+	if err := sendEvents(ctx, sw, req.uid, req.builder, h.connecter, encoding, heartbeat, h.epoch, options...); err != nil {
+		sw.write(func(w io.Writer) error {
+			writeEventError(w, err)
+			return nil
+		})
+	}
+}
 
-	mux.Handle(
-		prefixPublic,
-		validRequest(
-			authMiddleware(
-				countMiddleware(
-					handler,
-					counter,
-				),
-				auth,
-			),
-		),
-	)
+// serveStream writes the messages as a stream. Each message is one line.
+func (h *autoupdateHandler) serveStream(ctx context.Context, w http.ResponseWriter, r *http.Request, req *autoupdateRequest) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	options, err := h.connectOptions(ctx, r, req)
+	if err != nil {
+		req.encoding.format.handleErrorWithStatus(w, err)
+		return
+	}
+
+	encoding := req.encoding
+	encoding.format.setContentType(w)
+	encoding.delta = req.delta
+
+	var wr io.Writer = w
+	if r.URL.Query().Has("skip_first") {
+		// TODO: This will not compress the first data. For the performance
+		// tool this does not matter.
+		wr = newSkipFirst(w)
+	}
+
+	sw := &streamWriter{w: wr}
+	writeControl, heartbeat := h.control(r, func(msg ControlMessage) error {
+		return sw.write(func(w io.Writer) error { return writeMessage(w, controlFrame{Control: msg}, encoding) })
+	})
+	stopControl := h.opts.Control.listen(ctx, writeControl, cancel)
+	defer stopControl()
+
+	if req.broadcast {
+		key := broadcastKey{
+			scope:       req.scope,
+			kb:          req.builder.Fingerprint(),
+			contentType: encoding.format.contentType,
+			compress:    encoding.compress,
+			zstdFrames:  req.zstdFrames,
+			minInterval: req.minInterval,
+		}
+		err = sendBroadcast(ctx, sw, h.broadcasts, key, req.uid, req.builder, encoding, heartbeat)
+	}
+
+	if !req.broadcast || errors.Is(err, errNotJoined) {
+		err = sendMessages(ctx, sw, req.uid, req.builder, h.connecter, encoding, heartbeat, options...)
+	}
+
+	if err != nil {
+		sw.write(func(io.Writer) error {
+			encoding.format.handleErrorWithoutStatus(w, err)
+			return nil
+		})
+	}
+}
+
+// messageEncoding defines, how the messages of a response are encoded.
+type messageEncoding struct {
+	format format
+
+	// compress compresses each message on its own with zstd and encodes it
+	// with base64.
+	compress bool
+
+	// If delta is not nil, the messages are encoded as delta to the data, the
+	// client already has.
+	delta *deltaEncoder
+
+	// If withPosition is true, each message is wrapped in an object with the
+	// datastore update id of the message.
+	withPosition bool
+	updateID     datastore.UpdateID
+}
+
+// positionMessage is a message with the datastore update id.
+type positionMessage struct {
+	Position int    `json:"position,omitempty"`
+	StreamID string `json:"stream_id,omitempty"`
+	Data     any    `json:"data"`
+}
+
+// withUpdateIDOption returns the option to set the update id of each message,
+// if the client requested it.
+func (e *messageEncoding) withUpdateIDOption() []autoupdate.ConnectOption {
+	if !e.withPosition {
+		return nil
+	}
+
+	return []autoupdate.ConnectOption{
+		autoupdate.WithUpdateID(func(id datastore.UpdateID) { e.updateID = id }),
+	}
 }
 
-func writeData(w io.Writer, data map[dskey.Key][]byte, compress bool) error {
-	converted := make(map[string]json.RawMessage, len(data))
-	for k, v := range data {
-		converted[k.String()] = v
+// writeData writes the data of a message.
+func writeData(w io.Writer, data map[dskey.Key][]byte, encoding messageEncoding) error {
+	var message any = convertData(data)
+	if encoding.delta != nil {
+		var err error
+		message, err = encoding.delta.encode(data)
+		if err != nil {
+			return fmt.Errorf("encoding delta: %w", err)
+		}
+	}
+
+	if encoding.withPosition {
+		message = positionMessage{
+			Position: encoding.updateID.Position,
+			StreamID: encoding.updateID.StreamID,
+			Data:     message,
+		}
 	}
 
-	if compress {
+	return writeMessage(w, message, encoding)
+}
+
+func writeMessage(w io.Writer, v any, encoding messageEncoding) error {
+	if encoding.compress {
 		defer fmt.Fprintln(w)
 		base64Encoder := base64.NewEncoder(base64.RawStdEncoding, w)
 		defer base64Encoder.Close()
@@ -188,42 +648,220 @@ func writeData(w io.Writer, data map[dskey.Key][]byte, compress bool) error {
 		w = zstdEncoder
 	}
 
-	if err := json.NewEncoder(w).Encode(converted); err != nil {
+	if err := encoding.format.encode(w, v); err != nil {
 		return fmt.Errorf("encode data: %w", err)
 	}
 
 	return nil
 }
 
-// HistoryInformationer is an object, that can write the history information for
+// HistoryInformationer is an object, that returns the history information for
 // an object.
 type HistoryInformationer interface {
 	HistoryInformation(ctx context.Context, uid int, fqid string, w io.Writer) error
+	HistoryEntries(ctx context.Context, uid int, fqid string, filter autoupdate.HistoryFilter) ([]autoupdate.HistoryEntry, int, error)
 }
 
 // HandleHistoryInformation registers the route to return the history information info
 // for an fqid.
+//
+// Without the query parameter details, the response is the history
+// information from the datastore reader. With details, the response is a list
+// of entries with the name of the user and the changed fields. The entries can
+// be filtered with the query parameters from and to as unix timestamps and
+// user_id. The query parameters offset and limit select a page of the filtered
+// entries with at most 100 entries. The header X-Total-Count contains the
+// amount of filtered entries.
 func HandleHistoryInformation(mux *http.ServeMux, auth Authenticater, hi HistoryInformationer) {
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		uid := auth.FromContext(r.Context())
+		format := negotiateFormat(w, r)
 
 		fqid := r.URL.Query().Get("fqid")
 		if fqid == "" {
-			handleErrorWithStatus(w, invalidRequestError{fmt.Errorf("History Information needs an fqid")})
+			format.handleErrorWithStatus(w, invalidRequestError{fmt.Errorf("History Information needs an fqid")})
+			return
+		}
+
+		details := r.URL.Query().Has("details")
+
+		var filter autoupdate.HistoryFilter
+		for _, param := range []struct {
+			name  string
+			value *int
+		}{
+			{"from", &filter.From},
+			{"to", &filter.To},
+			{"user_id", &filter.UserID},
+			{"offset", &filter.Offset},
+			{"limit", &filter.Limit},
+		} {
+			raw := r.URL.Query().Get(param.name)
+			if raw == "" {
+				continue
+			}
+
+			if !details {
+				format.handleErrorWithStatus(w, invalidRequestError{fmt.Errorf("%s needs the query parameter details", param.name)})
+				return
+			}
+
+			value, err := strconv.Atoi(raw)
+			if err != nil || value < 0 {
+				format.handleErrorWithStatus(w, invalidRequestError{fmt.Errorf("%s has to be a positive number, not %q", param.name, raw)})
+				return
+			}
+			*param.value = value
+		}
+
+		if !details {
+			writeHistoryInformation(w, r, hi, uid, fqid, format)
+			return
+		}
+
+		entries, total, err := hi.HistoryEntries(r.Context(), uid, fqid, filter)
+		if err != nil {
+			format.handleErrorWithStatus(w, fmt.Errorf("getting history information: %w", err))
 			return
 		}
 
+		if entries == nil {
+			entries = []autoupdate.HistoryEntry{}
+		}
+
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		format.setContentType(w)
+		if err := format.encode(w, entries); err != nil {
+			format.handleErrorWithoutStatus(w, fmt.Errorf("encoding history information: %w", err))
+			return
+		}
+	})
+
+	mux.Handle(prefixPublic+"/history_information", authMiddleware(handler, auth))
+}
+
+// writeHistoryInformation writes the history information from the datastore
+// reader.
+func writeHistoryInformation(w http.ResponseWriter, r *http.Request, hi HistoryInformationer, uid int, fqid string, format format) {
+	if !format.binary() {
 		if err := hi.HistoryInformation(r.Context(), uid, fqid, w); err != nil {
 			handleErrorWithStatus(w, fmt.Errorf("getting history information: %w", err))
+		}
+		return
+	}
+
+	// The history information is json. It has to be read completely, to
+	// convert it.
+	buf := new(bytes.Buffer)
+	if err := hi.HistoryInformation(r.Context(), uid, fqid, buf); err != nil {
+		format.handleErrorWithStatus(w, fmt.Errorf("getting history information: %w", err))
+		return
+	}
+
+	format.setContentType(w)
+	if err := format.encode(w, json.RawMessage(buf.Bytes())); err != nil {
+		format.handleErrorWithoutStatus(w, fmt.Errorf("encoding history information: %w", err))
+	}
+}
+
+type historyDiffer interface {
+	HistoryDiff(ctx context.Context, userID int, kb autoupdate.KeysBuilder, from, to int) (map[dskey.Key]autoupdate.ValueDiff, error)
+}
+
+// valueDiff is the old and new value of a key in the response of the history
+// diff.
+type valueDiff struct {
+	Old json.RawMessage `json:"old"`
+	New json.RawMessage `json:"new"`
+}
+
+// HandleHistoryDiff registers the route to get the keys, that differ between
+// two positions.
+//
+// The keys are requested like a normal autoupdate request with a body and the
+// query parameter k. The positions are the query parameters from and to. The
+// response contains the old and new value for each changed key:
+//
+//	{"user/1/username": {"old": "hugo", "new": "emil"}}
+func HandleHistoryDiff(mux *http.ServeMux, auth Authenticater, differ historyDiffer) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		uid := auth.FromContext(r.Context())
+		format := negotiateFormat(w, r)
+
+		var positions [2]int
+		for i, name := range []string{"from", "to"} {
+			raw := r.URL.Query().Get(name)
+			position, err := strconv.Atoi(raw)
+			if err != nil || position <= 0 {
+				format.handleErrorWithStatus(w, invalidRequestError{fmt.Errorf("%s has to be a positive number, not %q", name, raw)})
+				return
+			}
+			positions[i] = position
+		}
+
+		queryBuilder, err := keysbuilder.FromKeys(strings.Split(r.URL.Query().Get("k"), ",")...)
+		if err != nil {
+			format.handleErrorWithStatus(w, fmt.Errorf("building keysbuilder from query: %w", err))
+			return
+		}
+
+		bodyBuilder, err := keysbuilder.ManyFromJSON(r.Body)
+		if err != nil {
+			format.handleErrorWithStatus(w, fmt.Errorf("building keysbuilder from body: %w", err))
+			return
+		}
+
+		diff, err := differ.HistoryDiff(r.Context(), uid, keysbuilder.FromBuilders(queryBuilder, bodyBuilder), positions[0], positions[1])
+		if err != nil {
+			format.handleErrorWithStatus(w, fmt.Errorf("getting history diff: %w", err))
+			return
+		}
+
+		response := make(map[string]valueDiff, len(diff))
+		for key, values := range diff {
+			response[key.String()] = valueDiff{Old: nullIfEmpty(values.Old), New: nullIfEmpty(values.New)}
+		}
+
+		format.setContentType(w)
+		if err := format.encode(w, response); err != nil {
+			format.handleErrorWithoutStatus(w, fmt.Errorf("encoding history diff: %w", err))
 			return
 		}
 	})
 
-	mux.Handle(prefixPublic+"/history_information", authMiddleware(handler, auth))
+	mux.Handle(prefixPublic+"/history_diff", validRequest(authMiddleware(handler, auth)))
 }
 
-func sendMessages(ctx context.Context, w io.Writer, uid int, kb autoupdate.KeysBuilder, connecter Connecter, compress bool) error {
-	next, err := connecter.Connect(ctx, uid, kb)
+// nullIfEmpty returns the json value null for an empty value.
+func nullIfEmpty(value []byte) json.RawMessage {
+	if len(value) == 0 {
+		return json.RawMessage("null")
+	}
+	return value
+}
+
+// sendMessages writes the messages of a connection until the context is done.
+//
+// If heartbeat is not zero, a heartbeat message is written, when there was no
+// other message for this time.
+func sendMessages(ctx context.Context, w *streamWriter, uid int, kb autoupdate.KeysBuilder, connecter Connecter, encoding messageEncoding, heartbeat time.Duration, options ...autoupdate.ConnectOption) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if heartbeat > 0 {
+		stopHeartbeat := w.startHeartbeat(ctx, heartbeat, func(w io.Writer) error {
+			return writeMessage(w, controlFrame{Control: ControlMessage{Type: controlHeartbeat}}, encoding)
+		}, cancel)
+		defer stopHeartbeat()
+	}
+
+	if encoding.delta != nil {
+		options = append(options, encoding.delta.connectOptions()...)
+	}
+	options = append(options, encoding.withUpdateIDOption()...)
+
+	next, err := connecter.Connect(ctx, uid, kb, options...)
 	if err != nil {
 		return fmt.Errorf("getting connection: %w", err)
 	}
@@ -236,14 +874,199 @@ func sendMessages(ctx context.Context, w io.Writer, uid int, kb autoupdate.KeysB
 			return fmt.Errorf("getting next message: %w", err)
 		}
 
-		if err := writeData(w, data, compress); err != nil {
+		if err := w.write(func(w io.Writer) error { return writeData(w, data, encoding) }); err != nil {
 			return fmt.Errorf("write data: %w", err)
 		}
-		w.(http.Flusher).Flush()
 	}
 	return ctx.Err()
 }
 
+// playbackSteps returns a channel, that moves a playback one position forward
+// in each interval. The interval is the value of the query parameter
+// `playback` like `500ms` or `2s`.
+func playbackSteps(ctx context.Context, rawInterval string) (<-chan int, error) {
+	interval, err := time.ParseDuration(rawInterval)
+	if err != nil || interval <= 0 {
+		return nil, invalidRequestError{fmt.Errorf("playback has to be a positive duration like 1s, not %s", rawInterval)}
+	}
+
+	steps := make(chan int)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// Blocks, when the connection is live and does not read steps
+			// anymore.
+			select {
+			case steps <- 1:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return steps, nil
+}
+
+// parseKnownHashes reads the hashes of the values, that the client already has,
+// from the request body.
+//
+// The body can be a list of keysbuilder objects or an object like:
+//
+//	{"request": [KEYSBUILDER], "known": {"user/1/name": "HASH"}}
+//
+// HASH is the xxhash64 of the value as hex string. Returns the keysbuilder part
+// of the body and the hashes. The hashes are nil, if the body is not such an
+// object.
+func parseKnownHashes(body []byte) ([]byte, map[dskey.Key]uint64, error) {
+	if trimmed := bytes.TrimSpace(body); len(trimmed) == 0 || trimmed[0] != '{' {
+		return body, nil, nil
+	}
+
+	var content struct {
+		Request json.RawMessage   `json:"request"`
+		Known   map[string]string `json:"known"`
+	}
+	if err := json.Unmarshal(body, &content); err != nil || content.Request == nil {
+		// Let the keysbuilder return the error for the invalid body.
+		return body, nil, nil
+	}
+
+	hashes := make(map[dskey.Key]uint64, len(content.Known))
+	for rawKey, rawHash := range content.Known {
+		key, err := dskey.FromString(rawKey)
+		if err != nil {
+			return nil, nil, invalidRequestError{fmt.Errorf("invalid key %s", rawKey)}
+		}
+
+		hash, err := strconv.ParseUint(rawHash, 16, 64)
+		if err != nil {
+			return nil, nil, invalidRequestError{fmt.Errorf("invalid hash for key %s: %s", rawKey, rawHash)}
+		}
+		hashes[key] = hash
+	}
+
+	return content.Request, hashes, nil
+}
+
+// isEventStream returns true, if the client requested server-sent events.
+func isEventStream(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(accept, ",") {
+			mediaType, _, _ = strings.Cut(mediaType, ";")
+			if strings.TrimSpace(mediaType) == "text/event-stream" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseLastEventID returns the topic id from the Last-Event-ID header. Returns
+// 0, if the header is not set or if the id is from another epoch. In this case,
+// the client gets all data.
+func parseLastEventID(r *http.Request, epoch string) (uint64, error) {
+	rawID := r.Header.Get("Last-Event-ID")
+	if rawID == "" {
+		return 0, nil
+	}
+
+	idEpoch, rawTID, found := strings.Cut(rawID, "-")
+	if !found {
+		return 0, invalidRequestError{fmt.Errorf("Last-Event-ID has to be in the form EPOCH-NUMBER, not %s", rawID)}
+	}
+
+	id, err := strconv.ParseUint(rawTID, 10, 64)
+	if err != nil {
+		return 0, invalidRequestError{fmt.Errorf("Last-Event-ID has to be in the form EPOCH-NUMBER, not %s", rawID)}
+	}
+
+	if idEpoch != epoch {
+		return 0, nil
+	}
+	return id, nil
+}
+
+// sendEvents is like sendMessages but writes each message as a server-sent
+// event. The id of each event is the epoch and the topic id of the message.
+func sendEvents(ctx context.Context, w *streamWriter, uid int, kb autoupdate.KeysBuilder, connecter Connecter, encoding messageEncoding, heartbeat time.Duration, epoch string, options ...autoupdate.ConnectOption) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if heartbeat > 0 {
+		stopHeartbeat := w.startHeartbeat(ctx, heartbeat, func(w io.Writer) error {
+			return writeControlEvent(w, ControlMessage{Type: controlHeartbeat})
+		}, cancel)
+		defer stopHeartbeat()
+	}
+
+	var tid uint64
+	options = append(options, autoupdate.WithTopicID(func(id uint64) { tid = id }))
+
+	if encoding.delta != nil {
+		options = append(options, encoding.delta.connectOptions()...)
+	}
+	options = append(options, encoding.withUpdateIDOption()...)
+
+	next, err := connecter.Connect(ctx, uid, kb, options...)
+	if err != nil {
+		return fmt.Errorf("getting connection: %w", err)
+	}
+
+	for f, ok := next(); ok; f, ok = next() {
+		// This blocks, until there is new data. It also unblocks, when the
+		// client context is done.
+		data, err := f(ctx)
+		if err != nil {
+			return fmt.Errorf("getting next message: %w", err)
+		}
+
+		err = w.write(func(w io.Writer) error {
+			// writeData ends the data with a newline. The second newline ends
+			// the event.
+			fmt.Fprintf(w, "id: %s-%d\ndata: ", epoch, tid)
+			if err := writeData(w, data, encoding); err != nil {
+				return err
+			}
+			fmt.Fprint(w, "\n")
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("write data: %w", err)
+		}
+	}
+	return ctx.Err()
+}
+
+// writeControlEvent writes a control message as server-sent event with the type
+// control.
+func writeControlEvent(w io.Writer, msg ControlMessage) error {
+	encoded, err := json.Marshal(controlFrame{Control: msg})
+	if err != nil {
+		return fmt.Errorf("encoding control message: %w", err)
+	}
+
+	_, err = fmt.Fprintf(w, "event: control\ndata: %s\n\n", encoded)
+	return err
+}
+
+// writeEventError writes an error as server-sent event with the type error.
+func writeEventError(w io.Writer, err error) {
+	errType, msg, ok := clientError(err)
+	if !ok {
+		return
+	}
+
+	fmt.Fprintf(w, "event: error\ndata: {\"error\": {\"type\": \"%s\", \"msg\": \"%s\"}}\n\n", errType, quote(msg))
+}
+
 type restrictFQIDser interface {
 	RestrictFQIDs(ctx context.Context, uid int, fqids []string) (map[string]map[string][]byte, error)
 }
@@ -282,7 +1105,9 @@ func HandleRestrictFQIDs(mux *http.ServeMux, service restrictFQIDser) {
 				responseBody[fqid] = converted
 			}
 
-			if err := json.NewEncoder(w).Encode(responseBody); err != nil {
+			format := negotiateFormat(w, r)
+			format.setContentType(w)
+			if err := format.encode(w, responseBody); err != nil {
 				handleErrorInternal(w, fmt.Errorf("encode response body: %w", err))
 				return
 			}
@@ -345,16 +1170,10 @@ func handleError(w http.ResponseWriter, err error, writeStatusCode bool, interna
 		return
 	}
 
-	status := http.StatusBadRequest
-	var StatusCoder interface{ StatusCode() int }
-	if errors.As(err, &StatusCoder) {
-		status = StatusCoder.StatusCode()
-	}
-
 	var errClient ClientError
 	if errors.As(err, &errClient) {
 		if writeStatusCode {
-			w.WriteHeader(status)
+			w.WriteHeader(errorStatusCode(err))
 		}
 
 		fmt.Fprintf(w, `{"error": {"type": "%s", "msg": "%s"}}`, errClient.Type(), quote(errClient.Error()))
@@ -374,6 +1193,43 @@ func handleError(w http.ResponseWriter, err error, writeStatusCode bool, interna
 	fmt.Fprintln(w, clientOutput)
 }
 
+// errorStatusCode returns the http status code for an error.
+//
+// Client errors use the status code of the error or 400. Other errors are
+// internal errors.
+func errorStatusCode(err error) int {
+	var errClient ClientError
+	if !errors.As(err, &errClient) {
+		return http.StatusInternalServerError
+	}
+
+	var StatusCoder interface{ StatusCode() int }
+	if errors.As(err, &StatusCoder) {
+		return StatusCoder.StatusCode()
+	}
+	return http.StatusBadRequest
+}
+
+// clientError returns the error type and message that should be send to the
+// client.
+//
+// Like handleError, it handles internal errors. The last return value is false,
+// if nothing should be send to the client, for example when the client closed
+// the connection.
+func clientError(err error) (string, string, bool) {
+	if oserror.ContextDone(err) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+		return "", "", false
+	}
+
+	var errClient ClientError
+	if errors.As(err, &errClient) {
+		return errClient.Type(), errClient.Error(), true
+	}
+
+	oserror.Handle(err)
+	return "InternalError", "Something went wrong on the server. The admin is already informed.", true
+}
+
 // quote decodes changes quotation marks with a backslash to make sure, they are
 // valid json.
 func quote(s string) string {
@@ -1,18 +1,25 @@
 package http_test
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
 	ahttp "github.com/OpenSlides/openslides-autoupdate-service/internal/http"
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/oserror"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dsmock"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/environment"
 )
 
 var (
@@ -24,7 +31,7 @@ type connecterMock struct {
 	f autoupdate.DataProvider
 }
 
-func (c *connecterMock) Connect(ctx context.Context, userID int, kb autoupdate.KeysBuilder) (autoupdate.DataProvider, error) {
+func (c *connecterMock) Connect(ctx context.Context, userID int, kb autoupdate.KeysBuilder, options ...autoupdate.ConnectOption) (autoupdate.DataProvider, error) {
 	return c.f, nil
 }
 
@@ -33,6 +40,10 @@ func (c *connecterMock) SingleData(ctx context.Context, userID int, kb autoupdat
 	return next(ctx)
 }
 
+func (c *connecterMock) LastUpdateID() datastore.UpdateID {
+	return datastore.UpdateID{StreamID: "1680000000000-0", Position: 42}
+}
+
 func TestKeysHandler(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -50,7 +61,7 @@ func TestKeysHandler(t *testing.T) {
 		f: func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true },
 	}
 
-	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, nil)
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{})
 
 	req := httptest.NewRequest("GET", "/system/autoupdate?k=user/1/name,user/2/name", nil).WithContext(ctx)
 	rec := httptest.NewRecorder()
@@ -86,7 +97,7 @@ func TestComplexHandler(t *testing.T) {
 		f: func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true },
 	}
 
-	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, nil)
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{})
 
 	req := httptest.NewRequest(
 		"GET",
@@ -141,7 +152,7 @@ func TestErrors(t *testing.T) {
 		f: func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true },
 	}
 
-	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, nil)
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{})
 
 	for _, tt := range []struct {
 		name    string
@@ -205,6 +216,39 @@ func TestErrors(t *testing.T) {
 			`SyntaxError`,
 			"wrong type at field `ids`. Got string, expected number",
 		},
+		{
+			"Playback without position",
+			httptest.NewRequest(
+				"GET",
+				"/system/autoupdate?k=user/1/name&playback=1s",
+				nil,
+			),
+			400,
+			`invalid_request`,
+			"Invalid request: playback needs a position",
+		},
+		{
+			"Playback invalid speed",
+			httptest.NewRequest(
+				"GET",
+				"/system/autoupdate?k=user/1/name&position=5&playback=fast",
+				nil,
+			),
+			400,
+			`invalid_request`,
+			"Invalid request: playback has to be a positive duration like 1s, not fast",
+		},
+		{
+			"Invalid min interval",
+			httptest.NewRequest(
+				"GET",
+				"/system/autoupdate?k=user/1/name&min_interval=soon",
+				nil,
+			),
+			400,
+			`invalid_request`,
+			"Invalid request: min_interval has to be a duration like 500ms, not soon",
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			resp := httptest.NewRecorder()
@@ -239,10 +283,11 @@ func TestErrors(t *testing.T) {
 }
 
 type HistoryInformationStub struct {
-	uid   int
-	fqid  string
-	write string
-	err   error
+	uid    int
+	fqid   string
+	filter autoupdate.HistoryFilter
+	write  string
+	err    error
 }
 
 func (h *HistoryInformationStub) HistoryInformation(ctx context.Context, uid int, fqid string, w io.Writer) error {
@@ -254,6 +299,20 @@ func (h *HistoryInformationStub) HistoryInformation(ctx context.Context, uid int
 	return h.err
 }
 
+func (h *HistoryInformationStub) HistoryEntries(ctx context.Context, uid int, fqid string, filter autoupdate.HistoryFilter) ([]autoupdate.HistoryEntry, int, error) {
+	h.uid = uid
+	h.fqid = fqid
+	h.filter = filter
+	if h.err != nil {
+		return nil, 0, h.err
+	}
+
+	entries := []autoupdate.HistoryEntry{
+		{Position: 42, UserID: 5, UserName: "hugo", Information: json.RawMessage(`["motion was created"]`), Timestamp: 1234567, ChangedFields: []string{"title"}},
+	}
+	return entries, 7, nil
+}
+
 func TestHistoryInformation(t *testing.T) {
 	mux := http.NewServeMux()
 	hi := &HistoryInformationStub{
@@ -283,11 +342,130 @@ func TestHistoryInformation(t *testing.T) {
 	}
 }
 
-func TestHistoryInformationNoFQID(t *testing.T) {
+func TestHistoryInformationDetails(t *testing.T) {
 	mux := http.NewServeMux()
-	hi := &HistoryInformationStub{
-		write: "my information",
+	hi := &HistoryInformationStub{}
+	ahttp.HandleHistoryInformation(mux, fakeAuth(1), hi)
+
+	resp := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/system/autoupdate/history_information?fqid=motion/42&details=1", nil)
+
+	mux.ServeHTTP(resp, req)
+
+	if resp.Result().StatusCode != 200 {
+		t.Errorf("got status %s, expected %s", resp.Result().Status, http.StatusText(http.StatusOK))
+	}
+
+	expect := `[{"position":42,"user_id":5,"information":["motion was created"],"timestamp":1234567,"user_name":"hugo","changed_fields":["title"]}]` + "\n"
+	if body, _ := io.ReadAll(resp.Result().Body); string(body) != expect {
+		t.Errorf("got body %s, expected %s", body, expect)
+	}
+
+	if got := resp.Result().Header.Get("X-Total-Count"); got != "7" {
+		t.Errorf("got X-Total-Count %s, expected 7", got)
+	}
+
+	if hi.uid != 1 {
+		t.Errorf("hi was called with user %d, expected 1", hi.uid)
 	}
+
+	if hi.fqid != "motion/42" {
+		t.Errorf("hi was called with `%s`, expected `motion/42`", hi.fqid)
+	}
+}
+
+func TestHistoryInformationFilter(t *testing.T) {
+	mux := http.NewServeMux()
+	hi := &HistoryInformationStub{}
+	ahttp.HandleHistoryInformation(mux, fakeAuth(1), hi)
+
+	t.Run("valid", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/system/autoupdate/history_information?fqid=motion/42&details=1&from=100&to=200&user_id=5&offset=10&limit=20", nil)
+		mux.ServeHTTP(resp, req)
+
+		if resp.Result().StatusCode != 200 {
+			t.Errorf("got status %s, expected %s", resp.Result().Status, http.StatusText(http.StatusOK))
+		}
+
+		expect := autoupdate.HistoryFilter{From: 100, To: 200, UserID: 5, Offset: 10, Limit: 20}
+		if hi.filter != expect {
+			t.Errorf("hi was called with filter %v, expected %v", hi.filter, expect)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/system/autoupdate/history_information?fqid=motion/42&details=1&limit=many", nil)
+		mux.ServeHTTP(resp, req)
+
+		if resp.Result().StatusCode != 400 {
+			t.Errorf("got status %s, expected %s", resp.Result().Status, http.StatusText(http.StatusBadRequest))
+		}
+	})
+
+	t.Run("without details", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/system/autoupdate/history_information?fqid=motion/42&limit=20", nil)
+		mux.ServeHTTP(resp, req)
+
+		if resp.Result().StatusCode != 400 {
+			t.Errorf("got status %s, expected %s", resp.Result().Status, http.StatusText(http.StatusBadRequest))
+		}
+	})
+}
+
+type historyDiffStub struct {
+	from, to int
+}
+
+func (h *historyDiffStub) HistoryDiff(ctx context.Context, userID int, kb autoupdate.KeysBuilder, from, to int) (map[dskey.Key]autoupdate.ValueDiff, error) {
+	h.from = from
+	h.to = to
+	return map[dskey.Key]autoupdate.ValueDiff{
+		myKey1: {Old: []byte(`"old"`), New: []byte(`"new"`)},
+		myKey2: {Old: []byte(`"deleted"`)},
+	}, nil
+}
+
+func TestHistoryDiff(t *testing.T) {
+	mux := http.NewServeMux()
+	differ := &historyDiffStub{}
+	ahttp.HandleHistoryDiff(mux, fakeAuth(1), differ)
+
+	t.Run("valid", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/system/autoupdate/history_diff?k=user/1/name&from=5&to=7", nil)
+		mux.ServeHTTP(resp, req)
+
+		if resp.Result().StatusCode != 200 {
+			t.Errorf("got status %s, expected %s", resp.Result().Status, http.StatusText(http.StatusOK))
+		}
+
+		expect := `{"collection/1/field":{"old":"old","new":"new"},"collection/2/field":{"old":"deleted","new":null}}` + "\n"
+		if body, _ := io.ReadAll(resp.Result().Body); string(body) != expect {
+			t.Errorf("got body `%s`, expected `%s`", body, expect)
+		}
+
+		if differ.from != 5 || differ.to != 7 {
+			t.Errorf("differ was called with %d and %d, expected 5 and 7", differ.from, differ.to)
+		}
+	})
+
+	t.Run("missing position", func(t *testing.T) {
+		resp := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/system/autoupdate/history_diff?k=user/1/name&from=5", nil)
+		mux.ServeHTTP(resp, req)
+
+		if resp.Result().StatusCode != 400 {
+			t.Errorf("got status %s, expected %s", resp.Result().Status, http.StatusText(http.StatusBadRequest))
+		}
+	})
+}
+
+func TestHistoryInformationNoFQID(t *testing.T) {
+	mux := http.NewServeMux()
+	hi := &HistoryInformationStub{}
 	ahttp.HandleHistoryInformation(mux, fakeAuth(1), hi)
 
 	resp := httptest.NewRecorder()
@@ -340,3 +518,387 @@ func (a fakeAuth) Authenticate(w http.ResponseWriter, r *http.Request) (context.
 func (a fakeAuth) FromContext(ctx context.Context) int {
 	return int(a)
 }
+
+func TestEventStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mux := http.NewServeMux()
+
+	f := func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		cancel()
+		return map[dskey.Key][]byte{myKey1: []byte(`"bar"`)}, nil
+	}
+	connecter := &connecterMock{
+		f: func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true },
+	}
+
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{})
+
+	t.Run("events", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/system/autoupdate?k=user/1/name", nil).WithContext(ctx)
+		req.Header.Set("Accept", "text/event-stream")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		res := rec.Result()
+
+		if got := res.Header.Get("Content-Type"); got != "text/event-stream" {
+			t.Errorf("Got content type %s, expected text/event-stream", got)
+		}
+
+		got, _ := io.ReadAll(res.Body)
+		id, data, _ := strings.Cut(string(got), "\n")
+		if !strings.HasPrefix(id, "id: ") || !strings.HasSuffix(id, "-0") {
+			t.Errorf("Got id line `%s`, expected `id: EPOCH-0`", id)
+		}
+
+		expect := "data: {\"collection/1/field\":\"bar\"}\n\n"
+		if data != expect {
+			t.Errorf("Got content `%s`, expected `%s`", data, expect)
+		}
+	})
+
+	t.Run("invalid last event id", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/system/autoupdate?k=user/1/name", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Last-Event-ID", "foo")
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+
+		if rec.Result().StatusCode != 400 {
+			t.Errorf("Got status %s, expected %s", rec.Result().Status, http.StatusText(400))
+		}
+	})
+}
+
+func TestEventStreamResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, dsBackground := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		user/1:
+			username: hugo
+			first_name: max
+	`))
+	go dsBackground(ctx, oserror.Handle)
+
+	allowAll := func(ctx context.Context, getter datastore.Getter, uid int) (context.Context, datastore.Getter) {
+		return ctx, getter
+	}
+	s, background, err := autoupdate.New(environment.ForTests{}, ds, allowAll)
+	if err != nil {
+		t.Fatalf("autoupdate.New: %v", err)
+	}
+	go background(ctx, oserror.Handle)
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), s, ahttp.AutoupdateOptions{})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// firstEvent returns the id and the data of the first event.
+	firstEvent := func(t *testing.T, lastEventID string) (string, map[string]string) {
+		t.Helper()
+
+		reqCtx, reqCancel := context.WithCancel(ctx)
+		defer reqCancel()
+
+		req, _ := http.NewRequestWithContext(reqCtx, "GET", ts.URL+"/system/autoupdate?k=user/1/username,user/1/first_name", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		reader := bufio.NewReader(resp.Body)
+		idLine, _ := reader.ReadString('\n')
+		dataLine, _ := reader.ReadString('\n')
+
+		var data map[string]string
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(dataLine, "data: ")), &data); err != nil {
+			t.Fatalf("decoding event `%s`: %v", dataLine, err)
+		}
+		return strings.TrimSpace(strings.TrimPrefix(idLine, "id: ")), data
+	}
+
+	// A connection can only be resumed after the first update.
+	ds.Send(dsmock.YAMLData("user/2/username: other"))
+	var id, tid string
+	for i := 0; tid == "" || tid == "0"; i++ {
+		if i == 100 {
+			t.Fatalf("update was not processed")
+		}
+		time.Sleep(time.Millisecond)
+
+		id, _ = firstEvent(t, "")
+		_, tid, _ = strings.Cut(id, "-")
+	}
+
+	ds.Send(dsmock.YAMLData("user/1/username: new"))
+
+	t.Run("same epoch", func(t *testing.T) {
+		_, data := firstEvent(t, id)
+
+		expect := map[string]string{"user/1/username": "new"}
+		if !reflect.DeepEqual(data, expect) {
+			t.Errorf("Got %v, expected %v", data, expect)
+		}
+	})
+
+	t.Run("other epoch", func(t *testing.T) {
+		_, data := firstEvent(t, "other-"+tid)
+
+		expect := map[string]string{"user/1/username": "new", "user/1/first_name": "max"}
+		if !reflect.DeepEqual(data, expect) {
+			t.Errorf("Got %v, expected %v", data, expect)
+		}
+	})
+
+	t.Run("with delta", func(t *testing.T) {
+		req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/system/autoupdate?k=user/1/username&delta=merge", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Last-Event-ID", id)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 400 {
+			t.Errorf("Got status %s, expected %s", resp.Status, http.StatusText(400))
+		}
+	})
+}
+
+func TestDelta(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, dsBackground := dsmock.NewMockDatastore(map[dskey.Key][]byte{
+		dskey.MustKey("user/1/id"):       []byte(`1`),
+		dskey.MustKey("user/1/username"): []byte(`"hugo"`),
+		dskey.MustKey("user/1/settings"): []byte(`{"a":1,"b":2}`),
+	})
+	go dsBackground(ctx, oserror.Handle)
+
+	allowAll := func(ctx context.Context, getter datastore.Getter, uid int) (context.Context, datastore.Getter) {
+		return ctx, getter
+	}
+	s, background, err := autoupdate.New(environment.ForTests{}, ds, allowAll)
+	if err != nil {
+		t.Fatalf("autoupdate.New: %v", err)
+	}
+	go background(ctx, oserror.Handle)
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), s, ahttp.AutoupdateOptions{})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	modes := []struct {
+		mode   string
+		expect string
+	}{
+		{"merge", `{"user/1/settings":{"b":3},"user/1/username":"max"}`},
+		{"json-patch", `[{"op":"replace","path":"/user~11~1settings/b","value":3},{"op":"replace","path":"/user~11~1username","value":"max"}]`},
+	}
+
+	readers := make([]*bufio.Reader, len(modes))
+	for i, tt := range modes {
+		req, _ := http.NewRequestWithContext(ctx, "GET", ts.URL+"/system/autoupdate?k=user/1/username,user/1/settings&delta="+tt.mode, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		readers[i] = bufio.NewReader(resp.Body)
+		first, err := readers[i].ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading first message: %v", err)
+		}
+
+		if expect := `{"user/1/settings":{"a":1,"b":2},"user/1/username":"hugo"}` + "\n"; first != expect {
+			t.Errorf("mode %s: got first message `%s`, expected `%s`", tt.mode, first, expect)
+		}
+	}
+
+	ds.Send(map[dskey.Key][]byte{
+		dskey.MustKey("user/1/username"): []byte(`"max"`),
+		dskey.MustKey("user/1/settings"): []byte(`{"a":1,"b":3}`),
+	})
+
+	for i, tt := range modes {
+		got, err := readers[i].ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading second message: %v", err)
+		}
+
+		if got != tt.expect+"\n" {
+			t.Errorf("mode %s: got `%s`, expected `%s`", tt.mode, got, tt.expect)
+		}
+	}
+
+	t.Run("with position", func(t *testing.T) {
+		resp, err := http.Get(ts.URL + "/system/autoupdate?k=user/1/username&delta=merge&position=1")
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 400 {
+			t.Errorf("Got status %s, expected %s", resp.Status, http.StatusText(400))
+		}
+	})
+}
+
+func TestListDiffSharedConnections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, dsBackground := dsmock.NewMockDatastore(dsmock.YAMLData(`---
+		meeting/1/user_ids: [1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20]
+		user/1/username: hugo
+	`))
+	go dsBackground(ctx, oserror.Handle)
+
+	allowAll := func(ctx context.Context, getter datastore.Getter, uid int) (context.Context, datastore.Getter) {
+		return ctx, getter
+	}
+	s, background, err := autoupdate.New(environment.ForTests{}, ds, allowAll)
+	if err != nil {
+		t.Fatalf("autoupdate.New: %v", err)
+	}
+	go background(ctx, oserror.Handle)
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), s, ahttp.AutoupdateOptions{})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	body := `[{"ids":[1],"collection":"meeting","fields":{"user_ids":{"type":"relation-list","collection":"user","fields":{"username":null}}}}]`
+
+	// Two connections of the same user with the same keys.
+	var readers []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequestWithContext(ctx, "POST", ts.URL+"/system/autoupdate?delta=list-diff", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("sending request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		reader := bufio.NewReader(resp.Body)
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatalf("reading first message: %v", err)
+		}
+		readers = append(readers, reader)
+	}
+
+	ds.Send(dsmock.YAMLData(`meeting/1/user_ids: [1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17,18,19,20,21]`))
+
+	for i, reader := range readers {
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading second message of connection %d: %v", i, err)
+		}
+
+		expect := `{"meeting/1/user_ids":{"added":[21],"removed":[]}}` + "\n"
+		if got != expect {
+			t.Errorf("connection %d got `%s`, expected `%s`", i, got, expect)
+		}
+	}
+}
+
+func TestKnownHashes(t *testing.T) {
+	f := func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		return map[dskey.Key][]byte{myKey1: []byte(`"bar"`)}, nil
+	}
+	connecter := &connecterMock{
+		f: func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true },
+	}
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{})
+
+	for _, tt := range []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{
+			"valid",
+			`{"request":[{"ids":[1],"collection":"user","fields":{"name":null}}],"known":{"user/1/name":"a1b2c3d4e5f60718"}}`,
+			200,
+		},
+		{
+			"invalid hash",
+			`{"request":[{"ids":[1],"collection":"user","fields":{"name":null}}],"known":{"user/1/name":"no hash"}}`,
+			400,
+		},
+		{
+			"invalid key",
+			`{"request":[{"ids":[1],"collection":"user","fields":{"name":null}}],"known":{"user/name":"a1b2c3d4e5f60718"}}`,
+			400,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/system/autoupdate?single=1", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if got := rec.Result().StatusCode; got != tt.status {
+				t.Errorf("Got status %d, expected %d: %s", got, tt.status, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestWithPosition(t *testing.T) {
+	f := func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		return map[dskey.Key][]byte{myKey1: []byte(`"bar"`)}, nil
+	}
+	connecter := &connecterMock{
+		f: func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true },
+	}
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdate(mux, fakeAuth(1), connecter, ahttp.AutoupdateOptions{})
+
+	for _, tt := range []struct {
+		name   string
+		url    string
+		expect string
+	}{
+		{
+			"single",
+			"/system/autoupdate?k=user/1/name&single=1&with_position=1",
+			`{"position":42,"stream_id":"1680000000000-0","data":{"collection/1/field":"bar"}}` + "\n",
+		},
+		{
+			"position",
+			"/system/autoupdate?k=user/1/name&position=5&with_position=1",
+			`{"position":5,"data":{"collection/1/field":"bar"}}` + "\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.url, nil)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if got := rec.Body.String(); got != tt.expect {
+				t.Errorf("Got `%s`, expected `%s`", got, tt.expect)
+			}
+		})
+	}
+}
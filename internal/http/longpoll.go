@@ -0,0 +1,344 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/metric"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+)
+
+const (
+	// pollTimeout is the time a poll request waits for new data before it
+	// returns an empty message.
+	pollTimeout = 30 * time.Second
+
+	// pollTTL is the time a long-polling connection is kept after the last
+	// request.
+	pollTTL = 2 * time.Minute
+)
+
+// cursorError is returned, when a client polls with a cursor that is unknown
+// or expired. The client has to start a new long-polling connection.
+type cursorError struct {
+	cursor string
+}
+
+func (e cursorError) Error() string {
+	return fmt.Sprintf("unknown or expired cursor %s", e.cursor)
+}
+
+func (e cursorError) Type() string {
+	return "unknown_cursor"
+}
+
+func (e cursorError) StatusCode() int {
+	return http.StatusGone
+}
+
+// tooManySessionsError is returned, when a user starts more long-polling
+// sessions then allowed.
+type tooManySessionsError struct {
+	max int
+}
+
+func (e tooManySessionsError) Error() string {
+	return fmt.Sprintf("a user can have at most %d long-polling sessions", e.max)
+}
+
+func (e tooManySessionsError) Type() string {
+	return "too_many_sessions"
+}
+
+func (e tooManySessionsError) StatusCode() int {
+	return http.StatusTooManyRequests
+}
+
+// pollMessage is the response of a long-polling request.
+type pollMessage struct {
+	Cursor string `json:"cursor"`
+	Data   any    `json:"data"`
+}
+
+// pollResult is the result of one call to the autoupdate connection.
+type pollResult struct {
+	data map[dskey.Key][]byte
+	err  error
+}
+
+// pollSession is an autoupdate connection of a long-polling client. It keeps
+// the state of the connection between two requests.
+type pollSession struct {
+	mu sync.Mutex
+
+	id   string
+	uid  int
+	next autoupdate.DataProvider
+
+	// ctx is done, when the session expires.
+	ctx    context.Context
+	cancel context.CancelFunc
+	expire *time.Timer
+
+	// pending is the result of the running call to the connection. It is nil,
+	// if there is no running call.
+	pending chan pollResult
+
+	// seq is the number of messages, that where sent to the client. last is the
+	// last message, so it can be sent again, if the client did not get it.
+	seq  uint64
+	last map[dskey.Key][]byte
+}
+
+// cursor returns the cursor for the next request.
+func (s *pollSession) cursor() string {
+	return s.id + "." + strconv.FormatUint(s.seq, 10)
+}
+
+// poll returns the next data of the connection. Returns an empty map, if there
+// is no new data in the timeout.
+//
+// If the timeout is reached, the connection keeps calculating the data in the
+// background. The next call returns it.
+func (s *pollSession) poll(ctx context.Context, timeout time.Duration) (map[dskey.Key][]byte, error) {
+	if s.pending == nil {
+		f, ok := s.next()
+		if !ok {
+			return nil, fmt.Errorf("connection is closed")
+		}
+
+		pending := make(chan pollResult, 1)
+		s.pending = pending
+		go func() {
+			data, err := f(s.ctx)
+			pending <- pollResult{data: data, err: err}
+		}()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-s.pending:
+		s.pending = nil
+		return r.data, r.err
+
+	case <-timer.C:
+		return map[dskey.Key][]byte{}, nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// pollSessions holds the sessions of all long-polling clients.
+//
+// The sessions are not bound to a request, so they are counted with their own
+// counter. Each user can only have maxPerUser sessions. Anonymous users have no
+// limit, since all anonymous clients have the same user id.
+type pollSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*pollSession
+	perUser  map[int]int
+	timeout  time.Duration
+	ttl      time.Duration
+
+	maxPerUser int
+	counter    *metric.CurrentCounter
+}
+
+// newPollSessions initializes the sessions.
+//
+// maxPerUser zero means no limit. counter can be nil.
+func newPollSessions(timeout, ttl time.Duration, maxPerUser int, counter *metric.CurrentCounter) *pollSessions {
+	return &pollSessions{
+		sessions:   make(map[string]*pollSession),
+		perUser:    make(map[int]int),
+		timeout:    timeout,
+		ttl:        ttl,
+		maxPerUser: maxPerUser,
+		counter:    counter,
+	}
+}
+
+// create starts a new session.
+//
+// Returns a tooManySessionsError, if the user has already the maximum amount
+// of sessions. The limit does not apply to anonymous users.
+func (p *pollSessions) create(uid int, connect func(ctx context.Context) (autoupdate.DataProvider, error)) (*pollSession, error) {
+	rawID := make([]byte, 16)
+	if _, err := rand.Read(rawID); err != nil {
+		return nil, fmt.Errorf("creating session id: %w", err)
+	}
+
+	// The slot is taken before the connection is created, so many requests at
+	// the same time can not exceed the limit.
+	p.mu.Lock()
+	if uid != 0 && p.maxPerUser > 0 && p.perUser[uid] >= p.maxPerUser {
+		p.mu.Unlock()
+		return nil, tooManySessionsError{max: p.maxPerUser}
+	}
+	p.perUser[uid]++
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	next, err := connect(ctx)
+	if err != nil {
+		cancel()
+		p.releaseUser(uid)
+		return nil, err
+	}
+
+	s := &pollSession{
+		id:     hex.EncodeToString(rawID),
+		uid:    uid,
+		next:   next,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	s.expire = time.AfterFunc(p.ttl, func() { p.remove(s.id) })
+
+	if p.counter != nil {
+		p.counter.Add()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sessions[s.id] = s
+	return s, nil
+}
+
+// releaseUser frees a slot of the user.
+func (p *pollSessions) releaseUser(uid int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.releaseUserLocked(uid)
+}
+
+// releaseUserLocked is like releaseUser but has to be called with the lock.
+func (p *pollSessions) releaseUserLocked(uid int) {
+	p.perUser[uid]--
+	if p.perUser[uid] <= 0 {
+		delete(p.perUser, uid)
+	}
+}
+
+// get returns the session for a cursor and the sequence number of the cursor.
+func (p *pollSessions) get(cursor string, uid int) (*pollSession, uint64, error) {
+	id, rawSeq, _ := strings.Cut(cursor, ".")
+	seq, err := strconv.ParseUint(rawSeq, 10, 64)
+	if err != nil {
+		return nil, 0, invalidRequestError{fmt.Errorf("invalid cursor %s", cursor)}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s, ok := p.sessions[id]
+	if !ok || s.uid != uid {
+		return nil, 0, cursorError{cursor: cursor}
+	}
+	return s, seq, nil
+}
+
+// resetExpire restarts the expire timer of a session, if the session was not
+// removed in the meantime.
+func (p *pollSessions) resetExpire(s *pollSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.sessions[s.id] == s {
+		s.expire.Reset(p.ttl)
+	}
+}
+
+// remove stops a session.
+func (p *pollSessions) remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s, ok := p.sessions[id]; ok {
+		s.expire.Stop()
+		s.cancel()
+		delete(p.sessions, id)
+		p.releaseUserLocked(s.uid)
+
+		if p.counter != nil {
+			p.counter.Done()
+		}
+	}
+}
+
+// startPoll creates a long-polling session and writes the first data.
+func startPoll(ctx context.Context, w http.ResponseWriter, uid int, kb autoupdate.KeysBuilder, connecter Connecter, sessions *pollSessions, encoding messageEncoding, options ...autoupdate.ConnectOption) error {
+	s, err := sessions.create(uid, func(ctx context.Context) (autoupdate.DataProvider, error) {
+		return connecter.Connect(ctx, uid, kb, options...)
+	})
+	if err != nil {
+		return fmt.Errorf("getting connection: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return pollAndWrite(ctx, w, s, sessions, encoding)
+}
+
+// continuePoll writes the next data of a long-polling session.
+func continuePoll(ctx context.Context, w http.ResponseWriter, uid int, cursor string, sessions *pollSessions, encoding messageEncoding) error {
+	s, seq, err := sessions.get(cursor, uid)
+	if err != nil {
+		return err
+	}
+
+	if !s.mu.TryLock() {
+		return invalidRequestError{fmt.Errorf("there is already a request with cursor %s", cursor)}
+	}
+	defer s.mu.Unlock()
+
+	switch {
+	case seq == s.seq:
+		return pollAndWrite(ctx, w, s, sessions, encoding)
+
+	case seq+1 == s.seq && s.last != nil:
+		// The client did not get the last message.
+		return writeMessage(w, pollMessage{Cursor: s.cursor(), Data: convertData(s.last)}, encoding)
+
+	default:
+		return cursorError{cursor: cursor}
+	}
+}
+
+// pollAndWrite waits for the next data of the session and writes it.
+//
+// The caller has to hold the lock of the session.
+func pollAndWrite(ctx context.Context, w http.ResponseWriter, s *pollSession, sessions *pollSessions, encoding messageEncoding) error {
+	// Do not expire the session while the client is waiting.
+	s.expire.Stop()
+	defer sessions.resetExpire(s)
+
+	data, err := s.poll(ctx, sessions.timeout)
+	if err != nil {
+		if ctx.Err() == nil {
+			// The connection is broken. The client has to start again.
+			sessions.remove(s.id)
+		}
+		return fmt.Errorf("polling data: %w", err)
+	}
+
+	if len(data) > 0 || s.seq == 0 {
+		s.seq++
+		s.last = data
+	}
+
+	return writeMessage(w, pollMessage{Cursor: s.cursor(), Data: convertData(data)}, encoding)
+}
@@ -0,0 +1,259 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+)
+
+// channelConnecter returns the first data immediately and each later data
+// from a channel.
+type channelConnecter struct {
+	Connecter
+	data chan map[dskey.Key][]byte
+}
+
+func (c *channelConnecter) Connect(ctx context.Context, userID int, kb autoupdate.KeysBuilder, options ...autoupdate.ConnectOption) (autoupdate.DataProvider, error) {
+	first := true
+	f := func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		if first {
+			first = false
+			return map[dskey.Key][]byte{dskey.MustKey("user/1/name"): []byte(`"first"`)}, nil
+		}
+
+		select {
+		case data := <-c.data:
+			return data, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true }, nil
+}
+
+// pollResponse is a decoded pollMessage.
+type pollResponse struct {
+	Cursor string                     `json:"cursor"`
+	Data   map[string]json.RawMessage `json:"data"`
+}
+
+func TestLongPoll(t *testing.T) {
+	ctx := context.Background()
+	connecter := &channelConnecter{data: make(chan map[dskey.Key][]byte)}
+	sessions := newPollSessions(20*time.Millisecond, time.Minute, 0, nil)
+
+	poll := func(t *testing.T, cursor string) (pollResponse, error) {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		var err error
+		if cursor == "" {
+			err = startPoll(ctx, rec, 1, nil, connecter, sessions, messageEncoding{})
+		} else {
+			err = continuePoll(ctx, rec, 1, cursor, sessions, messageEncoding{})
+		}
+		if err != nil {
+			return pollResponse{}, err
+		}
+
+		var msg pollResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &msg); err != nil {
+			t.Fatalf("decoding response `%s`: %v", rec.Body.Bytes(), err)
+		}
+		return msg, nil
+	}
+
+	first, err := poll(t, "")
+	if err != nil {
+		t.Fatalf("first poll: %v", err)
+	}
+
+	if got := string(first.Data["user/1/name"]); got != `"first"` {
+		t.Errorf("first poll returned %s, expected \"first\"", got)
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		msg, err := poll(t, first.Cursor)
+		if err != nil {
+			t.Fatalf("poll: %v", err)
+		}
+
+		if len(msg.Data) != 0 {
+			t.Errorf("got data %v, expected empty data", msg.Data)
+		}
+
+		if msg.Cursor != first.Cursor {
+			t.Errorf("got cursor %s, expected the same cursor %s", msg.Cursor, first.Cursor)
+		}
+	})
+
+	var second pollResponse
+	t.Run("new data", func(t *testing.T) {
+		// The connection from the last poll is still waiting.
+		connecter.data <- map[dskey.Key][]byte{dskey.MustKey("user/1/name"): []byte(`"second"`)}
+
+		second, err = poll(t, first.Cursor)
+		if err != nil {
+			t.Fatalf("poll: %v", err)
+		}
+
+		if got := string(second.Data["user/1/name"]); got != `"second"` {
+			t.Errorf("got %s, expected \"second\"", got)
+		}
+
+		if second.Cursor == first.Cursor {
+			t.Errorf("cursor did not change")
+		}
+	})
+
+	t.Run("repeat last message", func(t *testing.T) {
+		msg, err := poll(t, first.Cursor)
+		if err != nil {
+			t.Fatalf("poll: %v", err)
+		}
+
+		if got := string(msg.Data["user/1/name"]); got != `"second"` {
+			t.Errorf("got %s, expected \"second\"", got)
+		}
+
+		if msg.Cursor != second.Cursor {
+			t.Errorf("got cursor %s, expected %s", msg.Cursor, second.Cursor)
+		}
+	})
+
+	t.Run("unknown cursor", func(t *testing.T) {
+		_, err := poll(t, "abc.1")
+
+		var errCursor cursorError
+		if !errors.As(err, &errCursor) {
+			t.Errorf("got error %v, expected cursorError", err)
+		}
+	})
+
+	t.Run("cursor of other user", func(t *testing.T) {
+		err := continuePoll(ctx, httptest.NewRecorder(), 2, second.Cursor, sessions, messageEncoding{})
+
+		var errCursor cursorError
+		if !errors.As(err, &errCursor) {
+			t.Errorf("got error %v, expected cursorError", err)
+		}
+	})
+}
+
+func TestLongPollExpire(t *testing.T) {
+	connecter := &channelConnecter{data: make(chan map[dskey.Key][]byte)}
+	sessions := newPollSessions(time.Second, 10*time.Millisecond, 0, nil)
+
+	rec := httptest.NewRecorder()
+	if err := startPoll(context.Background(), rec, 1, nil, connecter, sessions, messageEncoding{}); err != nil {
+		t.Fatalf("first poll: %v", err)
+	}
+
+	var msg pollResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &msg); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	err := continuePoll(context.Background(), httptest.NewRecorder(), 1, msg.Cursor, sessions, messageEncoding{})
+
+	var errCursor cursorError
+	if !errors.As(err, &errCursor) {
+		t.Errorf("got error %v, expected cursorError after the ttl", err)
+	}
+}
+
+func TestLongPollBrokenConnection(t *testing.T) {
+	connect := func(ctx context.Context) (autoupdate.DataProvider, error) {
+		f := func(ctx context.Context) (map[dskey.Key][]byte, error) { return nil, errors.New("broken") }
+		return func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true }, nil
+	}
+	sessions := newPollSessions(time.Second, time.Minute, 0, nil)
+
+	s, err := sessions.create(1, connect)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	s.mu.Lock()
+	err = pollAndWrite(context.Background(), httptest.NewRecorder(), s, sessions, messageEncoding{})
+	s.mu.Unlock()
+
+	if err == nil {
+		t.Fatalf("pollAndWrite did not return the error of the connection")
+	}
+
+	if _, ok := sessions.sessions[s.id]; ok {
+		t.Errorf("session was not removed")
+	}
+
+	if s.expire.Stop() {
+		t.Errorf("expire timer of the removed session is running")
+	}
+}
+
+func TestLongPollSessionLimit(t *testing.T) {
+	connect := func(ctx context.Context) (autoupdate.DataProvider, error) {
+		return func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return nil, false }, nil
+	}
+	sessions := newPollSessions(time.Second, time.Minute, 2, nil)
+
+	first, err := sessions.create(1, connect)
+	if err != nil {
+		t.Fatalf("first session: %v", err)
+	}
+
+	if _, err := sessions.create(1, connect); err != nil {
+		t.Fatalf("second session: %v", err)
+	}
+
+	t.Run("limit reached", func(t *testing.T) {
+		_, err := sessions.create(1, connect)
+
+		var errTooMany tooManySessionsError
+		if !errors.As(err, &errTooMany) {
+			t.Errorf("got error %v, expected tooManySessionsError", err)
+		}
+	})
+
+	t.Run("other user", func(t *testing.T) {
+		if _, err := sessions.create(2, connect); err != nil {
+			t.Errorf("session of other user: %v", err)
+		}
+	})
+
+	t.Run("anonymous", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			if _, err := sessions.create(0, connect); err != nil {
+				t.Errorf("anonymous session %d: %v", i, err)
+			}
+		}
+	})
+
+	t.Run("after remove", func(t *testing.T) {
+		sessions.remove(first.id)
+
+		if _, err := sessions.create(1, connect); err != nil {
+			t.Errorf("session after remove: %v", err)
+		}
+	})
+
+	t.Run("failed connect", func(t *testing.T) {
+		failing := func(ctx context.Context) (autoupdate.DataProvider, error) { return nil, errors.New("some error") }
+		if _, err := sessions.create(3, failing); err == nil {
+			t.Fatalf("create did not return the error of connect")
+		}
+
+		if got := sessions.perUser[3]; got != 0 {
+			t.Errorf("user has %d sessions after a failed connect, expected 0", got)
+		}
+	})
+}
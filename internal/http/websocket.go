@@ -0,0 +1,454 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/keysbuilder"
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/metric"
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/oserror"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/auth"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"golang.org/x/net/websocket"
+)
+
+// HandleAutoupdateWebsocket registers a websocket endpoint, where a client can
+// open many subscriptions over one connection.
+//
+// The client sends json messages like:
+//
+//	{"type": "subscribe", "id": "motions", "body": [KEYSBUILDER]}
+//	{"type": "modify", "id": "motions", "body": [KEYSBUILDER]}
+//	{"type": "extend", "id": "motions", "body": [KEYSBUILDER]}
+//	{"type": "unsubscribe", "id": "motions"}
+//
+// A subscription with a position replays the history from this position. It
+// is moved forward with step, one position at a time, or with live to the
+// current data:
+//
+//	{"type": "subscribe", "id": "history", "body": [KEYSBUILDER], "position": 42}
+//	{"type": "step", "id": "history"}
+//	{"type": "live", "id": "history"}
+//
+// With modify, the keysbuilder of a subscription is replaced. With extend, the
+// body is added to the keysbuilder. In both cases, the client only gets the new
+// keys and nil for keys that are not requested anymore.
+//
+// Each message from the server is tagged with the id of the subscription:
+//
+//	{"id": "motions", "data": {"motion/1/title": "foo"}}
+//	{"id": "motions", "error": {"type": "SyntaxError", "msg": "No data"}}
+//
+// Control messages are not tagged with an id:
+//
+//	{"id": "", "control": {"type": "reload"}}
+//
+// Browsers can not set the authentication header on a websocket. They send the
+// auth cookie and the token as subprotocol with the prefix "bearer.". If no
+// format is requested as subprotocol, the server selects the token protocol. A
+// renewed token is sent in the Authentication header of the handshake response.
+// Requests with an Origin header from another host are rejected.
+//
+// The messages from the server are json text messages. With the subprotocol
+// msgpack or cbor or with the Accept header, the server sends binary messages
+// in this format. The messages from the client are always json.
+func HandleAutoupdateWebsocket(mux *http.ServeMux, auth Authenticater, connecter Connecter, counter *metric.CurrentCounter, control *ControlHub) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uid := auth.FromContext(r.Context())
+
+		format := formatFromAccept(r)
+		server := websocket.Server{
+			// The default handshake rejects clients without an origin header,
+			// but only browsers send one. Requests from browsers have to come
+			// from the same host.
+			Handshake: func(config *websocket.Config, r *http.Request) error {
+				if err := checkWebsocketOrigin(r); err != nil {
+					return err
+				}
+
+				var protocol string
+				protocol, format = negotiateWebsocketFormat(config.Protocol, format)
+				config.Protocol = nil
+				if protocol != "" {
+					config.Protocol = []string{protocol}
+				}
+
+				// The handshake response is written to the hijacked
+				// connection. Headers from the middlewares, for example a
+				// renewed auth token, have to be added to it.
+				config.Header = w.Header()
+				return nil
+			},
+			Handler: func(ws *websocket.Conn) {
+				if err := serveWebsocket(ws.Request().Context(), ws, uid, connecter, control, format); err != nil {
+					oserror.Handle(fmt.Errorf("websocket: %w", err))
+				}
+			},
+		}
+
+		server.ServeHTTP(w, r)
+	})
+
+	mux.Handle(
+		prefixPublic+"/ws",
+		authMiddleware(
+			countMiddleware(
+				handler,
+				counter,
+			),
+			auth,
+		),
+	)
+}
+
+// checkWebsocketOrigin prevents cross-site websocket hijacking. If the
+// request has an Origin header, its host has to be the host of the request or
+// the forwarded host of a proxy.
+func checkWebsocketOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+
+	originURL, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("invalid origin %q: %w", origin, err)
+	}
+
+	for _, host := range []string{r.Host, r.Header.Get("X-Forwarded-Host")} {
+		if host != "" && strings.EqualFold(originURL.Host, host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin %s does not match the host %s", origin, r.Host)
+}
+
+// negotiateWebsocketFormat returns the first subprotocol of the client, that
+// is a supported format. If the client did not request a format as
+// subprotocol, fallback is used.
+//
+// Browsers close the connection, if the server does not select one of the
+// offered subprotocols. So if the client only sent the auth token as
+// subprotocol, the token protocol is returned.
+func negotiateWebsocketFormat(protocols []string, fallback format) (string, format) {
+	var tokenProtocol string
+	for _, protocol := range protocols {
+		switch protocol {
+		case "json":
+			return protocol, formatJSON
+		case "msgpack":
+			return protocol, formatMsgpack
+		case "cbor":
+			return protocol, formatCBOR
+		}
+
+		if tokenProtocol == "" && strings.HasPrefix(protocol, auth.TokenProtocolPrefix) {
+			tokenProtocol = protocol
+		}
+	}
+	return tokenProtocol, fallback
+}
+
+// wsRequest is a message from the client.
+type wsRequest struct {
+	Type     string          `json:"type"`
+	ID       string          `json:"id"`
+	Body     json.RawMessage `json:"body"`
+	Position int             `json:"position"`
+}
+
+// wsResponse is a message to the client.
+type wsResponse struct {
+	ID    string        `json:"id"`
+	Data  any           `json:"data,omitempty"`
+	Error *errorMessage `json:"error,omitempty"`
+
+	// Position is the position of a message of a playback.
+	Position int `json:"position,omitempty"`
+
+	Control *ControlMessage `json:"control,omitempty"`
+}
+
+// wsConn wraps a websocket connection, so it can be written from many
+// goroutines.
+type wsConn struct {
+	mu     sync.Mutex
+	ws     *websocket.Conn
+	format format
+}
+
+// send sends a message to the client. Binary formats are send as binary
+// messages.
+func (c *wsConn) send(msg wsResponse) error {
+	if !c.format.binary() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		return websocket.JSON.Send(c.ws, msg)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := c.format.encode(buf, msg); err != nil {
+		return fmt.Errorf("encoding message: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return websocket.Message.Send(c.ws, buf.Bytes())
+}
+
+// sendError sends an error for a subscription to the client.
+//
+// Errors that should not be send to the client, for example when the
+// subscription was closed, are ignored.
+func (c *wsConn) sendError(id string, err error) error {
+	errType, msg, ok := clientError(err)
+	if !ok {
+		return nil
+	}
+
+	return c.send(wsResponse{ID: id, Error: &errorMessage{Type: errType, Msg: msg}})
+}
+
+// wsSubscription is an open subscription of a websocket connection.
+type wsSubscription struct {
+	cancel  context.CancelFunc
+	builder *keysbuilder.Builder
+	updates chan autoupdate.KeysBuilder
+
+	// steps moves a playback forward. It is nil, if the subscription is not a
+	// playback.
+	steps chan int
+}
+
+// setBuilder sends a new keysbuilder to the subscription.
+//
+// If the subscription did not process the last keysbuilder, it is replaced.
+func (s *wsSubscription) setBuilder(builder *keysbuilder.Builder) {
+	s.builder = builder
+
+	select {
+	case <-s.updates:
+	default:
+	}
+	s.updates <- builder
+}
+
+// serveWebsocket reads the messages from the client and starts and stops the
+// subscriptions.
+//
+// Blocks until the client closes the connection or the context is done.
+func serveWebsocket(ctx context.Context, ws *websocket.Conn, uid int, connecter Connecter, control *ControlHub, format format) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	conn := &wsConn{ws: ws, format: format}
+
+	stopControl := control.listen(ctx, func(msg ControlMessage) error {
+		return conn.send(wsResponse{Control: &msg})
+	}, cancel)
+	defer stopControl()
+
+	// Unblock the receive call below, when the context is done. For example
+	// when the session of the user gets revoked.
+	go func() {
+		<-ctx.Done()
+		ws.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	subscriptions := make(map[string]*wsSubscription)
+	defer func() {
+		for _, sub := range subscriptions {
+			sub.cancel()
+		}
+	}()
+
+	for {
+		var request wsRequest
+		if err := websocket.JSON.Receive(ws, &request); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				if err := conn.sendError("", invalidRequestError{fmt.Errorf("decoding message: %w", err)}); err != nil {
+					return fmt.Errorf("sending error: %w", err)
+				}
+				continue
+			}
+
+			if oserror.ContextDone(err) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return fmt.Errorf("receiving message: %w", err)
+		}
+
+		if request.ID == "" {
+			if err := conn.sendError("", invalidRequestError{fmt.Errorf("message needs an id")}); err != nil {
+				return fmt.Errorf("sending error: %w", err)
+			}
+			continue
+		}
+
+		switch request.Type {
+		case "subscribe":
+			if sub, ok := subscriptions[request.ID]; ok {
+				sub.cancel()
+				delete(subscriptions, request.ID)
+			}
+
+			builder, err := keysbuilder.ManyFromJSON(bytes.NewReader(request.Body))
+			if err != nil {
+				if err := conn.sendError(request.ID, fmt.Errorf("building keysbuilder: %w", err)); err != nil {
+					return fmt.Errorf("sending error: %w", err)
+				}
+				continue
+			}
+
+			subCtx, cancelSub := context.WithCancel(oserror.ContextWithBody(ctx, string(request.Body)))
+			sub := &wsSubscription{
+				cancel:  cancelSub,
+				builder: builder,
+				updates: make(chan autoupdate.KeysBuilder, 1),
+			}
+			subscriptions[request.ID] = sub
+
+			if request.Position != 0 {
+				sub.steps = make(chan int, 10)
+			}
+
+			wg.Add(1)
+			go func(id string, position int, steps <-chan int) {
+				defer wg.Done()
+
+				if err := subscribe(subCtx, conn, id, uid, builder, sub.updates, connecter, position, steps); err != nil {
+					if err := conn.sendError(id, err); err != nil {
+						// The connection is broken. Close it, so the receive
+						// loop returns.
+						cancel()
+					}
+				}
+			}(request.ID, request.Position, sub.steps)
+
+		case "step", "live":
+			sub, ok := subscriptions[request.ID]
+			if !ok || sub.steps == nil {
+				if err := conn.sendError(request.ID, invalidRequestError{fmt.Errorf("no playback with id %q", request.ID)}); err != nil {
+					return fmt.Errorf("sending error: %w", err)
+				}
+				continue
+			}
+
+			step := 1
+			if request.Type == "live" {
+				step = 0
+			}
+
+			select {
+			case sub.steps <- step:
+			default:
+				if err := conn.sendError(request.ID, invalidRequestError{fmt.Errorf("too many steps for playback %q", request.ID)}); err != nil {
+					return fmt.Errorf("sending error: %w", err)
+				}
+			}
+
+		case "modify", "extend":
+			sub, ok := subscriptions[request.ID]
+			if !ok {
+				if err := conn.sendError(request.ID, invalidRequestError{fmt.Errorf("unknown subscription %q", request.ID)}); err != nil {
+					return fmt.Errorf("sending error: %w", err)
+				}
+				continue
+			}
+
+			builder, err := keysbuilder.ManyFromJSON(bytes.NewReader(request.Body))
+			if err != nil {
+				if err := conn.sendError(request.ID, fmt.Errorf("building keysbuilder: %w", err)); err != nil {
+					return fmt.Errorf("sending error: %w", err)
+				}
+				continue
+			}
+
+			if request.Type == "extend" {
+				builder = keysbuilder.FromBuilders(sub.builder, builder)
+			}
+
+			sub.setBuilder(builder)
+
+		case "unsubscribe":
+			if sub, ok := subscriptions[request.ID]; ok {
+				sub.cancel()
+				delete(subscriptions, request.ID)
+			}
+
+		default:
+			if err := conn.sendError(request.ID, invalidRequestError{fmt.Errorf("unknown message type %q", request.Type)}); err != nil {
+				return fmt.Errorf("sending error: %w", err)
+			}
+		}
+	}
+}
+
+// subscribe sends the data for one subscription to the client.
+//
+// If position is not zero, the subscription replays the history from this
+// position. It is moved forward by the values from steps.
+//
+// Blocks until the context is done.
+func subscribe(ctx context.Context, conn *wsConn, id string, uid int, kb *keysbuilder.Builder, updates <-chan autoupdate.KeysBuilder, connecter Connecter, position int, steps <-chan int) error {
+	options := []autoupdate.ConnectOption{autoupdate.WithKeysBuilderUpdates(updates)}
+
+	var messagePosition int
+	if position != 0 {
+		options = append(
+			options,
+			autoupdate.WithPlayback(position, steps),
+			autoupdate.WithUpdateID(func(updateID datastore.UpdateID) { messagePosition = updateID.Position }),
+		)
+	}
+
+	next, err := connecter.Connect(ctx, uid, kb, options...)
+	if err != nil {
+		return fmt.Errorf("getting connection: %w", err)
+	}
+
+	for f, ok := next(); ok; f, ok = next() {
+		data, err := f(ctx)
+		if err != nil {
+			return fmt.Errorf("getting next message: %w", err)
+		}
+
+		if err := conn.send(wsResponse{ID: id, Data: convertData(data), Position: messagePosition}); err != nil {
+			return fmt.Errorf("sending data: %w", err)
+		}
+	}
+	return ctx.Err()
+}
+
+// convertData converts the data from the autoupdate service to a map, that
+// can be encoded to json.
+func convertData(data map[dskey.Key][]byte) map[string]json.RawMessage {
+	converted := make(map[string]json.RawMessage, len(data))
+	for k, v := range data {
+		converted[k.String()] = v
+	}
+	return converted
+}
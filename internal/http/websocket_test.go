@@ -0,0 +1,200 @@
+package http_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
+	ahttp "github.com/OpenSlides/openslides-autoupdate-service/internal/http"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"golang.org/x/net/websocket"
+)
+
+func TestWebsocket(t *testing.T) {
+	connecter := new(onceConnecter)
+
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdateWebsocket(mux, fakeAuth(1), connecter, nil, nil)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/system/autoupdate/ws", "", srv.URL)
+	if err != nil {
+		t.Fatalf("dial websocket: %v", err)
+	}
+	defer ws.Close()
+
+	receive := func() string {
+		var msg string
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			t.Fatalf("receiving message: %v", err)
+		}
+		return msg
+	}
+
+	t.Run("subscribe", func(t *testing.T) {
+		websocket.Message.Send(ws, `{"type":"subscribe","id":"first","body":[{"ids":[1],"collection":"user","fields":{"name":null}}]}`)
+
+		expect := `{"id":"first","data":{"collection/1/field":"bar"}}`
+		if got := receive(); got != expect {
+			t.Errorf("got `%s`, expected `%s`", got, expect)
+		}
+	})
+
+	t.Run("second subscription", func(t *testing.T) {
+		websocket.Message.Send(ws, `{"type":"subscribe","id":"second","body":[{"ids":[1],"collection":"user","fields":{"name":null}}]}`)
+
+		expect := `{"id":"second","data":{"collection/1/field":"bar"}}`
+		if got := receive(); got != expect {
+			t.Errorf("got `%s`, expected `%s`", got, expect)
+		}
+	})
+
+	t.Run("invalid body", func(t *testing.T) {
+		websocket.Message.Send(ws, `{"type":"subscribe","id":"third","body":[]}`)
+
+		expect := `{"id":"third","error":{"type":"SyntaxError","msg":"No data"}}`
+		if got := receive(); got != expect {
+			t.Errorf("got `%s`, expected `%s`", got, expect)
+		}
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		websocket.Message.Send(ws, `{"type":"foo","id":"first"}`)
+
+		expect := `{"id":"first","error":{"type":"invalid_request","msg":"Invalid request: unknown message type \"foo\""}}`
+		if got := receive(); got != expect {
+			t.Errorf("got `%s`, expected `%s`", got, expect)
+		}
+	})
+
+	t.Run("modify unknown subscription", func(t *testing.T) {
+		websocket.Message.Send(ws, `{"type":"modify","id":"unknown","body":[{"ids":[1],"collection":"user","fields":{"name":null}}]}`)
+
+		expect := `{"id":"unknown","error":{"type":"invalid_request","msg":"Invalid request: unknown subscription \"unknown\""}}`
+		if got := receive(); got != expect {
+			t.Errorf("got `%s`, expected `%s`", got, expect)
+		}
+	})
+
+	t.Run("step without playback", func(t *testing.T) {
+		websocket.Message.Send(ws, `{"type":"step","id":"first"}`)
+
+		expect := `{"id":"first","error":{"type":"invalid_request","msg":"Invalid request: no playback with id \"first\""}}`
+		if got := receive(); got != expect {
+			t.Errorf("got `%s`, expected `%s`", got, expect)
+		}
+	})
+
+	t.Run("unsubscribe and subscribe again", func(t *testing.T) {
+		websocket.Message.Send(ws, `{"type":"unsubscribe","id":"second"}`)
+		websocket.Message.Send(ws, `{"type":"subscribe","id":"second","body":[{"ids":[1],"collection":"user","fields":{"name":null}}]}`)
+
+		expect := `{"id":"second","data":{"collection/1/field":"bar"}}`
+		if got := receive(); got != expect {
+			t.Errorf("got `%s`, expected `%s`", got, expect)
+		}
+	})
+}
+
+// onceConnecter is a Connecter where each connection returns one message and
+// then blocks until the context is done.
+type onceConnecter struct{}
+
+func (c *onceConnecter) Connect(ctx context.Context, userID int, kb autoupdate.KeysBuilder, options ...autoupdate.ConnectOption) (autoupdate.DataProvider, error) {
+	first := true
+	f := func(ctx context.Context) (map[dskey.Key][]byte, error) {
+		if first {
+			first = false
+			return map[dskey.Key][]byte{myKey1: []byte(`"bar"`)}, nil
+		}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	return func() (func(ctx context.Context) (map[dskey.Key][]byte, error), bool) { return f, true }, nil
+}
+
+func (c *onceConnecter) SingleData(ctx context.Context, userID int, kb autoupdate.KeysBuilder, position int) (map[dskey.Key][]byte, error) {
+	return map[dskey.Key][]byte{myKey1: []byte(`"bar"`)}, nil
+}
+
+func (c *onceConnecter) LastUpdateID() datastore.UpdateID {
+	return datastore.UpdateID{}
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdateWebsocket(mux, fakeAuth(1), new(onceConnecter), nil, nil)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/system/autoupdate/ws"
+
+	t.Run("same host", func(t *testing.T) {
+		ws, err := websocket.Dial(url, "", srv.URL)
+		if err != nil {
+			t.Fatalf("dial websocket: %v", err)
+		}
+		ws.Close()
+	})
+
+	t.Run("other host", func(t *testing.T) {
+		ws, err := websocket.Dial(url, "", "https://attacker.example")
+		if err == nil {
+			ws.Close()
+			t.Fatalf("dial websocket from other origin succeeded")
+		}
+	})
+}
+
+// renewAuth is an Authenticater, that renews the token of each request.
+type renewAuth struct {
+	fakeAuth
+	token string
+}
+
+// Authenticate sets the renewed token.
+func (a renewAuth) Authenticate(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	w.Header().Set("Authentication", a.token)
+	return r.Context(), nil
+}
+
+func TestWebsocketTokenProtocol(t *testing.T) {
+	mux := http.NewServeMux()
+	ahttp.HandleAutoupdateWebsocket(mux, renewAuth{fakeAuth: 1, token: "bearer renewed"}, new(onceConnecter), nil, nil)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	req, err := http.NewRequest("GET", srv.URL+"/system/autoupdate/ws", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Protocol", "bearer.old")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("sending request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %s, expected %s", resp.Status, http.StatusText(http.StatusSwitchingProtocols))
+	}
+
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != "bearer.old" {
+		t.Errorf("got protocol %q, expected %q", got, "bearer.old")
+	}
+
+	if got := resp.Header.Get("Authentication"); got != "bearer renewed" {
+		t.Errorf("got renewed token %q, expected %q", got, "bearer renewed")
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
@@ -22,6 +25,19 @@ type Builder struct {
 	mu sync.Mutex
 
 	bodies []body
+
+	// relationLists are the keys from the last Update call, that are requested
+	// as relation-list or generic-relation-list.
+	relationLists map[dskey.Key]struct{}
+
+	// children are the sub edges of each edge from the last update. With them,
+	// UpdateChanged only has to fetch the changed parts of the tree.
+	children map[edge][]edge
+
+	// keys and expanded are the requested keys from the last update and the
+	// keys, that where used to find other keys.
+	keys     map[dskey.Key]struct{}
+	expanded map[dskey.Key]struct{}
 }
 
 // FromKeys creates a keysbuilder from a list of keys.
@@ -78,65 +94,266 @@ func (b *Builder) Update(ctx context.Context, getter datastore.Getter) ([]dskey.
 		return nil, nil
 	}
 
-	// Start with all keys from all the bodies.
+	b.children = nil
+	if err := b.build(ctx, getter, nil); err != nil {
+		return nil, err
+	}
+
+	keys := make([]dskey.Key, 0, len(b.keys))
+	for key := range b.keys {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// UpdateChanged is like Update, but only fetches the values of the keys in
+// changed and of keys, that where not requested on the last update. The other
+// parts of the tree are taken from the last update.
+//
+// It returns the keys, that are requested since the last update and the keys,
+// that are not requested anymore.
+//
+// The getter has to return the same values as on the last update for all keys,
+// that are not in changed.
+func (b *Builder) UpdateChanged(ctx context.Context, getter datastore.Getter, changed []dskey.Key) (added []dskey.Key, removed []dskey.Key, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.bodies) == 0 {
+		return nil, nil, nil
+	}
+
+	changedSet := make(map[dskey.Key]struct{}, len(changed))
+	for _, key := range changed {
+		changedSet[key] = struct{}{}
+	}
+
+	oldKeys := b.keys
+	if err := b.build(ctx, getter, changedSet); err != nil {
+		return nil, nil, err
+	}
+
+	for key := range b.keys {
+		if _, ok := oldKeys[key]; !ok {
+			added = append(added, key)
+		}
+	}
+
+	for key := range oldKeys {
+		if _, ok := b.keys[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	return added, removed, nil
+}
+
+// build travels the tree of requested keys starting from the bodies.
+//
+// The value of a key is only fetched, if it is in changed or if its sub keys
+// are not known from the last update. The state of the builder is only changed,
+// if build does not return an error.
+//
+// Has to be called with the lock.
+func (b *Builder) build(ctx context.Context, getter datastore.Getter, changed map[dskey.Key]struct{}) error {
 	process := make(map[dskey.Key]fieldDescription)
 	for _, body := range b.bodies {
 		body.keys(process)
 	}
+	queue := toEdges(process)
 
-	var keys []dskey.Key
+	visited := make(map[edge]struct{})
+	keys := make(map[dskey.Key]struct{})
+	expanded := make(map[dskey.Key]struct{})
+	relationLists := make(map[dskey.Key]struct{})
+	children := make(map[edge][]edge, len(b.children))
 
 	var needed []dskey.Key
-	processed := make(map[dskey.Key]fieldDescription)
-	for {
-		// Get all keys and descriptions
-		for key, description := range process {
-			keys = append(keys, key)
-			if description == nil {
+	for len(queue) > 0 {
+		var next []edge
+		var fetch []edge
+		for _, e := range queue {
+			if _, ok := visited[e]; ok {
 				continue
 			}
+			visited[e] = struct{}{}
+			keys[e.key] = struct{}{}
 
-			needed = append(needed, key)
-			processed[key] = description
+			if e.description == nil {
+				continue
+			}
+			expanded[e.key] = struct{}{}
+
+			switch e.description.(type) {
+			case *relationListField, *genericRelationListField:
+				relationLists[e.key] = struct{}{}
+			}
+
+			if sub, ok := b.children[e]; ok {
+				if _, isChanged := changed[e.key]; !isChanged {
+					children[e] = sub
+					next = append(next, sub...)
+					continue
+				}
+			}
+			fetch = append(fetch, e)
 		}
 
-		if len(needed) == 0 {
-			break
+		if len(fetch) > 0 {
+			needed = needed[:0]
+			for _, e := range fetch {
+				needed = append(needed, e.key)
+			}
+
+			// Get values for all special (not none) fields.
+			data, err := getter.Get(ctx, needed...)
+			if err != nil {
+				return fmt.Errorf("load needed keys: %w", err)
+			}
+
+			for _, e := range fetch {
+				sub, err := e.expand(data[e.key])
+				if err != nil {
+					return err
+				}
+				children[e] = sub
+				next = append(next, sub...)
+			}
 		}
 
-		// Get values for all special (not none) fields.
-		data, err := getter.Get(ctx, needed...)
-		if err != nil {
-			return nil, fmt.Errorf("load needed keys: %w", err)
+		queue = next
+	}
+
+	b.children = children
+	b.keys = keys
+	b.expanded = expanded
+	b.relationLists = relationLists
+	return nil
+}
+
+// edge is a requested key together with the description, how its value is
+// used to find other keys.
+type edge struct {
+	key         dskey.Key
+	description fieldDescription
+}
+
+// expand returns the edges, that are requested by the value of the edge.
+func (e edge) expand(value []byte) ([]edge, error) {
+	// This are fields that do not exist or the user has not the permission to
+	// see them.
+	if value == nil {
+		return nil, nil
+	}
+
+	process := make(map[dskey.Key]fieldDescription)
+	if err := e.description.keys(e.key, value, process); err != nil {
+		var invalidErr *json.UnmarshalTypeError
+		if errors.As(err, &invalidErr) {
+			// value has wrong type.
+			return nil, ValueError{key: e.key, gotType: invalidErr.Value, expectType: invalidErr.Type, err: err}
 		}
+		return nil, err
+	}
+	return toEdges(process), nil
+}
+
+func toEdges(process map[dskey.Key]fieldDescription) []edge {
+	edges := make([]edge, 0, len(process))
+	for key, description := range process {
+		edges = append(edges, edge{key: key, description: description})
+	}
+	return edges
+}
+
+// Expands returns true, if the value of the key was used to find other keys on
+// the last update.
+func (b *Builder) Expands(key dskey.Key) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.expanded[key]
+	return ok
+}
 
-		// Clear process and needed without freeing the memory.
-		needed = needed[:0]
-		for k := range process {
-			delete(process, k)
+// IsRelationList returns true, if the key was requested as relation-list or
+// generic-relation-list on the last call to Update.
+func (b *Builder) IsRelationList(key dskey.Key) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.relationLists[key]
+	return ok
+}
+
+// Fingerprint returns a string, that is the same for two builders, that
+// request the same keys.
+//
+// The order of ids and fields does not change the fingerprint.
+func (b *Builder) Fingerprint() string {
+	var sb strings.Builder
+	for i, body := range b.bodies {
+		if i > 0 {
+			sb.WriteByte(';')
 		}
 
-		for key, description := range processed {
-			// This are fields that do not exist or the user has not the
-			// permission to see them.
-			if data[key] == nil {
-				continue
-			}
+		ids := make([]int, len(body.ids))
+		copy(ids, body.ids)
+		sort.Ints(ids)
 
-			if err := description.keys(key, data[key], process); err != nil {
-				var invalidErr *json.UnmarshalTypeError
-				if errors.As(err, &invalidErr) {
-					// value has wrong type.
-					return nil, ValueError{key: key, gotType: invalidErr.Value, expectType: invalidErr.Type, err: err}
-				}
-				return nil, err
+		sb.WriteString(body.collection)
+		sb.WriteByte('[')
+		for j, id := range ids {
+			if j > 0 {
+				sb.WriteByte(',')
 			}
+			sb.WriteString(strconv.Itoa(id))
 		}
+		sb.WriteByte(']')
+		writeFieldsFingerprint(&sb, body.fieldsMap)
+	}
+	return sb.String()
+}
 
-		// Clear processed.
-		for k := range processed {
-			delete(processed, k)
+func writeFieldsFingerprint(sb *strings.Builder, fm fieldsMap) {
+	names := make([]string, 0, len(fm.fields))
+	for name := range fm.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
 		}
+		sb.WriteString(name)
+		writeFieldFingerprint(sb, fm.fields[name])
+	}
+	sb.WriteByte('}')
+}
+
+func writeFieldFingerprint(sb *strings.Builder, description fieldDescription) {
+	switch d := description.(type) {
+	case *relationField:
+		sb.WriteString(":" + ftRelation + "(" + d.collection + ")")
+		writeFieldsFingerprint(sb, d.fieldsMap)
+
+	case *relationListField:
+		sb.WriteString(":" + ftRelationList + "(" + d.collection + ")")
+		writeFieldsFingerprint(sb, d.fieldsMap)
+
+	case *genericRelationField:
+		sb.WriteString(":" + ftGenericRelation)
+		writeFieldsFingerprint(sb, d.fieldsMap)
+
+	case *genericRelationListField:
+		sb.WriteString(":" + ftGenericRelationList)
+		writeFieldsFingerprint(sb, d.fieldsMap)
+
+	case *templateField:
+		sb.WriteString(":" + ftTemplate + "(")
+		writeFieldFingerprint(sb, d.values)
+		sb.WriteByte(')')
 	}
-	return keys, nil
 }
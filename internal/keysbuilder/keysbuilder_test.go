@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/keysbuilder"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dsmock"
 )
@@ -463,6 +464,180 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+// recordGetter records the requested keys.
+type recordGetter struct {
+	getter    datastore.Getter
+	requested []dskey.Key
+}
+
+func (r *recordGetter) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	r.requested = append(r.requested, keys...)
+	return r.getter.Get(ctx, keys...)
+}
+
+func TestUpdateChanged(t *testing.T) {
+	ctx := context.Background()
+	json := `{
+		"ids": [1],
+		"collection": "user",
+		"fields": {
+			"group_ids": {
+				"type": "relation-list",
+				"collection": "group",
+				"fields": {
+					"perm_ids": {
+						"type": "relation-list",
+						"collection": "perm",
+						"fields": {"name": null}
+					}
+				}
+			}
+		}
+	}`
+	b, err := keysbuilder.FromJSON(strings.NewReader(json))
+	if err != nil {
+		t.Fatalf("FromJSON returned unexpected error: %v", err)
+	}
+
+	ds := dsmock.Stub(dsmock.YAMLData(`---
+	user/1/group_ids: [1, 2]
+	group/1/perm_ids: [1]
+	group/2/perm_ids: [2]
+	`))
+
+	if _, err := b.Update(ctx, ds); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	// group/1/perm_ids changed, but it is not in changed, so the builder
+	// does not see it.
+	getter := &recordGetter{getter: dsmock.Stub(dsmock.YAMLData(`---
+	user/1/group_ids: [2, 3]
+	group/1/perm_ids: [4]
+	group/2/perm_ids: [2]
+	group/3/perm_ids: [3]
+	`))}
+
+	added, removed, err := b.UpdateChanged(ctx, getter, mustKeys("user/1/group_ids"))
+	if err != nil {
+		t.Fatalf("UpdateChanged: %v", err)
+	}
+
+	if diff := cmpSet(set(mustKeys("group/3/perm_ids", "perm/3/name")...), set(added...)); diff != nil {
+		t.Errorf("wrong added keys: %v", diff)
+	}
+
+	if diff := cmpSet(set(mustKeys("group/1/perm_ids", "perm/1/name")...), set(removed...)); diff != nil {
+		t.Errorf("wrong removed keys: %v", diff)
+	}
+
+	if diff := cmpSet(set(mustKeys("user/1/group_ids", "group/3/perm_ids")...), set(getter.requested...)); diff != nil {
+		t.Errorf("wrong requested keys: %v", diff)
+	}
+
+	t.Run("no change", func(t *testing.T) {
+		getter.requested = nil
+		added, removed, err := b.UpdateChanged(ctx, getter, nil)
+		if err != nil {
+			t.Fatalf("UpdateChanged: %v", err)
+		}
+
+		if len(added) != 0 || len(removed) != 0 || len(getter.requested) != 0 {
+			t.Errorf("got added %v, removed %v and requested %v, expected nothing", added, removed, getter.requested)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		json := `{
+			"ids": [1],
+			"collection": "meeting",
+			"fields": {
+				"motion_ids": {
+					"type": "relation-list",
+					"collection": "motion",
+					"fields": {
+						"amendment_ids": {
+							"type": "relation-list",
+							"collection": "motion",
+							"fields": {"title": null}
+						}
+					}
+				}
+			}
+		}`
+		b, err := keysbuilder.FromJSON(strings.NewReader(json))
+		if err != nil {
+			t.Fatalf("FromJSON returned unexpected error: %v", err)
+		}
+
+		if _, err := b.Update(ctx, dsmock.Stub(dsmock.YAMLData(`---
+		meeting/1/motion_ids: [1, 2]
+		motion/1/amendment_ids: [2]
+		motion/2/amendment_ids: [1]
+		`))); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+
+		added, removed, err := b.UpdateChanged(ctx, dsmock.Stub(dsmock.YAMLData(`---
+		meeting/1/motion_ids: []
+		motion/1/amendment_ids: [2]
+		motion/2/amendment_ids: [1]
+		`)), mustKeys("meeting/1/motion_ids"))
+		if err != nil {
+			t.Fatalf("UpdateChanged: %v", err)
+		}
+
+		if len(added) != 0 {
+			t.Errorf("got added keys %v, expected none", added)
+		}
+
+		expect := mustKeys("motion/1/amendment_ids", "motion/2/amendment_ids", "motion/1/title", "motion/2/title")
+		if diff := cmpSet(set(expect...), set(removed...)); diff != nil {
+			t.Errorf("wrong removed keys: %v", diff)
+		}
+	})
+}
+
+func TestExpands(t *testing.T) {
+	ds := dsmock.Stub(dsmock.YAMLData(`---
+	user/1/note_id: 1
+	`))
+
+	json := `{
+		"ids": [1],
+		"collection": "user",
+		"fields": {
+			"name": null,
+			"note_id": {
+				"type": "relation",
+				"collection": "note",
+				"fields": {"important": null}
+			}
+		}
+	}`
+	b, err := keysbuilder.FromJSON(strings.NewReader(json))
+	if err != nil {
+		t.Fatalf("FromJSON returned unexpected error: %v", err)
+	}
+
+	if _, err := b.Update(context.Background(), ds); err != nil {
+		t.Fatalf("Building keys: %v", err)
+	}
+
+	for _, tt := range []struct {
+		key    string
+		expect bool
+	}{
+		{"user/1/name", false},
+		{"user/1/note_id", true},
+		{"note/1/important", false},
+	} {
+		if got := b.Expands(dskey.MustKey(tt.key)); got != tt.expect {
+			t.Errorf("Expands(%s) returned %t, expected %t", tt.key, got, tt.expect)
+		}
+	}
+}
+
 func TestConcurency(t *testing.T) {
 	jsonData := `
 	{
@@ -635,3 +810,123 @@ func TestRequestCount(t *testing.T) {
 		t.Errorf("Updated() did %d requests, expected 1", got)
 	}
 }
+
+func TestIsRelationList(t *testing.T) {
+	ds := dsmock.Stub(dsmock.YAMLData(`---
+	user/1/note_id: 1
+	user/1/group_ids: [1]
+	user/1/seen: ["note/1"]
+	user/1/group_$_ids: ["2"]
+	`))
+
+	json := `{
+		"ids": [1],
+		"collection": "user",
+		"fields": {
+			"name": null,
+			"note_id": {
+				"type": "relation",
+				"collection": "note",
+				"fields": {"important": null}
+			},
+			"group_ids": {
+				"type": "relation-list",
+				"collection": "group",
+				"fields": {"name": null}
+			},
+			"seen": {
+				"type": "generic-relation-list",
+				"fields": {"name": null}
+			},
+			"group_$_ids": {
+				"type": "template",
+				"values": {
+					"type": "relation-list",
+					"collection": "group",
+					"fields": {"name": null}
+				}
+			}
+		}
+	}`
+	b, err := keysbuilder.FromJSON(strings.NewReader(json))
+	if err != nil {
+		t.Fatalf("FromJSON returned unexpected error: %v", err)
+	}
+
+	if _, err := b.Update(context.Background(), ds); err != nil {
+		t.Fatalf("Building keys: %v", err)
+	}
+
+	for _, tt := range []struct {
+		key    string
+		expect bool
+	}{
+		{"user/1/name", false},
+		{"user/1/note_id", false},
+		{"user/1/group_ids", true},
+		{"user/1/seen", true},
+		{"user/1/group_$_ids", false},
+		{"user/1/group_$2_ids", true},
+		{"group/1/name", false},
+	} {
+		if got := b.IsRelationList(dskey.MustKey(tt.key)); got != tt.expect {
+			t.Errorf("IsRelationList(%s) returned %t, expected %t", tt.key, got, tt.expect)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		a      string
+		b      string
+		expect bool
+	}{
+		{
+			"same",
+			`{"ids":[1],"collection":"user","fields":{"name":null}}`,
+			`{"ids":[1],"collection":"user","fields":{"name":null}}`,
+			true,
+		},
+		{
+			"different order",
+			`{"ids":[1,2],"collection":"user","fields":{"name":null,"email":null}}`,
+			`{"ids":[2,1],"collection":"user","fields":{"email":null,"name":null}}`,
+			true,
+		},
+		{
+			"different ids",
+			`{"ids":[1],"collection":"user","fields":{"name":null}}`,
+			`{"ids":[2],"collection":"user","fields":{"name":null}}`,
+			false,
+		},
+		{
+			"relation and relation-list",
+			`{"ids":[1],"collection":"user","fields":{"note_id":{"type":"relation","collection":"note","fields":{"text":null}}}}`,
+			`{"ids":[1],"collection":"user","fields":{"note_id":{"type":"relation-list","collection":"note","fields":{"text":null}}}}`,
+			false,
+		},
+		{
+			"template",
+			`{"ids":[1],"collection":"user","fields":{"group_$_ids":{"type":"template","values":{"type":"relation-list","collection":"group","fields":{"name":null}}}}}`,
+			`{"ids":[1],"collection":"user","fields":{"group_$_ids":{"type":"template"}}}`,
+			false,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := keysbuilder.FromJSON(strings.NewReader(tt.a))
+			if err != nil {
+				t.Fatalf("creating keysbuilder a: %v", err)
+			}
+
+			b, err := keysbuilder.FromJSON(strings.NewReader(tt.b))
+			if err != nil {
+				t.Fatalf("creating keysbuilder b: %v", err)
+			}
+
+			if got := a.Fingerprint() == b.Fingerprint(); got != tt.expect {
+				t.Errorf("got equal fingerprints %t (`%s` and `%s`), expected %t", got, a.Fingerprint(), b.Fingerprint(), tt.expect)
+			}
+		})
+	}
+}
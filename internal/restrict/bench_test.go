@@ -74,6 +74,69 @@ func BenchmarkRelationFields(b *testing.B) {
 	}
 }
 
+func BenchmarkGetChanged(b *testing.B) {
+	db, err := initDB(db)
+	if err != nil {
+		b.Fatalf("init db: %v", err)
+	}
+
+	request := `[{"collection":"meeting","ids":[2],"fields":{"id":null,"agenda_item_ids":{"type":"relation-list","collection":"agenda_item","fields":{"item_number":null,"comment":null,"closed":null,"type":null,"is_hidden":null,"is_internal":null,"duration":null,"weight":null,"level":null,"parent_id":null,"child_ids":null,"meeting_id":null,"tag_ids":null,"content_object_id":null,"id":null}},"speaker_ids":{"type":"relation-list","collection":"speaker","fields":{"begin_time":null,"end_time":null,"point_of_order":null,"speech_state":null,"weight":null,"note":null,"user_id":null,"id":null}},"list_of_speakers_ids":{"type":"relation-list","collection":"list_of_speakers","fields":{"closed":null,"content_object_id":null,"speaker_ids":null,"id":null}}}}]`
+
+	kb, err := keysbuilder.ManyFromJSON(strings.NewReader(request))
+	if err != nil {
+		b.Fatalf("loading request: %v", err)
+	}
+
+	ctx, getter := restrict.Middleware(context.Background(), db, 4)
+	keys, err := kb.Update(ctx, getter)
+	if err != nil {
+		b.Fatalf("updateing keysbuilder: %v", err)
+	}
+
+	b.Run("Get", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			ctx, getter := restrict.Middleware(context.Background(), db, 4)
+			if _, err := getter.Get(ctx, keys...); err != nil {
+				b.Fatalf("getting keys: %v", err)
+			}
+		}
+	})
+
+	b.Run("first call", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			var state restrict.State
+			ctx, getter := restrict.Middleware(context.Background(), db, 4)
+			if _, err := getter.(changedGetter).GetChanged(ctx, &state, nil, keys...); err != nil {
+				b.Fatalf("getting keys: %v", err)
+			}
+		}
+	})
+
+	b.Run("one changed key", func(b *testing.B) {
+		var state restrict.State
+		ctx, getter := restrict.Middleware(context.Background(), db, 4)
+		if _, err := getter.(changedGetter).GetChanged(ctx, &state, nil, keys...); err != nil {
+			b.Fatalf("getting keys: %v", err)
+		}
+
+		var changed []dskey.Key
+		for _, key := range keys {
+			if key.Collection == "agenda_item" && key.Field == "comment" {
+				changed = append(changed, key)
+				break
+			}
+		}
+
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			ctx, getter := restrict.Middleware(context.Background(), db, 4)
+			if _, err := getter.(changedGetter).GetChanged(ctx, &state, changed, keys...); err != nil {
+				b.Fatalf("getting keys: %v", err)
+			}
+		}
+	})
+}
+
 func initDB(in string) (datastore.Getter, error) {
 	var raw map[string]json.RawMessage
 	if err := json.Unmarshal([]byte(in), &raw); err != nil {
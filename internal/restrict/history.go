@@ -2,6 +2,7 @@ package restrict
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/restrict/collection"
@@ -18,11 +19,22 @@ type History struct {
 	userID        int
 	currentGetter datastore.Getter
 	oldGetter     datastore.Getter
+	regular       bool
 }
 
 // NewHistory initializes a History object.
 func NewHistory(current datastore.Getter, old datastore.Getter, userID int) History {
-	return History{userID, current, old}
+	return History{userID: userID, currentGetter: current, oldGetter: old}
+}
+
+// NewHistoryRestricted is like NewHistory, but also lets users with the
+// permission meeting.can_see_history see the history of there meetings.
+//
+// For this users, the keys are restricted with the normal restriction rules
+// at the old position. So they see, what they could see at the time. The
+// permission meeting.can_see_history is checked with the current data.
+func NewHistoryRestricted(current datastore.Getter, old datastore.Getter, userID int) History {
+	return History{userID: userID, currentGetter: current, oldGetter: old, regular: true}
 }
 
 // Get returns the keys the user can see.
@@ -49,6 +61,7 @@ func (h History) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]by
 	}
 
 	adminInMeeting := make(map[int]struct{}, len(requestUserMeetingIDs))
+	historyInMeeting := make(map[int]struct{}, len(requestUserMeetingIDs))
 	for _, meetingID := range requestUserMeetingIDs {
 		p, err := perm.FromContext(ctx, meetingID)
 		if err != nil {
@@ -58,13 +71,18 @@ func (h History) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]by
 		if p.IsAdmin() {
 			adminInMeeting[meetingID] = struct{}{}
 		}
+
+		if h.regular && p.Has(perm.MeetingCanSeeHistory) {
+			historyInMeeting[meetingID] = struct{}{}
+		}
 	}
 
-	if len(adminInMeeting) == 0 && !orgaManager {
+	if len(adminInMeeting) == 0 && len(historyInMeeting) == 0 && !orgaManager {
 		return nil, nil
 	}
 
 	allowedKeys := make([]dskey.Key, 0, len(keys))
+	var regularKeys []dskey.Key
 
 	for _, key := range keys {
 		canSee, err := h.canSeeKey(ctx, oldDS, currentDS, orgaManager, adminInMeeting, key)
@@ -74,6 +92,20 @@ func (h History) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]by
 
 		if canSee {
 			allowedKeys = append(allowedKeys, key)
+			continue
+		}
+
+		if len(historyInMeeting) == 0 {
+			continue
+		}
+
+		restricted, err := h.restrictRegular(ctx, oldDS, historyInMeeting, key)
+		if err != nil {
+			return nil, fmt.Errorf("checking key %s for regular restriction: %w", key, err)
+		}
+
+		if restricted {
+			regularKeys = append(regularKeys, key)
 		}
 	}
 
@@ -81,6 +113,83 @@ func (h History) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]by
 	if err != nil {
 		return nil, fmt.Errorf("get data from history getter: %w", err)
 	}
+
+	if len(regularKeys) == 0 {
+		return data, nil
+	}
+
+	regularData, err := h.regularData(ctx, oldDS, regularKeys)
+	if err != nil {
+		return nil, fmt.Errorf("get regular restricted data: %w", err)
+	}
+
+	if data == nil {
+		data = make(map[dskey.Key][]byte, len(regularData))
+	}
+
+	for key, value := range regularData {
+		data[key] = value
+	}
+	return data, nil
+}
+
+// restrictRegular returns true, if the key should be restricted with the
+// normal restriction rules.
+//
+// This are the keys of meetings, where the user has the permission
+// meeting.can_see_history and all keys, that do not belong to a meeting.
+func (h History) restrictRegular(ctx context.Context, oldDS *dsfetch.Fetch, historyInMeeting map[int]struct{}, key dskey.Key) (bool, error) {
+	if key.Collection == "user" && key.Field == "password" {
+		return false, nil
+	}
+
+	if key.Collection == "personal_note" {
+		// Personal notes are already checked in canSeeKey.
+		return false, nil
+	}
+
+	restricter := collection.Collection(ctx, key.Collection)
+	if _, ok := restricter.(collection.Unknown); ok {
+		return false, nil
+	}
+
+	meetingID, hasMeeting, err := restricter.MeetingID(ctx, oldDS, key.ID)
+	if err != nil {
+		var errDoesNotExist dsfetch.DoesNotExistError
+		if errors.As(err, &errDoesNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("getting meeting id: %w", err)
+	}
+
+	if !hasMeeting {
+		return true, nil
+	}
+
+	_, ok := historyInMeeting[meetingID]
+	return ok, nil
+}
+
+// regularData returns the keys restricted with the normal restriction rules
+// at the old position.
+//
+// The permissions of the user are also calculated at the old position. If the
+// user did not exist at this time, nothing is returned.
+func (h History) regularData(ctx context.Context, oldDS *dsfetch.Fetch, keys []dskey.Key) (map[dskey.Key][]byte, error) {
+	if _, err := oldDS.User_ID(h.userID).Value(ctx); err != nil {
+		var errDoesNotExist dsfetch.DoesNotExistError
+		if errors.As(err, &errDoesNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("checking request user at old position: %w", err)
+	}
+
+	ctx, restricter := Middleware(ctx, h.oldGetter, h.userID)
+
+	data, err := restricter.Get(ctx, keys...)
+	if err != nil {
+		return nil, fmt.Errorf("restricting data: %w", err)
+	}
 	return data, nil
 }
 
@@ -119,6 +228,11 @@ func (h History) canSeeKey(
 
 	meetingID, hasMeeting, err := collection.Collection(ctx, key.Collection).MeetingID(ctx, oldDS, key.ID)
 	if err != nil {
+		var errDoesNotExist dsfetch.DoesNotExistError
+		if errors.As(err, &errDoesNotExist) {
+			// The object did not exist at the old position.
+			return false, nil
+		}
 		return false, fmt.Errorf("getting meeting id: %w", err)
 	}
 
@@ -2,6 +2,7 @@ package restrict_test
 
 import (
 	"context"
+	"fmt"
 	"testing"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/restrict"
@@ -194,3 +195,136 @@ func TestHistoryGetter(t *testing.T) {
 		})
 	}
 }
+
+func TestHistoryRestricted(t *testing.T) {
+	ctx := context.Background()
+
+	member := `---
+			user/1:
+				group_$2_ids: [3]
+				meeting_ids: [2]
+			group/3/permissions: [%s]
+			meeting/2/admin_group_id: 4
+			`
+
+	for _, tt := range []struct {
+		name         string
+		current      string
+		old          string
+		testKey      string
+		expectCanSee bool
+	}{
+		{
+			"permission at the time",
+			fmt.Sprintf(member, "meeting.can_see_history"),
+			fmt.Sprintf(member, "agenda_item.can_see") + `
+			topic/5:
+				meeting_id: 2
+				title: foo
+			`,
+			"topic/5/title",
+			true,
+		},
+		{
+			"no permission at the time",
+			fmt.Sprintf(member, "meeting.can_see_history"),
+			fmt.Sprintf(member, "") + `
+			topic/5:
+				meeting_id: 2
+				title: foo
+			`,
+			"topic/5/title",
+			false,
+		},
+		{
+			"no history permission",
+			fmt.Sprintf(member, "agenda_item.can_see"),
+			fmt.Sprintf(member, "agenda_item.can_see") + `
+			topic/5:
+				meeting_id: 2
+				title: foo
+			`,
+			"topic/5/title",
+			false,
+		},
+		{
+			"other meeting",
+			fmt.Sprintf(member, "meeting.can_see_history"),
+			fmt.Sprintf(member, "agenda_item.can_see") + `
+			topic/5:
+				meeting_id: 404
+				title: foo
+			`,
+			"topic/5/title",
+			false,
+		},
+		{
+			"user did not exist",
+			fmt.Sprintf(member, "meeting.can_see_history"),
+			`---
+			topic/5:
+				meeting_id: 2
+				title: foo
+			`,
+			"topic/5/title",
+			false,
+		},
+		{
+			"object did not exist",
+			fmt.Sprintf(member, "meeting.can_see_history"),
+			fmt.Sprintf(member, "agenda_item.can_see"),
+			"topic/5/title",
+			false,
+		},
+		{
+			"password field",
+			fmt.Sprintf(member, "meeting.can_see_history"),
+			fmt.Sprintf(member, "agenda_item.can_see") + `
+			user/1/password: secret
+			`,
+			"user/1/password",
+			false,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			currentDS := dsmock.Stub(dsmock.YAMLData(tt.current))
+			oldDS := dsmock.Stub(dsmock.YAMLData(tt.old))
+			history := restrict.NewHistoryRestricted(currentDS, oldDS, 1)
+
+			key := dskey.MustKey(tt.testKey)
+
+			got, err := history.Get(ctx, key)
+			if err != nil {
+				t.Fatalf("Get returned: %v", err)
+			}
+
+			if tt.expectCanSee && got[key] == nil {
+				t.Errorf("history.Get() did not return %v", tt.testKey)
+			}
+
+			if !tt.expectCanSee && got[key] != nil {
+				t.Errorf("history.Get() did return %v", tt.testKey)
+			}
+		})
+	}
+
+	t.Run("admin mode", func(t *testing.T) {
+		currentDS := dsmock.Stub(dsmock.YAMLData(fmt.Sprintf(member, "meeting.can_see_history")))
+		oldDS := dsmock.Stub(dsmock.YAMLData(fmt.Sprintf(member, "agenda_item.can_see") + `
+			topic/5:
+				meeting_id: 2
+				title: foo
+			`))
+		history := restrict.NewHistory(currentDS, oldDS, 1)
+
+		key := dskey.MustKey("topic/5/title")
+		got, err := history.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get returned: %v", err)
+		}
+
+		if got[key] != nil {
+			t.Errorf("history.Get() did return %v", key)
+		}
+	})
+}
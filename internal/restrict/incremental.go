@@ -0,0 +1,336 @@
+package restrict
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/oserror"
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/restrict/collection"
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/restrict/perm"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dsfetch"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/set"
+)
+
+// State is the result of the last restriction of a client. With it, GetChanged
+// only has to restrict the parts of the data, that depend on changed keys.
+//
+// A State is not save for concurrent use. The zero value is ready to use.
+type State struct {
+	uid   int
+	valid bool
+
+	// values are the unrestricted values of the requested keys.
+	values map[dskey.Key][]byte
+
+	// superAdmin is the result of the superadmin check and superAdminDeps
+	// are the keys it depends on.
+	superAdmin     bool
+	superAdminDeps reads
+
+	decisions map[collection.CM]*decision
+}
+
+// decision is the result of a restriction mode for some ids.
+type decision struct {
+	ids     *set.Set[int]
+	allowed *set.Set[int]
+
+	// deps are the keys, that where read to calculate the decision. There is
+	// one entry for each call, that added ids to the decision.
+	deps []reads
+}
+
+// AddKeys adds all keys to the map, that the last restriction depends on.
+func (s *State) AddKeys(keys map[dskey.Key]struct{}) {
+	for key := range s.values {
+		keys[key] = struct{}{}
+	}
+
+	s.superAdminDeps.addTo(keys)
+
+	for _, d := range s.decisions {
+		for _, deps := range d.deps {
+			deps.addTo(keys)
+		}
+	}
+}
+
+// GetChanged is like Get, but only restricts the parts of the data, that
+// depend on the changed keys.
+//
+// changed has to contain all keys, that changed since the last call with the
+// state. Only the values of changed keys and keys, that where not requested on
+// the last call are fetched. Only the restriction modes, that depend on changed
+// keys are calculated again.
+func (r restricter) GetChanged(ctx context.Context, state *State, changed []dskey.Key, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	if !state.valid || state.uid != r.uid {
+		*state = State{uid: r.uid}
+	}
+
+	// The state is only valid, if GetChanged does not return an error.
+	valid := state.valid
+	state.valid = false
+
+	changedSet := make(map[dskey.Key]struct{}, len(changed))
+	for _, key := range changed {
+		changedSet[key] = struct{}{}
+	}
+
+	if !valid || state.superAdminDeps.anyIn(changedSet) {
+		rec := newRecorder(r.getter)
+		isSuperAdmin, err := perm.HasOrganizationManagementLevel(ctx, dsfetch.New(rec), r.uid, perm.OMLSuperadmin)
+		if err != nil {
+			var errDoesNotExist dsfetch.DoesNotExistError
+			if errors.As(err, &errDoesNotExist) || dskey.Key(errDoesNotExist).Collection == "user" {
+				// TODO LAST ERROR
+				return nil, fmt.Errorf("request user %d does not exist", r.uid)
+			}
+			return nil, fmt.Errorf("checking for superadmin: %w", err)
+		}
+
+		state.superAdmin = isSuperAdmin
+		state.superAdminDeps = rec.reads()
+	}
+
+	if err := state.updateValues(ctx, r.getter, changedSet, keys); err != nil {
+		return nil, fmt.Errorf("getting data: %w", err)
+	}
+
+	data := make(map[dskey.Key][]byte, len(state.values))
+	for key, value := range state.values {
+		data[key] = value
+	}
+
+	if state.superAdmin {
+		// The restriction for superadmins is cheap, so it is not cached.
+		if err := restrictSuperAdmin(ctx, r.getter, r.uid, data); err != nil {
+			return nil, fmt.Errorf("restrict as superadmin: %w", err)
+		}
+		state.decisions = nil
+		state.valid = true
+		return data, nil
+	}
+
+	start := time.Now()
+	times, err := state.updateDecisions(ctx, r.getter, changedSet)
+	if err != nil {
+		return nil, fmt.Errorf("restricting data: %w", err)
+	}
+
+	allowedMods := make(map[collection.CM]*set.Set[int], len(state.decisions))
+	for cm, d := range state.decisions {
+		allowedMods[cm] = d.allowed
+	}
+
+	if err := removeRestricted(data, allowedMods); err != nil {
+		return nil, fmt.Errorf("restricting data: %w", err)
+	}
+
+	duration := time.Since(start)
+	if len(times) > 0 && (duration > slowCalls || oserror.HasTagFromContext(ctx, "profile_restrict")) {
+		body, ok := oserror.BodyFromContext(ctx)
+		if !ok {
+			body = "unknown body, probably simple request"
+		}
+		profile(body, duration, times)
+	}
+
+	state.valid = true
+	return data, nil
+}
+
+// updateValues fetches the values of all keys, that are new or changed. Values
+// of keys, that are not requested anymore, are removed.
+func (s *State) updateValues(ctx context.Context, getter datastore.Getter, changed map[dskey.Key]struct{}, keys []dskey.Key) error {
+	if s.values == nil {
+		data, err := getter.Get(ctx, keys...)
+		if err != nil {
+			return err
+		}
+		s.values = data
+		return nil
+	}
+
+	values := make(map[dskey.Key][]byte, len(keys))
+	var fetch []dskey.Key
+	for _, key := range keys {
+		value, ok := s.values[key]
+		if _, isChanged := changed[key]; !ok || isChanged {
+			fetch = append(fetch, key)
+			continue
+		}
+		values[key] = value
+	}
+
+	if len(fetch) > 0 {
+		data, err := getter.Get(ctx, fetch...)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range fetch {
+			values[key] = data[key]
+		}
+	}
+
+	s.values = values
+	return nil
+}
+
+// updateDecisions calculates the restriction modes, that are needed for the
+// values and that are unknown or depend on changed keys.
+func (s *State) updateDecisions(ctx context.Context, getter datastore.Getter, changed map[dskey.Key]struct{}) (map[string]timeCount, error) {
+	restrictModeIDs := make(map[collection.CM]*set.Set[int])
+	for key, value := range s.values {
+		if value == nil {
+			continue
+		}
+
+		if err := groupKeysByCollection(key, value, restrictModeIDs); err != nil {
+			return nil, fmt.Errorf("grouping keys by collection: %w", err)
+		}
+	}
+
+	// All restriction modes, that are calculated in this call, share the
+	// caches like in restrict(). A mode can use cached results of the modes
+	// before it, so it depends on all keys, that where read until it was
+	// calculated.
+	rec := newRecorder(getter)
+	ctx = contextWithCache(ctx, rec, s.uid)
+
+	decisions := make(map[collection.CM]*decision, len(restrictModeIDs))
+	times := make(map[string]timeCount)
+	for _, cm := range sortRestrictModeIDs(restrictModeIDs) {
+		ids := restrictModeIDs[cm]
+
+		d := s.decisions[cm]
+		if d == nil || d.dependsOn(changed) {
+			d = &decision{
+				ids:     set.New[int](),
+				allowed: set.New[int](),
+			}
+		}
+
+		var missing []int
+		for _, id := range ids.List() {
+			if !d.ids.Has(id) {
+				missing = append(missing, id)
+			}
+		}
+
+		if len(missing) > 0 {
+			start := time.Now()
+			if err := d.calculate(ctx, rec, cm, missing); err != nil {
+				return nil, err
+			}
+			d.deps = append(d.deps, rec.reads())
+			times[cm.Collection+"/"+cm.Mode] = timeCount{time: time.Since(start), count: len(missing)}
+		}
+
+		decisions[cm] = d
+	}
+
+	s.decisions = decisions
+	return times, nil
+}
+
+// calculate calls the restriction mode for the ids and adds the result to the
+// decision.
+func (d *decision) calculate(ctx context.Context, getter datastore.Getter, cm collection.CM, ids []int) error {
+	modeFunc, err := restrictModefunc(ctx, cm.Collection, cm.Mode)
+	if err != nil {
+		return fmt.Errorf("getting restiction mode for %s/%s: %w", cm.Collection, cm.Mode, err)
+	}
+
+	allowedIDs, err := modeFunc(ctx, dsfetch.New(getter), ids...)
+	if err != nil {
+		var errDoesNotExist dsfetch.DoesNotExistError
+		if !errors.As(err, &errDoesNotExist) {
+			return fmt.Errorf("calling collection %s modefunc %s with ids %v: %w", cm.Collection, cm.Mode, ids, err)
+		}
+	}
+
+	d.ids.Add(ids...)
+	d.allowed.Add(allowedIDs...)
+	return nil
+}
+
+// dependsOn returns true, if one of the keys was read to calculate the
+// decision.
+func (d *decision) dependsOn(keys map[dskey.Key]struct{}) bool {
+	for _, deps := range d.deps {
+		if deps.anyIn(keys) {
+			return true
+		}
+	}
+	return false
+}
+
+// recorder is a datastore.Getter that remembers all requested keys in the
+// order, they where requested first.
+type recorder struct {
+	getter datastore.Getter
+
+	mu   sync.Mutex
+	keys map[dskey.Key]int
+}
+
+func newRecorder(getter datastore.Getter) *recorder {
+	return &recorder{
+		getter: getter,
+		keys:   make(map[dskey.Key]int),
+	}
+}
+
+func (r *recorder) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	r.mu.Lock()
+	for _, key := range keys {
+		if _, ok := r.keys[key]; !ok {
+			r.keys[key] = len(r.keys)
+		}
+	}
+	r.mu.Unlock()
+
+	return r.getter.Get(ctx, keys...)
+}
+
+// reads returns the keys, that where requested until now.
+//
+// The keys are not copied. They can be used after the recorder gets more
+// keys.
+func (r *recorder) reads() reads {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return reads{keys: r.keys, n: len(r.keys)}
+}
+
+// reads are the first n keys of a recorder.
+type reads struct {
+	keys map[dskey.Key]int
+	n    int
+}
+
+// anyIn returns true, if one of the keys was read.
+func (r reads) anyIn(keys map[dskey.Key]struct{}) bool {
+	for key := range keys {
+		if pos, ok := r.keys[key]; ok && pos < r.n {
+			return true
+		}
+	}
+	return false
+}
+
+// addTo adds all read keys to the map.
+func (r reads) addTo(keys map[dskey.Key]struct{}) {
+	for key, pos := range r.keys {
+		if pos < r.n {
+			keys[key] = struct{}{}
+		}
+	}
+}
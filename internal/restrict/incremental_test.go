@@ -0,0 +1,138 @@
+package restrict_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/restrict"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dsmock"
+)
+
+type changedGetter interface {
+	GetChanged(ctx context.Context, state *restrict.State, changed []dskey.Key, keys ...dskey.Key) (map[dskey.Key][]byte, error)
+}
+
+// recordGetter records the requested keys.
+type recordGetter struct {
+	getter    datastore.Getter
+	requested map[dskey.Key]struct{}
+}
+
+func (r *recordGetter) Get(ctx context.Context, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	for _, key := range keys {
+		r.requested[key] = struct{}{}
+	}
+	return r.getter.Get(ctx, keys...)
+}
+
+func TestGetChanged(t *testing.T) {
+	ds := dsmock.Stub(dsmock.YAMLData(`---
+	meeting/30/id: 30
+	user/1/group_$30_ids: [10]
+	user/1/group_$_ids: ["30"]
+	group/10:
+		meeting_id: 30
+		permissions:
+		- agenda_item.can_see
+	agenda_item:
+		1:
+			meeting_id: 30
+			item_number: one
+		2:
+			meeting_id: 30
+			item_number: two
+			is_internal: true
+	`))
+
+	keys := []dskey.Key{
+		dskey.MustKey("agenda_item/1/item_number"),
+		dskey.MustKey("agenda_item/2/item_number"),
+	}
+
+	getter := &recordGetter{getter: ds}
+	var state restrict.State
+
+	// get returns the data from GetChanged and checks, that it is the same
+	// as from Get.
+	get := func(t *testing.T, changed ...string) map[dskey.Key][]byte {
+		t.Helper()
+
+		getter.requested = make(map[dskey.Key]struct{})
+		ctx, restricter := restrict.Middleware(context.Background(), getter, 1)
+		data, err := restricter.(changedGetter).GetChanged(ctx, &state, mustKeys(changed...), keys...)
+		if err != nil {
+			t.Fatalf("GetChanged: %v", err)
+		}
+		requested := getter.requested
+
+		ctx, restricter = restrict.Middleware(context.Background(), ds, 1)
+		expect, err := restricter.Get(ctx, keys...)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+
+		if !reflect.DeepEqual(data, expect) {
+			t.Errorf("GetChanged returned %v, Get returned %v", data, expect)
+		}
+
+		getter.requested = requested
+		return data
+	}
+
+	data := get(t)
+	if string(data[keys[0]]) != `"one"` || data[keys[1]] != nil {
+		t.Errorf("got %v, expected only agenda_item/1", data)
+	}
+
+	t.Run("value changed", func(t *testing.T) {
+		ds[keys[0]] = []byte(`"first"`)
+		get(t, "agenda_item/1/item_number")
+
+		expect := map[dskey.Key]struct{}{keys[0]: {}}
+		if !reflect.DeepEqual(getter.requested, expect) {
+			t.Errorf("requested %v, expected only %v", getter.requested, keys[0])
+		}
+	})
+
+	t.Run("nothing changed", func(t *testing.T) {
+		get(t)
+
+		if len(getter.requested) != 0 {
+			t.Errorf("requested %v, expected nothing", getter.requested)
+		}
+	})
+
+	t.Run("decision changed", func(t *testing.T) {
+		ds[dskey.MustKey("agenda_item/2/is_internal")] = []byte(`false`)
+		data := get(t, "agenda_item/2/is_internal")
+
+		if string(data[keys[1]]) != `"two"` {
+			t.Errorf("agenda_item/2 was not visible after the change")
+		}
+
+		// The value did not change, so it is not requested again.
+		if _, ok := getter.requested[keys[1]]; ok {
+			t.Errorf("agenda_item/2/item_number was requested again")
+		}
+	})
+
+	t.Run("permission changed", func(t *testing.T) {
+		ds[dskey.MustKey("group/10/permissions")] = []byte(`[]`)
+		data := get(t, "group/10/permissions")
+
+		if data[keys[0]] != nil || data[keys[1]] != nil {
+			t.Errorf("got %v, expected no visible data", data)
+		}
+	})
+}
+
+func mustKeys(rawKeys ...string) []dskey.Key {
+	keys := make([]dskey.Key, len(rawKeys))
+	for i, k := range rawKeys {
+		keys[i] = dskey.MustKey(k)
+	}
+	return keys
+}
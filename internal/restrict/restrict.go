@@ -136,7 +136,16 @@ func restrict(ctx context.Context, getter datastore.Getter, uid int, data map[ds
 		times[cm.Collection+"/"+cm.Mode] = timeCount{time: duration, count: idsCount}
 	}
 
-	// Remove restricted keys.
+	if err := removeRestricted(data, allowedMods); err != nil {
+		return nil, err
+	}
+
+	return times, nil
+}
+
+// removeRestricted sets the values of restricted keys to nil and removes
+// restricted ids from relations.
+func removeRestricted(data map[dskey.Key][]byte, allowedMods map[collection.CM]*set.Set[int]) error {
 	for key := range data {
 		if data[key] == nil {
 			continue
@@ -144,7 +153,7 @@ func restrict(ctx context.Context, getter datastore.Getter, uid int, data map[ds
 
 		restrictionMode, err := restrictModeName(key.Collection, key.Field)
 		if err != nil {
-			return nil, fmt.Errorf("getting restriction Mode for %s: %w", key, err)
+			return fmt.Errorf("getting restriction Mode for %s: %w", key, err)
 		}
 
 		cm := collection.CM{Collection: key.Collection, Mode: restrictionMode}
@@ -155,15 +164,14 @@ func restrict(ctx context.Context, getter datastore.Getter, uid int, data map[ds
 
 		newValue, ok, err := manipulateRelations(key, data[key], allowedMods)
 		if err != nil {
-			return nil, fmt.Errorf("new value for relation key %s: %w", key, err)
+			return fmt.Errorf("new value for relation key %s: %w", key, err)
 		}
 
 		if ok {
 			data[key] = newValue
 		}
 	}
-
-	return times, nil
+	return nil
 }
 
 func restrictSuperAdmin(ctx context.Context, getter datastore.Getter, uid int, data map[dskey.Key][]byte) error {
@@ -7,6 +7,7 @@ import (
 	"log"
 	gohttp "net/http"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/autoupdate"
@@ -26,6 +27,9 @@ import (
 var (
 	envAutoupdatePort = environment.NewVariable("AUTOUPDATE_PORT", "9012", "Port on which the service listen on.")
 	envMetricInterval = environment.NewVariable("METRIC_INTERVAL", "5m", "Time in how often the metrics are gathered. Zero disables the metrics.")
+	envHeartbeat      = environment.NewVariable("AUTOUPDATE_HEARTBEAT", "30s", "Time without messages, after which a stream with the query parameter `control` gets a heartbeat message. Zero disables the heartbeat.")
+	envDrainWindow    = environment.NewVariable("AUTOUPDATE_DRAIN_WINDOW", "10s", "Time on shutdown, in which the clients are told to reconnect. Zero closes all connections immediately.")
+	envPollSessions   = environment.NewVariable("AUTOUPDATE_LONG_POLL_SESSIONS", "50", "Maximum amount of long-polling sessions of one user. Anonymous users have no limit. Zero means no limit.")
 )
 
 var cli struct {
@@ -157,6 +161,7 @@ func initService(lookup environment.Environmenter) (func(context.Context) error,
 
 	// Start metrics.
 	metric.Register(metric.Runtime)
+	metric.Register(auService.Metric)
 	metricTime, err := environment.ParseDuration(envMetricInterval.Value(lookup))
 	if err != nil {
 		return nil, fmt.Errorf("invalid value for `METRIC_INTERVAL`, expected duration got %s: %w", envMetricInterval.Value(lookup), err)
@@ -169,6 +174,21 @@ func initService(lookup environment.Environmenter) (func(context.Context) error,
 		backgroundTasks = append(backgroundTasks, runMetirc)
 	}
 
+	drainWindow, err := environment.ParseDuration(envDrainWindow.Value(lookup))
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for `AUTOUPDATE_DRAIN_WINDOW`, expected duration got %s: %w", envDrainWindow.Value(lookup), err)
+	}
+
+	heartbeat, err := environment.ParseDuration(envHeartbeat.Value(lookup))
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for `AUTOUPDATE_HEARTBEAT`, expected duration got %s: %w", envHeartbeat.Value(lookup), err)
+	}
+
+	maxPollSessions, err := strconv.Atoi(envPollSessions.Value(lookup))
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for `AUTOUPDATE_LONG_POLL_SESSIONS`, expected number got %s: %w", envPollSessions.Value(lookup), err)
+	}
+
 	service := func(ctx context.Context) error {
 		for _, bg := range backgroundTasks {
 			go bg(ctx, oserror.Handle)
@@ -176,7 +196,7 @@ func initService(lookup environment.Environmenter) (func(context.Context) error,
 
 		// Start http server.
 		fmt.Printf("Listen on %s\n", listenAddr)
-		return http.Run(ctx, listenAddr, authService, auService)
+		return http.Run(ctx, listenAddr, authService, auService, drainWindow, heartbeat, maxPollSessions)
 	}
 
 	return service, nil
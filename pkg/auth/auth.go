@@ -42,6 +42,11 @@ const (
 	cookieName = "refreshId"
 	authHeader = "Authentication"
 	authPath   = "/internal/auth/authenticate"
+
+	// TokenProtocolPrefix is the prefix of a websocket subprotocol, that
+	// contains the auth token. Browsers can not set headers on a websocket
+	// connection, so they send the token as subprotocol.
+	TokenProtocolPrefix = "bearer."
 )
 
 // LogoutEventer tells, when a sessionID gets revoked.
@@ -220,8 +225,15 @@ func (a *Auth) pruneOldData(ctx context.Context) {
 
 // loadToken loads and validates the token. If the token is expires, it tries
 // to renews it and writes the new token to the responsewriter.
+//
+// The token is read from the authentication header. If the header is not set,
+// the token is read from the websocket subprotocols.
 func (a *Auth) loadToken(w http.ResponseWriter, r *http.Request, payload jwt.Claims) error {
 	header := r.Header.Get(authHeader)
+	if header == "" {
+		header = protocolToken(r)
+	}
+
 	cookie, err := r.Cookie(cookieName)
 	if err != nil && err != http.ErrNoCookie {
 		return fmt.Errorf("reading cookie: %w", err)
@@ -268,6 +280,20 @@ func (a *Auth) loadToken(w http.ResponseWriter, r *http.Request, payload jwt.Cla
 	return nil
 }
 
+// protocolToken returns the token from the websocket subprotocols of the
+// request in the format of the authentication header. Returns an empty string,
+// if there is no token.
+func protocolToken(r *http.Request) string {
+	for _, header := range r.Header.Values("Sec-Websocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if token, ok := strings.CutPrefix(strings.TrimSpace(protocol), TokenProtocolPrefix); ok {
+				return "bearer " + token
+			}
+		}
+	}
+	return ""
+}
+
 func (a *Auth) handleInvalidToken(ctx context.Context, invalid *jwt.ValidationError, w http.ResponseWriter, encodedToken, encodedCookie string) error {
 	if !tokenExpired(invalid.Errors) {
 		return authError{"Invalid auth token", invalid}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -109,6 +110,18 @@ func TestAuth(t *testing.T) {
 			"",
 			"Can not find auth token",
 		},
+		{
+			"Valid cookie token as websocket protocol",
+			&http.Request{
+				Header: map[string][]string{
+					"Cookie":                 {validCookie},
+					"Sec-Websocket-Protocol": {"json, " + auth.TokenProtocolPrefix + strings.TrimPrefix(validHeader, "bearer ")},
+				},
+			},
+			1,
+			"",
+			"",
+		},
 		{
 			"No cookie Valid token",
 			&http.Request{
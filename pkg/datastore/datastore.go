@@ -38,6 +38,25 @@ type Updater interface {
 	Update(context.Context) (map[dskey.Key][]byte, error)
 }
 
+// UpdateID identifies the state of the datastore after an update.
+type UpdateID struct {
+	// StreamID is the id of the redis stream entry.
+	StreamID string
+
+	// Position is the datastore position. It is 0, if it is unknown.
+	//
+	// If the source does not know the position, it is the max position of the
+	// datastore reader after the update. If there where more writes in the
+	// meantime, it is newer then the data.
+	Position int
+}
+
+// UpdateIDer can be implemented by an Updater. LastUpdateID returns the id of
+// the data, that was returned by the last call to Update.
+type UpdateIDer interface {
+	LastUpdateID() UpdateID
+}
+
 // Source gives the data for keys.
 type Source interface {
 	Getter
@@ -48,6 +67,7 @@ type Source interface {
 type HistoryInformationer interface {
 	HistoryInformation(ctx context.Context, fqid string, w io.Writer) error
 	GetPosition(ctx context.Context, position int, key ...dskey.Key) (map[dskey.Key][]byte, error)
+	MaxPosition(ctx context.Context) (int, error)
 }
 
 // Datastore can be used to get values from the datastore-service.
@@ -67,6 +87,9 @@ type Datastore struct {
 
 	resetMu sync.Mutex
 
+	updateIDMu   sync.Mutex
+	lastUpdateID UpdateID
+
 	metricGetHitCount uint64
 }
 
@@ -137,6 +160,14 @@ func (d *Datastore) GetPosition(ctx context.Context, position int, keys ...dskey
 	return d.history.GetPosition(ctx, position, keys...)
 }
 
+// MaxPosition returns the highest position of the datastore.
+func (d *Datastore) MaxPosition(ctx context.Context) (int, error) {
+	if d.history == nil {
+		return 0, fmt.Errorf("histroy not supported")
+	}
+	return d.history.MaxPosition(ctx)
+}
+
 // RegisterChangeListener registers a function that is called whenever an
 // datastore update happens.
 func (d *Datastore) RegisterChangeListener(f func(map[dskey.Key][]byte) error) {
@@ -173,13 +204,32 @@ func (d *Datastore) HistoryInformation(ctx context.Context, fqid string, w io.Wr
 	return d.history.HistoryInformation(ctx, fqid, w)
 }
 
+// LastUpdateID returns the id of the last update from the default source.
+//
+// When called from a change listener, it is the id of the update, that the
+// listener was called with.
+func (d *Datastore) LastUpdateID() UpdateID {
+	d.updateIDMu.Lock()
+	defer d.updateIDMu.Unlock()
+
+	return d.lastUpdateID
+}
+
+// update is the data from one call to Source.Update.
+type update struct {
+	data map[dskey.Key][]byte
+
+	// id is only set, if the source implements the UpdateIDer interface.
+	id *UpdateID
+}
+
 // listenOnUpdates listens for updates and informs all listeners.
 func (d *Datastore) listenOnUpdates(ctx context.Context, errHandler func(error)) {
 	if errHandler == nil {
 		errHandler = func(error) {}
 	}
 
-	updatedValues := make(chan map[dskey.Key][]byte)
+	updatedValues := make(chan update)
 	sources := make([]Source, 0, len(d.keySource)+1)
 	sources = append(sources, d.defaultSource)
 	for _, s := range d.keySource {
@@ -202,7 +252,22 @@ func (d *Datastore) listenOnUpdates(ctx context.Context, errHandler func(error))
 					time.Sleep(messageBusReconnectPause)
 					continue
 				}
-				updatedValues <- data
+
+				u := update{data: data}
+				if ider, ok := source.(UpdateIDer); ok {
+					id := ider.LastUpdateID()
+					if id.Position == 0 && d.history != nil {
+						// The message bus does not contain the position, so
+						// it is requested from the datastore reader.
+						position, err := d.history.MaxPosition(ctx)
+						if err != nil && !oserror.ContextDone(err) {
+							errHandler(fmt.Errorf("getting position of update: %w", err))
+						}
+						id.Position = position
+					}
+					u.id = &id
+				}
+				updatedValues <- u
 			}
 		}(source)
 	}
@@ -212,7 +277,15 @@ func (d *Datastore) listenOnUpdates(ctx context.Context, errHandler func(error))
 		close(updatedValues)
 	}()
 
-	for data := range updatedValues {
+	for u := range updatedValues {
+		data := u.data
+
+		if u.id != nil {
+			d.updateIDMu.Lock()
+			d.lastUpdateID = *u.id
+			d.updateIDMu.Unlock()
+		}
+
 		// The lock prefents a cache reset while data is updating.
 		d.resetMu.Lock()
 		d.cache.SetIfExistMany(data)
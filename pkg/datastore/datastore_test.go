@@ -3,6 +3,9 @@ package datastore_test
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strconv"
 	"testing"
 	"time"
@@ -424,3 +427,54 @@ func TestResetWhileUpdate(t *testing.T) {
 	// There is nothing to assert. This test is only for the race detector. Make
 	// sure to run the tests with the -race flag.
 }
+
+// streamIDSource is a source, that knows the stream id of its updates but not
+// the position.
+type streamIDSource struct {
+	*dsmock.StubWithUpdate
+}
+
+func (streamIDSource) LastUpdateID() datastore.UpdateID {
+	return datastore.UpdateID{StreamID: "1680000000000-0"}
+}
+
+func TestLastUpdateIDPositionFromReader(t *testing.T) {
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/internal/datastore/reader/get_max_position" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`42`))
+	}))
+	defer reader.Close()
+
+	readerURL, _ := url.Parse(reader.URL)
+	env := environment.ForTests{
+		"DATASTORE_READER_HOST":     readerURL.Hostname(),
+		"DATASTORE_READER_PORT":     readerURL.Port(),
+		"DATASTORE_READER_PROTOCOL": readerURL.Scheme,
+	}
+
+	source := streamIDSource{dsmock.NewStubWithUpdate(dsmock.Stub{})}
+	ds, bg, err := datastore.New(env, nil, datastore.WithDefaultSource(source), datastore.WithHistory())
+	if err != nil {
+		t.Fatalf("init ds: %v", err)
+	}
+	go bg(shutdownCtx, oserror.Handle)
+
+	updateID := make(chan datastore.UpdateID, 1)
+	ds.RegisterChangeListener(func(map[dskey.Key][]byte) error {
+		updateID <- ds.LastUpdateID()
+		return nil
+	})
+
+	source.Send(dsmock.YAMLData("collection/1/field: new value"))
+
+	expect := datastore.UpdateID{StreamID: "1680000000000-0", Position: 42}
+	if got := <-updateID; got != expect {
+		t.Errorf("Got update id %v, expected %v", got, expect)
+	}
+}
@@ -0,0 +1,168 @@
+package datastore
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/internal/metric"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/environment"
+)
+
+var envHistoryCacheSize = environment.NewVariable("DATASTORE_HISTORY_CACHE_SIZE", "104857600", "Maximum size in bytes of the values from the history that are cached. Zero disables the cache.")
+
+// historyCacheEntryOverhead is the estimated memory of a cache entry without
+// its value and the strings of its key. It is the map entry, the list element
+// and the entry itself.
+const historyCacheEntryOverhead = 128
+
+// positionKey identifies a value in the history.
+type positionKey struct {
+	position int
+	key      dskey.Key
+}
+
+// historyCacheEntry is an element of the lru list.
+type historyCacheEntry struct {
+	positionKey
+	value []byte
+}
+
+// size returns the estimated memory of the entry in bytes.
+func (e *historyCacheEntry) size() int {
+	return historyCacheEntryOverhead + len(e.key.Collection) + len(e.key.Field) + len(e.value)
+}
+
+// historyCache is a size-bounded lru cache in front of a history source.
+//
+// Data at a position never changes, so the values are never invalidated. When
+// the cache is bigger then maxSize bytes, the least recently used values are
+// removed. A value, that is bigger then the cache, is not cached.
+//
+// Position 0 means the current position. It is not cached.
+type historyCache struct {
+	source  HistoryInformationer
+	maxSize int
+
+	mu    sync.Mutex
+	data  map[positionKey]*list.Element
+	order *list.List
+	size  int
+
+	metricHits      uint64
+	metricMisses    uint64
+	metricEvictions uint64
+}
+
+// newHistoryCache initializes a historyCache that holds up to maxSize bytes.
+func newHistoryCache(source HistoryInformationer, maxSize int) *historyCache {
+	return &historyCache{
+		source:  source,
+		maxSize: maxSize,
+		data:    make(map[positionKey]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// GetPosition returns the values from the cache and fetches the missing
+// values from the source.
+func (h *historyCache) GetPosition(ctx context.Context, position int, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	if position <= 0 {
+		return h.source.GetPosition(ctx, position, keys...)
+	}
+
+	result := make(map[dskey.Key][]byte, len(keys))
+	var missing []dskey.Key
+
+	h.mu.Lock()
+	for _, key := range keys {
+		element, ok := h.data[positionKey{position, key}]
+		if !ok {
+			missing = append(missing, key)
+			continue
+		}
+
+		h.order.MoveToFront(element)
+		result[key] = element.Value.(*historyCacheEntry).value
+	}
+	h.mu.Unlock()
+
+	atomic.AddUint64(&h.metricHits, uint64(len(keys)-len(missing)))
+	atomic.AddUint64(&h.metricMisses, uint64(len(missing)))
+
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	data, err := h.source.GetPosition(ctx, position, missing...)
+	if err != nil {
+		return nil, fmt.Errorf("fetching missing keys: %w", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, key := range missing {
+		value := data[key]
+		result[key] = value
+		h.add(positionKey{position, key}, value)
+	}
+
+	return result, nil
+}
+
+// add adds a value to the cache and removes the oldest values, if the cache
+// is full.
+//
+// Has to be called with the lock.
+func (h *historyCache) add(pk positionKey, value []byte) {
+	if element, ok := h.data[pk]; ok {
+		// Another call fetched the value at the same time.
+		h.order.MoveToFront(element)
+		return
+	}
+
+	entry := &historyCacheEntry{positionKey: pk, value: value}
+	if entry.size() > h.maxSize {
+		return
+	}
+
+	h.data[pk] = h.order.PushFront(entry)
+	h.size += entry.size()
+
+	for h.size > h.maxSize {
+		oldest := h.order.Back()
+		oldestEntry := oldest.Value.(*historyCacheEntry)
+		h.order.Remove(oldest)
+		delete(h.data, oldestEntry.positionKey)
+		h.size -= oldestEntry.size()
+		atomic.AddUint64(&h.metricEvictions, 1)
+	}
+}
+
+// HistoryInformation is not cached, since it changes with each new position.
+func (h *historyCache) HistoryInformation(ctx context.Context, fqid string, w io.Writer) error {
+	return h.source.HistoryInformation(ctx, fqid, w)
+}
+
+// MaxPosition is not cached, since it changes with each new position.
+func (h *historyCache) MaxPosition(ctx context.Context) (int, error) {
+	return h.source.MaxPosition(ctx)
+}
+
+func (h *historyCache) metric(values metric.Container) {
+	h.mu.Lock()
+	length := h.order.Len()
+	size := h.size
+	h.mu.Unlock()
+
+	values.Add("datastore_history_cache_len", length)
+	values.Add("datastore_history_cache_bytes", size)
+	values.Add("datastore_history_cache_hits", int(atomic.LoadUint64(&h.metricHits)))
+	values.Add("datastore_history_cache_misses", int(atomic.LoadUint64(&h.metricMisses)))
+	values.Add("datastore_history_cache_evictions", int(atomic.LoadUint64(&h.metricEvictions)))
+}
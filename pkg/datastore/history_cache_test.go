@@ -0,0 +1,133 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
+)
+
+// historySourceMock returns the position as value and counts the requested
+// keys.
+type historySourceMock struct {
+	requested []dskey.Key
+}
+
+func (h *historySourceMock) GetPosition(ctx context.Context, position int, keys ...dskey.Key) (map[dskey.Key][]byte, error) {
+	h.requested = append(h.requested, keys...)
+
+	data := make(map[dskey.Key][]byte, len(keys))
+	for _, key := range keys {
+		data[key] = []byte(fmt.Sprint(position))
+	}
+	return data, nil
+}
+
+func (h *historySourceMock) HistoryInformation(ctx context.Context, fqid string, w io.Writer) error {
+	return nil
+}
+
+func (h *historySourceMock) MaxPosition(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func TestHistoryCache(t *testing.T) {
+	ctx := context.Background()
+	key1 := dskey.MustKey("user/1/username")
+	key2 := dskey.MustKey("user/2/username")
+	key3 := dskey.MustKey("user/3/username")
+
+	// Each value is one byte, so the cache can hold two values.
+	entrySize := (&historyCacheEntry{positionKey: positionKey{5, key1}, value: []byte("5")}).size()
+
+	source := &historySourceMock{}
+	hc := newHistoryCache(source, 2*entrySize)
+
+	get := func(position int, keys ...dskey.Key) map[dskey.Key][]byte {
+		t.Helper()
+		data, err := hc.GetPosition(ctx, position, keys...)
+		if err != nil {
+			t.Fatalf("GetPosition: %v", err)
+		}
+		return data
+	}
+
+	got := get(5, key1, key2)
+	expect := map[dskey.Key][]byte{key1: []byte("5"), key2: []byte("5")}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("got %v, expected %v", got, expect)
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		source.requested = nil
+		get(5, key1, key2)
+
+		if len(source.requested) != 0 {
+			t.Errorf("source was called with %v, expected no call", source.requested)
+		}
+	})
+
+	t.Run("other position", func(t *testing.T) {
+		source.requested = nil
+		got := get(6, key1)
+
+		if !reflect.DeepEqual(source.requested, []dskey.Key{key1}) {
+			t.Errorf("source was called with %v, expected %v", source.requested, []dskey.Key{key1})
+		}
+
+		if string(got[key1]) != "6" {
+			t.Errorf("got %s, expected 6", got[key1])
+		}
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		// The cache contains 6:key1 and 5:key2. 5:key1 was evicted.
+		source.requested = nil
+		get(5, key2)
+		get(5, key1)
+
+		if !reflect.DeepEqual(source.requested, []dskey.Key{key1}) {
+			t.Errorf("source was called with %v, expected %v", source.requested, []dskey.Key{key1})
+		}
+	})
+
+	t.Run("current position", func(t *testing.T) {
+		source.requested = nil
+		get(0, key3)
+		get(0, key3)
+
+		if len(source.requested) != 2 {
+			t.Errorf("source was called with %v, expected two calls", source.requested)
+		}
+	})
+
+	t.Run("too big value", func(t *testing.T) {
+		small := newHistoryCache(source, entrySize-1)
+		source.requested = nil
+		small.GetPosition(ctx, 5, key1)
+		small.GetPosition(ctx, 5, key1)
+
+		if len(source.requested) != 2 {
+			t.Errorf("source was called with %v, expected two calls", source.requested)
+		}
+
+		if small.size != 0 {
+			t.Errorf("got size %d, expected 0", small.size)
+		}
+	})
+
+	if hc.size != 2*entrySize {
+		t.Errorf("got size %d, expected %d", hc.size, 2*entrySize)
+	}
+
+	if hc.metricEvictions != 2 {
+		t.Errorf("got %d evictions, expected 2", hc.metricEvictions)
+	}
+
+	if hc.metricHits != 3 || hc.metricMisses != 4 {
+		t.Errorf("got %d hits and %d misses, expected 3 and 4", hc.metricHits, hc.metricMisses)
+	}
+}
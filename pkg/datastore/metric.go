@@ -9,10 +9,13 @@ func (d *Datastore) metric(values metric.Container) {
 	values.Add("datastore_cache_size", d.cache.size())
 	values.Add("datastore_get_calls", int(d.metricGetHitCount))
 
-	if d.history != nil {
-		ds, ok := d.history.(*sourceDatastore)
-		if ok {
-			values.Add("datastore_hits", int(ds.metricDSHitCount))
-		}
+	history := d.history
+	if hc, ok := history.(*historyCache); ok {
+		hc.metric(values)
+		history = hc.source
+	}
+
+	if ds, ok := history.(*sourceDatastore); ok {
+		values.Add("datastore_hits", int(ds.metricDSHitCount))
 	}
 }
@@ -3,6 +3,7 @@ package datastore
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/OpenSlides/openslides-autoupdate-service/internal/projector"
@@ -39,6 +40,15 @@ func WithHistory() Option {
 		}
 		ds.history = datastoreSource
 
+		cacheSize, err := strconv.Atoi(envHistoryCacheSize.Value(lookup))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", envHistoryCacheSize.Key, err)
+		}
+
+		if cacheSize > 0 {
+			ds.history = newHistoryCache(datastoreSource, cacheSize)
+		}
+
 		return nil, nil
 	}
 }
@@ -3,6 +3,7 @@ package datastore
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -30,6 +31,7 @@ var (
 const (
 	urlGetMany            = "/internal/datastore/reader/get_many"
 	urlHistoryInformation = "/internal/datastore/reader/history_information"
+	urlMaxPosition        = "/internal/datastore/reader/get_max_position"
 )
 
 // sourceDatastore receives the data from the datastore-reader via http and
@@ -229,3 +231,31 @@ func (s *sourceDatastore) HistoryInformation(ctx context.Context, fqid string, w
 
 	return nil
 }
+
+// MaxPosition requests the highest position from the datastore.
+func (s *sourceDatastore) MaxPosition(ctx context.Context) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url+urlMaxPosition, strings.NewReader("{}"))
+	if err != nil {
+		return 0, fmt.Errorf("creating request for datastore: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("sending request to datastore: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// TODO External Error
+		return 0, fmt.Errorf("datastore returned %s", resp.Status)
+	}
+
+	var position int
+	if err := json.NewDecoder(resp.Body).Decode(&position); err != nil {
+		return 0, fmt.Errorf("decoding datastore response: %w", err)
+	}
+
+	return position, nil
+}
@@ -115,3 +115,37 @@ func handleGetMany(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+func TestSourceMaxPosition(t *testing.T) {
+	var path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		fmt.Fprint(w, "42")
+	}))
+	defer ts.Close()
+
+	host, port, schema := parseURL(ts.URL)
+	env := environment.ForTests(map[string]string{
+		"DATASTORE_READER_HOST":     host,
+		"DATASTORE_READER_PORT":     port,
+		"DATASTORE_READER_PROTOCOL": schema,
+	})
+
+	sd, err := newSourceDatastore(env)
+	if err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	got, err := sd.MaxPosition(context.Background())
+	if err != nil {
+		t.Fatalf("MaxPosition: %v", err)
+	}
+
+	if got != 42 {
+		t.Errorf("got position %d, expected 42", got)
+	}
+
+	if path != urlMaxPosition {
+		t.Errorf("requested %s, expected %s", path, urlMaxPosition)
+	}
+}
@@ -136,6 +136,15 @@ func (p *SourcePostgres) Update(ctx context.Context) (map[dskey.Key][]byte, erro
 	return p.updater.Update(ctx)
 }
 
+// LastUpdateID returns the update id from the updater, if it implements the
+// UpdateIDer interface.
+func (p *SourcePostgres) LastUpdateID() UpdateID {
+	if ider, ok := p.updater.(UpdateIDer); ok {
+		return ider.LastUpdateID()
+	}
+	return UpdateID{}
+}
+
 func prepareQuery(keys []dskey.Key) (uniqueFieldsStr string, fieldIndex map[string]int, uniqueFQID []string) {
 	uniqueFQIDSet := make(map[string]struct{})
 	uniqueFieldsSet := make(map[string]struct{})
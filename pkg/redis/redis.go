@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/datastore/dskey"
 	"github.com/OpenSlides/openslides-autoupdate-service/pkg/environment"
 	"github.com/gomodule/redigo/redis"
@@ -89,6 +90,16 @@ func (r *Redis) Update(ctx context.Context) (map[dskey.Key][]byte, error) {
 	return data, nil
 }
 
+// LastUpdateID returns the redis stream id of the data, that was returned by
+// the last call to Update.
+//
+// The stream does not contain the datastore position, so the position is 0.
+func (r *Redis) LastUpdateID() datastore.UpdateID {
+	return datastore.UpdateID{
+		StreamID: r.lastAutoupdateID,
+	}
+}
+
 // LogoutEvent is a blocking function that returns, when a session was revoked.
 func (r *Redis) LogoutEvent(ctx context.Context) ([]string, error) {
 	id := r.lastLogoutID